@@ -9,25 +9,90 @@ import (
 type Iterator struct {
 	indexIter index.IndexrIterator
 	db        *DB
+	ns        *Namespace // nil for the default namespace
 	config    IteratorConfigs
+	// the real range of keys: [lower, upper), merged from bounds and prefix
+	lower []byte
+	upper []byte
+	// the iterator has run out of the range
+	done bool
 }
 
 func (db *DB) NewIterator(config IteratorConfigs) *Iterator {
-	indexIter := db.index.Iterator(config.Reverse)
-	return &Iterator{
-		indexIter: indexIter,
+	return db.newIterator(db.index, nil, config)
+}
+func (db *DB) newIterator(indexer index.Indexer, ns *Namespace, config IteratorConfigs) *Iterator {
+	lower, upper := config.LowerBound, config.UpperBound
+	if len(config.Prefix) > 0 {
+		// keys with the prefix are in [prefix, prefixEnd)
+		if lower == nil || bytes.Compare(config.Prefix, lower) > 0 {
+			lower = config.Prefix
+		}
+		if prefixEnd := prefixSuccessor(config.Prefix); prefixEnd != nil &&
+			(upper == nil || bytes.Compare(prefixEnd, upper) < 0) {
+			upper = prefixEnd
+		}
+	}
+	// the index only collects keys in the range
+	it := &Iterator{
+		indexIter: indexer.RangeIterator(config.Reverse, lower, upper),
 		db:        db,
+		ns:        ns,
 		config:    config,
+		lower:     lower,
+		upper:     upper,
 	}
+	it.Rewind()
+	return it
 }
 func (it *Iterator) Rewind() {
-	it.indexIter.Rewind()
+	it.done = false
+	// jump to the bound directly instead of walking from the first key
+	if !it.config.Reverse && it.lower != nil {
+		it.indexIter.Seek(it.lower)
+	} else if it.config.Reverse && it.upper != nil {
+		it.indexIter.Seek(it.upper)
+	} else {
+		it.indexIter.Rewind()
+	}
 	it.Filter()
 }
+
+// Seek Find the first key that is greater (or less when reverse) than or equal to key
 func (it *Iterator) Seek(key []byte) {
+	it.done = false
+	if !it.config.Reverse && it.lower != nil && bytes.Compare(key, it.lower) < 0 {
+		key = it.lower
+	} else if it.config.Reverse && it.upper != nil && bytes.Compare(key, it.upper) > 0 {
+		key = it.upper
+	}
 	it.indexIter.Seek(key)
 	it.Filter()
 }
+
+// SeekForPrev Find the last key that is less (or greater when reverse) than or equal to key,
+// a key at or past UpperBound lands on the last key below UpperBound.
+// An expired key of a namespace may be found, its Value is ErrorKeyNotFound.
+func (it *Iterator) SeekForPrev(key []byte) {
+	it.done = false
+	if it.config.Reverse && it.lower != nil && bytes.Compare(key, it.lower) < 0 {
+		key = it.lower
+	} else if !it.config.Reverse && it.upper != nil && bytes.Compare(key, it.upper) >= 0 {
+		// upper is excluded, land on the last key before it
+		it.indexIter.SeekBefore(it.upper)
+		it.checkRange()
+		return
+	}
+	it.indexIter.SeekForPrev(key)
+	it.checkRange()
+}
+
+// checkRange stop at a key out of the range after SeekForPrev
+func (it *Iterator) checkRange() {
+	if it.indexIter.Valid() && !it.inRange(it.indexIter.Key()) {
+		it.done = true
+	}
+}
 func (it *Iterator) Next() {
 	it.indexIter.Next()
 	it.Filter()
@@ -36,27 +101,67 @@ func (it *Iterator) Close() {
 	it.indexIter.Close()
 }
 func (it *Iterator) Valid() bool {
-	return it.indexIter.Valid()
+	return !it.done && it.indexIter.Valid()
 }
 func (it *Iterator) Key() []byte {
 	return it.indexIter.Key()
 }
 func (it *Iterator) Value() ([]byte, error) {
+	if it.config.KeyOnly {
+		return nil, ErrorIteratorKeyOnly
+	}
 	logRecordPos := it.indexIter.Value()
 	it.db.mutex.RLock()
 	defer it.db.mutex.RUnlock()
-	return it.db.getValueByPosition(logRecordPos)
+	if it.ns != nil {
+		return it.ns.getValueByPosition(logRecordPos)
+	}
+	return it.db.getValue(it.indexIter.Key(), logRecordPos)
 }
+
+// Filter skip the keys before the range and expired keys of namespaces,
+// and stop once keys run out of the range
 func (it *Iterator) Filter() {
-	prefixLens := len(it.config.Prefix)
-	if prefixLens == 0 {
+	checkExpired := it.ns != nil && it.ns.options.TTL > 0
+	if it.lower == nil && it.upper == nil && !checkExpired {
 		return
 	}
 	for ; it.indexIter.Valid(); it.indexIter.Next() {
 		key := it.indexIter.Key()
-		if prefixLens <= len(key) && bytes.Compare(it.config.Prefix, key[:prefixLens]) == 0 {
-			break
+		if it.inRange(key) {
+			if checkExpired && it.ns.expiredAt(it.indexIter.Value()) {
+				continue
+			}
+			return
+		}
+		// keys are ordered, so no more keys in the range
+		if !it.config.Reverse && it.upper != nil && bytes.Compare(key, it.upper) >= 0 ||
+			it.config.Reverse && it.lower != nil && bytes.Compare(key, it.lower) < 0 {
+			it.done = true
+			return
 		}
+	}
+}
+func (it *Iterator) inRange(key []byte) bool {
+	if it.lower != nil && bytes.Compare(key, it.lower) < 0 {
+		return false
+	}
+	if it.upper != nil && bytes.Compare(key, it.upper) >= 0 {
+		return false
+	}
+	return true
+}
 
+// prefixSuccessor get the smallest key that is greater than all keys with the prefix,
+// return nil if there isn't (prefix is all 0xff)
+func prefixSuccessor(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			end := make([]byte, i+1)
+			copy(end, prefix[:i+1])
+			end[i]++
+			return end
+		}
 	}
+	return nil
 }
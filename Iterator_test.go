@@ -90,3 +90,128 @@ func TestDB_Iterator_Multi_Values(t *testing.T) {
 		assert.NotNil(t, iter3.Key())
 	}
 }
+
+func TestDB_Iterator_Bounds(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-iterator-bounds")
+	opts.DirPath = dir + "/"
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for _, key := range []string{"aa", "ab", "abc", "ac", "b", "ba", "c"} {
+		err := db.Put([]byte(key), []byte(key))
+		assert.Nil(t, err)
+	}
+	collect := func(iter *Iterator) []string {
+		var keys []string
+		for ; iter.Valid(); iter.Next() {
+			keys = append(keys, string(iter.Key()))
+		}
+		return keys
+	}
+
+	// 1.lower and upper bound
+	iterOpts := DefaultIteratorConfigs
+	iterOpts.LowerBound = []byte("ab")
+	iterOpts.UpperBound = []byte("b")
+	iter1 := db.NewIterator(iterOpts)
+	assert.Equal(t, []string{"ab", "abc", "ac"}, collect(iter1))
+	iter1.Close()
+
+	// 2.reverse with bounds
+	iterOpts.Reverse = true
+	iter2 := db.NewIterator(iterOpts)
+	assert.Equal(t, []string{"ac", "abc", "ab"}, collect(iter2))
+	iter2.Close()
+
+	// 3.prefix stops in both directions
+	iterOpts = DefaultIteratorConfigs
+	iterOpts.Prefix = []byte("ab")
+	iter3 := db.NewIterator(iterOpts)
+	assert.Equal(t, []string{"ab", "abc"}, collect(iter3))
+	iter3.Close()
+	iterOpts.Reverse = true
+	iter4 := db.NewIterator(iterOpts)
+	assert.Equal(t, []string{"abc", "ab"}, collect(iter4))
+	iter4.Close()
+
+	// 4.seek out of the range
+	iterOpts = DefaultIteratorConfigs
+	iterOpts.Prefix = []byte("a")
+	iter5 := db.NewIterator(iterOpts)
+	iter5.Seek([]byte("b"))
+	assert.False(t, iter5.Valid())
+	iter5.Seek([]byte("0"))
+	assert.Equal(t, []byte("aa"), iter5.Key())
+	iter5.Close()
+
+	// 5.seek for prev past the upper bound
+	iterOpts = DefaultIteratorConfigs
+	iterOpts.UpperBound = []byte("b")
+	iter6 := db.NewIterator(iterOpts)
+	iter6.SeekForPrev([]byte("b"))
+	assert.Equal(t, []byte("ac"), iter6.Key())
+	iter6.SeekForPrev([]byte("z"))
+	assert.Equal(t, []byte("ac"), iter6.Key())
+	iter6.Next()
+	assert.False(t, iter6.Valid())
+	iter6.SeekForPrev([]byte("a"))
+	assert.False(t, iter6.Valid())
+	iter6.Close()
+}
+
+func TestDB_Iterator_SeekForPrev(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-iterator-seek-prev")
+	opts.DirPath = dir + "/"
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for _, key := range []string{"a", "c", "e"} {
+		err := db.Put([]byte(key), []byte(key))
+		assert.Nil(t, err)
+	}
+	iter1 := db.NewIterator(DefaultIteratorConfigs)
+	iter1.SeekForPrev([]byte("d"))
+	assert.Equal(t, []byte("c"), iter1.Key())
+	iter1.SeekForPrev([]byte("c"))
+	assert.Equal(t, []byte("c"), iter1.Key())
+	iter1.SeekForPrev([]byte("0"))
+	assert.False(t, iter1.Valid())
+	iter1.Close()
+
+	iterOpts := DefaultIteratorConfigs
+	iterOpts.Reverse = true
+	iter2 := db.NewIterator(iterOpts)
+	iter2.SeekForPrev([]byte("b"))
+	assert.Equal(t, []byte("c"), iter2.Key())
+	iter2.SeekForPrev([]byte("f"))
+	assert.False(t, iter2.Valid())
+	iter2.Close()
+}
+
+func TestDB_Iterator_KeyOnly(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-iterator-key-only")
+	opts.DirPath = dir + "/"
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Put(utils.GetTestKey(1), utils.RandomValue(10))
+	assert.Nil(t, err)
+
+	iterOpts := DefaultIteratorConfigs
+	iterOpts.KeyOnly = true
+	iter := db.NewIterator(iterOpts)
+	defer iter.Close()
+	assert.True(t, iter.Valid())
+	assert.Equal(t, utils.GetTestKey(1), iter.Key())
+	_, err = iter.Value()
+	assert.Equal(t, ErrorIteratorKeyOnly, err)
+}
@@ -0,0 +1,505 @@
+package KVstore
+
+import (
+	"KVstore/data"
+	"KVstore/index"
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	BackupManifestFileName = "BACKUP_MANIFEST"
+	// read and write files by this size when copying
+	backupCopyBufferSize = 1024 * 1024
+)
+
+// BackupManifest records the files in a backup dir,
+// so that the next backup only copies new or changed files
+type BackupManifest struct {
+	Files        []BackupFile `json:"files"`
+	SeqNo        uint64       `json:"seq_no"`
+	ActiveFileId uint32       `json:"active_file_id"`
+	ActiveOffset int64        `json:"active_offset"` // the active file is copied up to here
+	CreatedAt    time.Time    `json:"created_at"`
+}
+type BackupFile struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"` // mod time of the source file when copied
+	CRC     uint32    `json:"crc"`      // crc of the whole file in backup
+}
+
+// a file to back up, only the first size bytes are copied
+type backupSource struct {
+	name  string
+	size  int64
+	index *index.BPlusTreeSnapshot // written instead of the file if not nil
+}
+
+// Backup copy the db to dir. If dir holds an earlier backup of this db,
+// only new or changed files and the tail of the active file are copied.
+// Writes are blocked only when getting the file list.
+func (db *DB) Backup(dir string) error {
+	_, err := db.backup(context.Background(), dir)
+	return err
+}
+
+// BackupContext ctx is checked between files and copied chunks, a canceled
+// backup keeps the old manifest, the next backup copies the files again
+func (db *DB) BackupContext(ctx context.Context, dir string) error {
+	_, err := db.backup(ctx, dir)
+	return err
+}
+
+func (db *DB) backup(ctx context.Context, dir string) (manifest *BackupManifest, err error) {
+	end := db.beginBackup(dir)
+	defer func() {
+		end(err)
+	}()
+	manifest, sources, err := db.backupSources(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer closeBackupSources(sources)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	oldManifest, err := ReadBackupManifest(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	oldFiles := make(map[string]BackupFile)
+	if oldManifest != nil {
+		for _, file := range oldManifest.Files {
+			oldFiles[file.Name] = file
+		}
+	}
+
+	for _, source := range sources {
+		file, err := copyBackupFile(ctx, db.limiter, db.config.DirPath, dir, source, oldFiles[source.name])
+		if err != nil {
+			return nil, err
+		}
+		manifest.Files = append(manifest.Files, *file)
+		delete(oldFiles, source.name)
+	}
+	// files removed by merge are removed from backup too
+	for name := range oldFiles {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	if err := writeBackupManifest(dir, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// BackupTo stream a tar archive of the db to w, the manifest is the last entry
+// of the archive since the crc of files is known after writing them.
+// Writes are blocked only when getting the file list.
+func (db *DB) BackupTo(w io.Writer) error {
+	return db.BackupToContext(context.Background(), w)
+}
+
+// BackupToContext ctx is checked between files and copied chunks,
+// the archive is incomplete if ctx is done
+func (db *DB) BackupToContext(ctx context.Context, w io.Writer) (err error) {
+	end := db.beginBackup("")
+	defer func() {
+		end(err)
+	}()
+	snapshot, err := db.NewBackupSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+	return snapshot.writeTar(ctx, w)
+}
+
+// BackupSnapshot the files of a BackupTo archive taken at one point of the log,
+// the archive is written later by Stream without blocking writes
+type BackupSnapshot struct {
+	db       *DB
+	manifest *BackupManifest
+	sources  []backupSource
+}
+
+// NewBackupSnapshot take the files to back up now, writes are blocked only
+// for this. Close it when done, merged files are not installed until Open anyway.
+func (db *DB) NewBackupSnapshot(ctx context.Context) (*BackupSnapshot, error) {
+	manifest, sources, err := db.backupSources(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &BackupSnapshot{db: db, manifest: manifest, sources: sources}, nil
+}
+
+// Stream write the archive of the snapshot to w as BackupTo does,
+// it can be called only once
+func (s *BackupSnapshot) Stream(ctx context.Context, w io.Writer) (err error) {
+	end := s.db.beginBackup("")
+	defer func() {
+		end(err)
+	}()
+	return s.writeTar(ctx, w)
+}
+
+func (s *BackupSnapshot) Close() {
+	closeBackupSources(s.sources)
+}
+
+func (s *BackupSnapshot) writeTar(ctx context.Context, w io.Writer) error {
+	manifest := s.manifest
+	tw := tar.NewWriter(w)
+	for _, source := range s.sources {
+		file, err := writeTarFile(ctx, s.db.limiter, tw, s.db.config.DirPath, source)
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, *file)
+	}
+	buf, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    BackupManifestFileName,
+		Mode:    0644,
+		Size:    int64(len(buf)),
+		ModTime: manifest.CreatedAt,
+	}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(buf); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// write the first size bytes of the source file to the archive
+func writeTarFile(ctx context.Context, limiter *rateLimiter, tw *tar.Writer, srcDir string,
+	source backupSource) (*BackupFile, error) {
+	file := &BackupFile{Name: source.name, Size: source.size}
+	var copyTo func(w io.Writer) error
+	if source.index != nil {
+		file.ModTime = time.Now()
+		copyTo = func(w io.Writer) error {
+			_, err := source.index.WriteTo(contextWriter{ctx: ctx, w: w, limiter: limiter})
+			return err
+		}
+	} else {
+		src, err := os.Open(filepath.Join(srcDir, source.name))
+		if err != nil {
+			return nil, err
+		}
+		defer src.Close()
+		info, err := src.Stat()
+		if err != nil {
+			return nil, err
+		}
+		file.ModTime = info.ModTime()
+		if file.Size < 0 {
+			file.Size = info.Size()
+		}
+		copyTo = func(w io.Writer) error {
+			_, err := io.CopyN(w, contextReader{ctx: ctx, r: src, limiter: limiter}, file.Size)
+			return err
+		}
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    file.Name,
+		Mode:    0644,
+		Size:    file.Size,
+		ModTime: file.ModTime,
+	}); err != nil {
+		return nil, err
+	}
+	hash := crc32.NewIEEE()
+	if err := copyTo(io.MultiWriter(tw, hash)); err != nil {
+		return nil, err
+	}
+	file.CRC = hash.Sum32()
+	return file, nil
+}
+
+// Checkpoint create a copy of the db in dir which can be opened directly.
+// Sealed files are hard linked and only the active file is copied, so it takes
+// almost no time and space if dir is on the same filesystem as the db.
+// B+ tree index is copied into dir too, open it with IndexerDirPath set to dir.
+func (db *DB) Checkpoint(dir string) error {
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return ErrorCheckpointDirNotEmpty
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	_, sources, err := db.backupSources(context.Background())
+	if err != nil {
+		return err
+	}
+	defer closeBackupSources(sources)
+	for _, source := range sources {
+		// sealed files are never changed, merge only replaces them by rename
+		if source.size < 0 {
+			err := os.Link(filepath.Join(db.config.DirPath, source.name), filepath.Join(dir, source.name))
+			if err == nil {
+				continue
+			}
+			// e.g. dir is on another filesystem, fall back to copy
+		}
+		if _, err := copyBackupFile(context.Background(), nil, db.config.DirPath, dir, source, BackupFile{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// get files to back up under the lock, sealed files won't change until merge
+// files are installed by Open, the active file is copied up to WriteOffset
+func (db *DB) backupSources(ctx context.Context) (*BackupManifest, []backupSource, error) {
+	if err := db.lockContext(ctx); err != nil {
+		return nil, nil, err
+	}
+	defer db.mutex.Unlock()
+	manifest := &BackupManifest{
+		SeqNo:     db.seqNo,
+		CreatedAt: time.Now(),
+	}
+	var sources []backupSource
+	for fid := range db.olderFiles {
+		sources = append(sources, backupSource{name: filepath.Base(data.GetDataFileName("", fid)), size: -1})
+	}
+	if db.activeFile != nil {
+		manifest.ActiveFileId = db.activeFile.FileId
+		manifest.ActiveOffset = db.activeFile.WriteOffset
+		sources = append(sources, backupSource{
+			name: filepath.Base(data.GetDataFileName("", db.activeFile.FileId)),
+			size: db.activeFile.WriteOffset,
+		})
+	}
+	// written by merge, needed to load merged files
+	for _, name := range []string{data.HintFileName, data.MergeFinishedFileName} {
+		if _, err := os.Stat(filepath.Join(db.config.DirPath, name)); err == nil {
+			sources = append(sources, backupSource{name: name, size: -1})
+		}
+	}
+	// B+ tree index is not loaded from data files, take it at the same point
+	// as the active file. It is in the backup dir next to data files.
+	if bpt, ok := db.index.(*index.BPlusTree); ok {
+		snapshot, err := bpt.Snapshot()
+		if err != nil {
+			return nil, nil, err
+		}
+		sources = append(sources, backupSource{name: index.BPTreeIndexFileName, size: snapshot.Size(), index: snapshot})
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i].name < sources[j].name
+	})
+	return manifest, sources, nil
+}
+
+// copyBackupFile copy source into dir, skip it if not changed since the old backup,
+// and only copy the tail if the old backup is a prefix of it (e.g. the active file)
+func copyBackupFile(ctx context.Context, limiter *rateLimiter, srcDir, destDir string,
+	source backupSource, old BackupFile) (*BackupFile, error) {
+	if source.index != nil {
+		return copyIndexSnapshot(ctx, limiter, destDir, source)
+	}
+	srcPath := filepath.Join(srcDir, source.name)
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return nil, err
+	}
+	size := source.size
+	if size < 0 {
+		size = info.Size()
+	}
+	file := &BackupFile{Name: source.name, Size: size, ModTime: info.ModTime()}
+	if old.Name == file.Name && old.Size == file.Size && old.ModTime.Equal(file.ModTime) {
+		file.CRC = old.CRC
+		return file, nil
+	}
+
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	destPath := filepath.Join(destDir, source.name)
+	var from int64 = 0
+	var crc uint32 = 0
+	// the old backup must be still there to append to it
+	if destInfo, err := os.Stat(destPath); err == nil &&
+		old.Name == file.Name && old.Size <= size && destInfo.Size() == old.Size {
+		prefixCRC, err := fileCRC(src, old.Size)
+		if err != nil {
+			return nil, err
+		}
+		if prefixCRC == old.CRC {
+			from, crc = old.Size, old.CRC
+		}
+	}
+	flag := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if from > 0 {
+		flag = os.O_WRONLY | os.O_APPEND
+	}
+	dest, err := os.OpenFile(destPath, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer dest.Close()
+	if _, err := src.Seek(from, io.SeekStart); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, backupCopyBufferSize)
+	for remain := size - from; remain > 0; {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		n := int64(len(buf))
+		if remain < n {
+			n = remain
+		}
+		if err := limiter.wait(ctx, n); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(src, buf[:n]); err != nil {
+			return nil, err
+		}
+		if _, err := dest.Write(buf[:n]); err != nil {
+			return nil, err
+		}
+		crc = crc32.Update(crc, crc32.IEEETable, buf[:n])
+		remain -= n
+	}
+	if err := dest.Sync(); err != nil {
+		return nil, err
+	}
+	file.CRC = crc
+	return file, nil
+}
+
+// the snapshot of B+ tree index is written whole every time
+func copyIndexSnapshot(ctx context.Context, limiter *rateLimiter, destDir string,
+	source backupSource) (*BackupFile, error) {
+	dest, err := os.OpenFile(filepath.Join(destDir, source.name), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer dest.Close()
+	hash := crc32.NewIEEE()
+	if _, err := source.index.WriteTo(contextWriter{ctx: ctx, w: io.MultiWriter(dest, hash), limiter: limiter}); err != nil {
+		return nil, err
+	}
+	if err := dest.Sync(); err != nil {
+		return nil, err
+	}
+	return &BackupFile{Name: source.name, Size: source.size, ModTime: time.Now(), CRC: hash.Sum32()}, nil
+}
+
+// release the index snapshot held by sources
+func closeBackupSources(sources []backupSource) {
+	for _, source := range sources {
+		if source.index != nil {
+			_ = source.index.Close()
+		}
+	}
+}
+
+// contextReader fails reading once ctx is done, reads are throttled by limiter
+type contextReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (cr contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := cr.r.Read(p)
+	if err := cr.limiter.wait(cr.ctx, int64(n)); err != nil {
+		return n, err
+	}
+	return n, err
+}
+
+// contextWriter fails writing once ctx is done, writes are throttled by limiter
+type contextWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	limiter *rateLimiter
+}
+
+func (cw contextWriter) Write(p []byte) (int, error) {
+	if err := cw.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if err := cw.limiter.wait(cw.ctx, int64(len(p))); err != nil {
+		return 0, err
+	}
+	return cw.w.Write(p)
+}
+
+// crc of the first size bytes of the file
+func fileCRC(file *os.File, size int64) (uint32, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	hash := crc32.NewIEEE()
+	if _, err := io.CopyN(hash, file, size); err != nil {
+		return 0, err
+	}
+	return hash.Sum32(), nil
+}
+
+// ReadBackupManifest read the manifest of the backup in dir
+func ReadBackupManifest(dir string) (*BackupManifest, error) {
+	buf, err := os.ReadFile(filepath.Join(dir, BackupManifestFileName))
+	if err != nil {
+		return nil, err
+	}
+	var manifest BackupManifest
+	if err := json.Unmarshal(buf, &manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// write to a temp file then rename, the old manifest is kept if failed
+func writeBackupManifest(dir string, manifest *BackupManifest) error {
+	buf, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	tempName := filepath.Join(dir, BackupManifestFileName+".tmp")
+	if err := os.WriteFile(tempName, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tempName, filepath.Join(dir, BackupManifestFileName))
+}
+
+// beginBackup tell the listener about a backup to dir, call the returned func with its error
+func (db *DB) beginBackup(dir string) func(err error) {
+	info := BackupInfo{Dir: dir}
+	db.config.Logger.Info("backup begin", "dir", dir)
+	db.config.EventListener.OnBackupBegin(info)
+	start := time.Now()
+	return func(err error) {
+		info.Duration, info.Err = time.Since(start), err
+		if err != nil {
+			db.config.Logger.Error("backup failed", "dir", dir, "err", err)
+		} else {
+			db.config.Logger.Info("backup end", "dir", dir, "duration", info.Duration)
+		}
+		db.config.EventListener.OnBackupEnd(info)
+	}
+}
@@ -0,0 +1,177 @@
+package KVstore
+
+import (
+	"KVstore/data"
+	"KVstore/utils"
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDB_Backup_Incremental(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-backup")
+	opts.DirPath = dir + "/"
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 500; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-backup-target")
+	defer os.RemoveAll(backupDir)
+	manifest1, err := db.backup(context.Background(), backupDir)
+	assert.Nil(t, err)
+	assert.Equal(t, len(db.olderFiles)+1, len(manifest1.Files))
+	sealedFile := filepath.Join(backupDir, manifest1.Files[0].Name)
+	sealedInfo, err := os.Stat(sealedFile)
+	assert.Nil(t, err)
+
+	// only the new files and the tail of the active file are copied
+	for i := 500; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	manifest2, err := db.backup(context.Background(), backupDir)
+	assert.Nil(t, err)
+	assert.Greater(t, len(manifest2.Files), len(manifest1.Files))
+	assert.Equal(t, manifest1.Files[0], manifest2.Files[0])
+	sealedInfo2, err := os.Stat(sealedFile)
+	assert.Nil(t, err)
+	assert.Equal(t, sealedInfo.ModTime(), sealedInfo2.ModTime())
+	assert.Equal(t, db.activeFile.WriteOffset, manifest2.ActiveOffset)
+
+	readManifest, err := ReadBackupManifest(backupDir)
+	assert.Nil(t, err)
+	assert.Equal(t, len(manifest2.Files), len(readManifest.Files))
+
+	// the backup can be opened
+	backupOpts := DefaultConfigs
+	backupOpts.DirPath = backupDir
+	db2, err := Open(backupOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, len(db2.ListKeys()))
+	assert.Nil(t, db2.Close())
+}
+
+func TestDB_Checkpoint(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-checkpoint")
+	opts.DirPath = dir + "/"
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 500; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	checkpointDir := filepath.Join(os.TempDir(), "bitcask-go-checkpoint-target")
+	defer os.RemoveAll(checkpointDir)
+	err = db.Checkpoint(checkpointDir)
+	assert.Nil(t, err)
+
+	// sealed files are hard linked
+	for fid := range db.olderFiles {
+		srcInfo, err := os.Stat(data.GetDataFileName(opts.DirPath, fid))
+		assert.Nil(t, err)
+		destInfo, err := os.Stat(data.GetDataFileName(checkpointDir, fid))
+		assert.Nil(t, err)
+		assert.True(t, os.SameFile(srcInfo, destInfo))
+	}
+	// checkpoint dir must be empty
+	err = db.Checkpoint(checkpointDir)
+	assert.Equal(t, ErrorCheckpointDirNotEmpty, err)
+
+	// writes after the checkpoint are not in it
+	err = db.Put(utils.GetTestKey(1000), utils.RandomValue(128))
+	assert.Nil(t, err)
+	checkpointOpts := DefaultConfigs
+	checkpointOpts.DirPath = checkpointDir
+	db2, err := Open(checkpointOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, 500, len(db2.ListKeys()))
+	_, err = db2.Get(utils.GetTestKey(1000))
+	assert.Equal(t, ErrorKeyNotFound, err)
+	assert.Nil(t, db2.Close())
+}
+
+func TestDB_BackupTo(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-backup-to")
+	opts.DirPath = dir + "/"
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 500; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	var buf bytes.Buffer
+	err = db.BackupTo(&buf)
+	assert.Nil(t, err)
+
+	restoreDir := filepath.Join(os.TempDir(), "bitcask-go-restore-from")
+	defer os.RemoveAll(restoreDir)
+	err = RestoreFrom(bytes.NewReader(buf.Bytes()), restoreDir)
+	assert.Nil(t, err)
+	_, err = ReadBackupManifest(restoreDir)
+	assert.Nil(t, err)
+	restoreOpts := DefaultConfigs
+	restoreOpts.DirPath = restoreDir
+	db2, err := Open(restoreOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, 500, len(db2.ListKeys()))
+	assert.Nil(t, db2.Close())
+
+	// a corrupted archive is rejected and nothing is left
+	corruptDir := filepath.Join(os.TempDir(), "bitcask-go-restore-from-corrupt")
+	defer os.RemoveAll(corruptDir)
+	corrupted := append([]byte{}, buf.Bytes()...)
+	corrupted[1024] ^= 0xff
+	err = RestoreFrom(bytes.NewReader(corrupted), corruptDir)
+	assert.Equal(t, ErrorBackupCorrupted, err)
+	_, err = os.Stat(corruptDir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDB_BackupSnapshot(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-backup-snapshot")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 300; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+	}
+	snapshot, err := db.NewBackupSnapshot(context.Background())
+	assert.Nil(t, err)
+	// writes after the snapshot are not in the archive
+	for i := 300; i < 600; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+	}
+	var buf bytes.Buffer
+	assert.Nil(t, snapshot.Stream(context.Background(), &buf))
+	snapshot.Close()
+
+	restoreDir := filepath.Join(os.TempDir(), "bitcask-go-backup-snapshot-restore")
+	defer os.RemoveAll(restoreDir)
+	assert.Nil(t, RestoreFrom(&buf, restoreDir))
+	restoreOpts := DefaultConfigs
+	restoreOpts.DirPath = restoreDir
+	db2, err := Open(restoreOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, 300, len(db2.ListKeys()))
+	assert.Nil(t, db2.Close())
+}
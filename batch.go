@@ -2,16 +2,20 @@ package KVstore
 
 import (
 	"KVstore/data"
-	"KVstore/index"
+	"bytes"
+	"context"
 	"encoding/binary"
+	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type WriteBatch struct {
 	mutex         *sync.Mutex
 	db            *DB
 	pendingWrites map[string]*data.LogRecord
+	rangeDeletes  []*data.LogRecord // applied before pendingWrites
 	configs       WriteBatchConfigs
 }
 
@@ -20,9 +24,6 @@ const NonTxnSeqNo uint64 = 0
 var txnFinKey = []byte("txn-fin")
 
 func (db *DB) NewWriteBatch(config WriteBatchConfigs) *WriteBatch {
-	if db.config.IndexerType == index.BPTree && !db.seqNoFileExist && !db.isInitial {
-		panic("cannot use write batch,seq no file not exists")
-	}
 	return &WriteBatch{
 		configs:       config,
 		mutex:         new(sync.Mutex),
@@ -36,6 +37,9 @@ func (wb *WriteBatch) Put(key []byte, value []byte) error {
 	if len(key) == 0 {
 		return ErrorKeyEmpty
 	}
+	if isNamespaceKey(key) {
+		return ErrorKeyReserved
+	}
 	wb.mutex.Lock()
 	defer wb.mutex.Unlock()
 	// temporarily store logs in memory
@@ -53,10 +57,15 @@ func (wb *WriteBatch) Delete(key []byte) error {
 	if len(key) == 0 {
 		return ErrorKeyEmpty
 	}
+	// merge and bloom rebuild replace the index and filter under the db lock,
+	// take it before the batch lock as commit does
+	wb.db.mutex.RLock()
+	pos := wb.db.getIndexPos(key)
+	wb.db.mutex.RUnlock()
 	wb.mutex.Lock()
 	defer wb.mutex.Unlock()
 	//check if in the pendingWrites
-	if wb.db.index.Get(key) == nil {
+	if pos == nil {
 		if wb.pendingWrites[string(key)] != nil {
 			delete(wb.pendingWrites, string(key))
 		}
@@ -71,23 +80,109 @@ func (wb *WriteBatch) Delete(key []byte) error {
 	return nil
 }
 
+// DeleteRange delete all keys in [start, end), writes added to the batch
+// before it are dropped
+func (wb *WriteBatch) DeleteRange(start []byte, end []byte) error {
+	if len(start) == 0 || len(end) == 0 {
+		return ErrorKeyEmpty
+	}
+	if bytes.Compare(start, end) >= 0 {
+		return ErrorInvalidRange
+	}
+	return wb.deleteRange(start, end)
+}
+
+// DeletePrefix delete all keys with the prefix, writes added to the batch
+// before it are dropped
+func (wb *WriteBatch) DeletePrefix(prefix []byte) error {
+	if len(prefix) == 0 {
+		return ErrorKeyEmpty
+	}
+	return wb.deleteRange(prefix, prefixSuccessor(prefix))
+}
+func (wb *WriteBatch) deleteRange(start []byte, end []byte) error {
+	if isNamespaceKey(start) {
+		return ErrorKeyReserved
+	}
+	wb.mutex.Lock()
+	defer wb.mutex.Unlock()
+	for key := range wb.pendingWrites {
+		if isNamespaceKey([]byte(key)) || key < string(start) || len(end) > 0 && key >= string(end) {
+			continue
+		}
+		delete(wb.pendingWrites, key)
+	}
+	wb.rangeDeletes = append(wb.rangeDeletes, &data.LogRecord{
+		Key:   start,
+		Value: end,
+		Type:  data.DELETE_RANGE,
+	})
+	return nil
+}
+
 // Commit, write all pendingWrites to the disk
 func (wb *WriteBatch) Commit() error {
+	return wb.CommitContext(context.Background())
+}
+
+// CommitContext stop waiting for the db once ctx is done, the batch is still
+// committed as a whole in the background if writing has started
+func (wb *WriteBatch) CommitContext(ctx context.Context) (err error) {
+	defer wb.db.metrics.observe(opCommit, time.Now(), &err)
+	if err := wb.db.waitWrite(ctx, wb.size()); err != nil {
+		return err
+	}
+	return wb.db.runLocked(ctx, func() error {
+		wb.mutex.Lock()
+		defer wb.mutex.Unlock()
+		return wb.commit()
+	})
+}
+
+// bytes of keys and values in the batch, for the rate limit
+func (wb *WriteBatch) size() int64 {
 	wb.mutex.Lock()
 	defer wb.mutex.Unlock()
+	var size int64
+	for _, record := range wb.pendingWrites {
+		size += int64(len(record.Key) + len(record.Value))
+	}
+	for _, record := range wb.rangeDeletes {
+		size += int64(len(record.Key) + len(record.Value))
+	}
+	return size
+}
 
-	if len(wb.pendingWrites) == 0 {
+// need both mutexes before reaching this func
+func (wb *WriteBatch) commit() error {
+	if len(wb.pendingWrites) == 0 && len(wb.rangeDeletes) == 0 {
 		return nil
 	}
-	if uint(len(wb.pendingWrites)) > wb.configs.MaxBatchNum {
+	if uint(len(wb.pendingWrites)+len(wb.rangeDeletes)) > wb.configs.MaxBatchNum {
 		return ErrorExceedMaxBatchNum
 	}
-	wb.db.mutex.Lock()
-	defer wb.db.mutex.Unlock()
+	// a batch may span namespaces, all of them must be still there
+	namespaces, err := wb.namespaces()
+	if err != nil {
+		return err
+	}
 	// get new SeqNo
 	SeqNo := atomic.AddUint64(&wb.db.seqNo, 1)
 
-	// write logs into datafile
+	// write logs into datafile, range deletes go first so that
+	// they are replayed before the other writes of the batch
+	rangePos := make([]*data.LogRecordPos, len(wb.rangeDeletes))
+	for i, record := range wb.rangeDeletes {
+		logRecordPos, err := wb.db.appendLogRecord(&data.LogRecord{
+			Key:   logRecordKeyWithSeqNo(record.Key, SeqNo),
+			Value: record.Value,
+			Type:  record.Type,
+		})
+		if err != nil {
+			return err
+		}
+		rangePos[i] = logRecordPos
+	}
 	tempPos := make(map[string]*data.LogRecordPos)
 	for _, record := range wb.pendingWrites {
 		logRecordPos, err := wb.db.appendLogRecord(&data.LogRecord{
@@ -100,39 +195,48 @@ func (wb *WriteBatch) Commit() error {
 		}
 		tempPos[string(record.Key)] = logRecordPos
 	}
-	//add finish flag for transaction
+	//add finish flag for transaction, with the commit time for point-in-time restore
 	finishedRecord := &data.LogRecord{
-		Key:  logRecordKeyWithSeqNo(txnFinKey, SeqNo),
-		Type: data.COMMIT,
+		Key:   logRecordKeyWithSeqNo(txnFinKey, SeqNo),
+		Value: []byte(strconv.FormatInt(time.Now().UnixNano(), 10)),
+		Type:  data.COMMIT,
 	}
-	if _, err := wb.db.appendLogRecord(finishedRecord); err != nil {
+	finishedPos, err := wb.db.appendLogRecord(finishedRecord)
+	if err != nil {
 		return err
 	}
 
 	//check if need to do persistence
-	if wb.configs.SyncWrites {
-		err := wb.db.activeFile.Sync()
-		if err != nil {
-			return err
+	needSync := wb.configs.SyncWrites
+	for _, ns := range namespaces {
+		needSync = needSync || ns.options.SyncWrites
+	}
+	if needSync {
+		if err := wb.db.fsync(); err != nil {
+			wb.db.syncFailed(err)
+			// the batch is not committed without its finish record
+			return wb.db.failWrite(err, finishedPos.Offset)
 		}
 	}
 
 	//update indexer
+	for i, record := range wb.rangeDeletes {
+		wb.db.deleteRangeFromIndex(record.Key, record.Value, rangePos[i])
+	}
 	for _, record := range wb.pendingWrites {
 		pos := tempPos[string(record.Key)]
-		var oldPos *data.LogRecordPos
-		if record.Type == data.PUT {
-			oldPos = wb.db.index.Put(record.Key, pos)
-
-		} else if record.Type == data.DELETE {
-			oldPos, _ = wb.db.index.Delete(record.Key)
+		if err := wb.db.updateIndex(record.Key, record.Type, pos); err != nil {
+			return err
 		}
-		if oldPos != nil {
-			wb.db.reclaimSize += int64(oldPos.Size)
+		if record.Type == data.PUT && !isNamespaceKey(record.Key) {
+			if err := wb.db.addToBloomFilter(record.Key); err != nil {
+				return err
+			}
 		}
 	}
 	// clean
 	wb.pendingWrites = make(map[string]*data.LogRecord)
+	wb.rangeDeletes = nil
 
 	return nil
 }
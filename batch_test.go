@@ -110,3 +110,73 @@ func TestDB_WriteBatch3(t *testing.T) {
 	err = wb.Commit()
 	assert.Nil(t, err)
 }
+
+func TestDB_WriteBatchDeleteRange(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-batch-delete-range")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Put([]byte("a-"+string(rune('0'+i))), utils.RandomValue(8)))
+	}
+	assert.Nil(t, db.Put([]byte("b-0"), utils.RandomValue(8)))
+	wb := db.NewWriteBatch(DefaultWriteBatchConfigs)
+	// dropped by the prefix deletion after it
+	assert.Nil(t, wb.Put([]byte("a-x"), []byte("before")))
+	assert.Nil(t, wb.DeletePrefix([]byte("a-")))
+	assert.Nil(t, wb.Put([]byte("a-y"), []byte("after")))
+	assert.Equal(t, 11, len(db.ListKeys()))
+	assert.Nil(t, wb.Commit())
+	assert.Equal(t, [][]byte{[]byte("a-y"), []byte("b-0")}, db.ListKeys())
+
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("a-y"), []byte("b-0")}, db.ListKeys())
+}
+
+func TestDB_WriteBatchDeleteConcurrent(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-batch-delete-concurrent")
+	opts.DirPath = dir
+	opts.BloomFilter = true
+	opts.DataFileMergeRatio = 0.01
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(16)))
+	}
+
+	// new keys fill the bloom filter and rebuild it, merge replaces it too
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 100; i < 1000; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(16)))
+			if i%20 == 0 {
+				_ = db.Merge()
+			}
+		}
+	}()
+	for i := 0; ; i++ {
+		wb := db.NewWriteBatch(DefaultWriteBatchConfigs)
+		assert.Nil(t, wb.Delete(utils.GetTestKey(i%100)))
+		assert.Nil(t, wb.Commit())
+		if i >= 100 {
+			select {
+			case <-done:
+			default:
+				continue
+			}
+			break
+		}
+	}
+	for i := 0; i < 100; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Equal(t, ErrorKeyNotFound, err)
+	}
+}
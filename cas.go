@@ -0,0 +1,124 @@
+package KVstore
+
+import (
+	"KVstore/data"
+	"bytes"
+	"context"
+)
+
+const versionPositionBits = 48
+
+// conditional writes check and write under the db mutex, so they are atomic
+// against other writers and WriteBatch commits
+
+// CompareAndSwap put value only if the current value of key equals expected,
+// return whether it is swapped
+func (db *DB) CompareAndSwap(key []byte, expected []byte, value []byte) (bool, error) {
+	if len(key) == 0 {
+		return false, ErrorKeyEmpty
+	}
+	if isNamespaceKey(key) {
+		return false, ErrorKeyReserved
+	}
+	if err := db.waitWrite(context.Background(), int64(len(key)+len(value))); err != nil {
+		return false, err
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if ok, err := db.valueEquals(key, expected); err != nil || !ok {
+		return false, err
+	}
+	return true, db.put(key, value)
+}
+
+// PutIfAbsent put value only if key doesn't exist, return whether it is put
+func (db *DB) PutIfAbsent(key []byte, value []byte) (bool, error) {
+	return db.PutIfVersion(key, value, 0)
+}
+
+// DeleteIfEquals delete key only if its value equals expected, return whether it is deleted
+func (db *DB) DeleteIfEquals(key []byte, expected []byte) (bool, error) {
+	if len(key) == 0 {
+		return false, ErrorKeyEmpty
+	}
+	if isNamespaceKey(key) {
+		return false, ErrorKeyReserved
+	}
+	if err := db.waitWrite(context.Background(), int64(len(key))); err != nil {
+		return false, err
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if ok, err := db.valueEquals(key, expected); err != nil || !ok {
+		return false, err
+	}
+	return true, db.delete(key)
+}
+
+// GetWithVersion get the value and the version of key, the version changes on every
+// write of the key and never comes back, it is also changed when a merge is installed
+// and by changing DataFileSize
+func (db *DB) GetWithVersion(key []byte) ([]byte, uint64, error) {
+	if len(key) == 0 {
+		return nil, 0, ErrorInvalidKey
+	}
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	pos := db.getIndexPos(key)
+	if pos == nil {
+		return nil, 0, ErrorKeyNotFound
+	}
+	value, err := db.getValue(key, pos)
+	if err != nil {
+		return nil, 0, err
+	}
+	return value, db.versionOf(pos), nil
+}
+
+// PutIfVersion put value only if the version of key is still version,
+// version 0 means the key must not exist. Return whether it is put.
+func (db *DB) PutIfVersion(key []byte, value []byte, version uint64) (bool, error) {
+	if len(key) == 0 {
+		return false, ErrorKeyEmpty
+	}
+	if isNamespaceKey(key) {
+		return false, ErrorKeyReserved
+	}
+	if err := db.waitWrite(context.Background(), int64(len(key)+len(value))); err != nil {
+		return false, err
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	var current uint64
+	if pos := db.getIndexPos(key); pos != nil {
+		current = db.versionOf(pos)
+	}
+	if current != version {
+		return false, nil
+	}
+	return true, db.put(key, value)
+}
+
+// need a mutex before reaching this func
+func (db *DB) valueEquals(key []byte, expected []byte) (bool, error) {
+	pos := db.getIndexPos(key)
+	if pos == nil {
+		return false, nil
+	}
+	value, err := db.getValue(key, pos)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(value, expected), nil
+}
+
+// the merge generation and the position of the record in the log. Records are only
+// appended so the position grows with every write until merged files reuse the file ids,
+// which is when the generation grows. Offsets are less than DataFileSize,
+// 0 is left for missing keys.
+// Positions use the low 48 bits (256TB of log), a stale version only repeats after
+// 65536 merges.
+func (db *DB) versionOf(pos *data.LogRecordPos) uint64 {
+	position := uint64(pos.Fid)*uint64(db.config.DataFileSize) + uint64(pos.Offset) + 1
+	return uint64(db.mergeGeneration)<<versionPositionBits | position&(1<<versionPositionBits-1)
+}
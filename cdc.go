@@ -0,0 +1,284 @@
+package KVstore
+
+import (
+	"KVstore/data"
+	"KVstore/fio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	// number of batches buffered in the channel of a subscription
+	subscriptionBufferSize = 64
+	// the offset of a change position has 32 bits, leave room for the last record
+	maxChangeDataFileSize = 1 << 31
+)
+
+// only used to stop reading, never returned by Err
+var errSubscriptionClosed = errors.New("subscription is closed")
+
+type ChangeType = byte
+
+const (
+	ChangePut ChangeType = iota
+	ChangeDelete
+	// keys in [Key, Value) are deleted, empty Value means no upper bound
+	ChangeDeleteRange
+	// Value is an operand written by MergeValue
+	ChangeMerge
+)
+
+type ChangeEvent struct {
+	Type  ChangeType
+	Key   []byte
+	Value []byte // nil for ChangeDelete, the range end for ChangeDeleteRange
+}
+
+// ChangeBatch writes committed together, a single Put or Delete is a batch of one
+type ChangeBatch struct {
+	SeqNo  uint64 // seqNo of the WriteBatch, NonTxnSeqNo for a single write
+	Events []ChangeEvent
+	// position in the log right after the batch, save it and pass it
+	// to Subscribe to resume after restart
+	NextSeq uint64
+}
+
+// Subscription tails the data files from a position and sends committed changes
+type Subscription struct {
+	db       *DB
+	prefix   []byte
+	fid      uint32 // where to read next
+	offset   int64
+	ch       chan *ChangeBatch
+	done     chan struct{} // closed by Close
+	finished chan struct{} // closed when the reading goroutine exits
+	once     sync.Once
+	err      error
+	// the batch read before its commit record, only used by the reading goroutine
+	pending map[uint64][]ChangeEvent
+}
+
+// Subscribe return a subscription of committed Put and Delete of keys with the prefix,
+// starting from fromSeq (0 means the beginning of the log, otherwise a NextSeq
+// received before). Changes of a WriteBatch are sent in one ChangeBatch,
+// uncommitted batches are never sent.
+// If the position is removed by merge, ErrorChangeStreamCompacted is returned,
+// then the consumer has to start from 0, merged files only hold the latest values.
+func (db *DB) Subscribe(prefix []byte, fromSeq uint64) (*Subscription, error) {
+	if db.config.DataFileSize > maxChangeDataFileSize {
+		return nil, ErrorDataFileTooLarge
+	}
+	fid, offset := uint32(fromSeq>>32), int64(fromSeq&0xffffffff)
+	if fromSeq != 0 {
+		if _, err := os.Stat(filepath.Join(db.config.DirPath, data.MergeFinishedFileName)); err == nil {
+			nonMergeFileId, err := getNonMergeFileID(db.config.DirPath)
+			if err != nil {
+				return nil, err
+			}
+			if fid < nonMergeFileId {
+				return nil, ErrorChangeStreamCompacted
+			}
+		}
+	}
+	s := &Subscription{
+		db:       db,
+		prefix:   prefix,
+		fid:      fid,
+		offset:   offset,
+		ch:       make(chan *ChangeBatch, subscriptionBufferSize),
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+		pending:  make(map[uint64][]ChangeEvent),
+	}
+	go s.run()
+	return s, nil
+}
+
+// Events the channel is closed after Close, Close of the db, or an error
+func (s *Subscription) Events() <-chan *ChangeBatch {
+	return s.ch
+}
+
+// Err return the error which stopped the subscription, only valid after Events is closed
+func (s *Subscription) Err() error {
+	<-s.finished
+	return s.err
+}
+
+// Close stop the subscription and wait for it to exit
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+	<-s.finished
+}
+
+// the state of the log for subscriptions
+type changeState struct {
+	fileIds      []uint32
+	activeFid    uint32
+	activeOffset int64
+	changed      chan struct{} // closed on the next write
+	closed       bool
+}
+
+func (db *DB) getChangeState() *changeState {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.changed == nil {
+		db.changed = make(chan struct{})
+	}
+	state := &changeState{changed: db.changed, closed: db.isClosed}
+	for fid := range db.olderFiles {
+		state.fileIds = append(state.fileIds, fid)
+	}
+	if db.activeFile != nil {
+		state.activeFid = db.activeFile.FileId
+		state.activeOffset = db.activeFile.WriteOffset
+		state.fileIds = append(state.fileIds, db.activeFile.FileId)
+	}
+	sort.Slice(state.fileIds, func(i, j int) bool {
+		return state.fileIds[i] < state.fileIds[j]
+	})
+	return state
+}
+
+// wake up subscriptions waiting for new writes
+// need a mutex before reaching this func
+func (db *DB) notifyChange() {
+	if db.changed != nil {
+		close(db.changed)
+		db.changed = nil
+	}
+}
+
+func (s *Subscription) run() {
+	// data files are read by our own fd, not affected by the db
+	files := make(map[uint32]*data.File)
+	defer func() {
+		for _, file := range files {
+			_ = file.Close()
+		}
+		close(s.ch)
+		close(s.finished)
+	}()
+	for {
+		state := s.db.getChangeState()
+		if err := s.readUntil(state, files); err != nil {
+			if err != errSubscriptionClosed {
+				s.err = err
+			}
+			return
+		}
+		if state.closed {
+			return
+		}
+		select {
+		case <-state.changed:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// read records from the current position to the end of the active file in state
+func (s *Subscription) readUntil(state *changeState, files map[uint32]*data.File) error {
+	for _, fid := range state.fileIds {
+		if fid < s.fid {
+			continue
+		}
+		if fid > s.fid {
+			s.fid, s.offset = fid, 0
+		}
+		file, ok := files[fid]
+		if !ok {
+			var err error
+			if file, err = data.OpenReadOnlyFile(s.db.config.DirPath, fid, fio.StandardIO); err != nil {
+				return err
+			}
+			files[fid] = file
+		}
+		for fid != state.activeFid || s.offset < state.activeOffset {
+			logRecord, size, err := file.Read(s.offset)
+			if err != nil {
+				if err == io.EOF && fid != state.activeFid {
+					break
+				}
+				return err
+			}
+			s.offset += size
+			if err := s.handleRecord(logRecord); err != nil {
+				return err
+			}
+		}
+		// sealed files never change
+		if fid != state.activeFid {
+			_ = file.Close()
+			delete(files, fid)
+		}
+	}
+	return nil
+}
+
+func (s *Subscription) handleRecord(logRecord *data.LogRecord) error {
+	realKey, seqNo := parseKeyWithSeqNo(logRecord.Key)
+	// records of a batch are written together under the db lock, if another record
+	// comes first the batch never gets its commit record: a failed write truncated
+	// it, or the db crashed and is reopened. Drop it, its records are never applied
+	if _, ok := s.pending[seqNo]; !ok || seqNo == NonTxnSeqNo {
+		for pendingSeqNo := range s.pending {
+			delete(s.pending, pendingSeqNo)
+		}
+	}
+	if logRecord.Type == data.COMMIT {
+		events := s.pending[seqNo]
+		delete(s.pending, seqNo)
+		return s.send(seqNo, events)
+	}
+	var events []ChangeEvent
+	if logRecord.Type == data.DELETE_RANGE {
+		// sent if the range overlaps keys with the prefix
+		prefixEnd := prefixSuccessor(s.prefix)
+		if (prefixEnd == nil || bytes.Compare(realKey, prefixEnd) < 0) &&
+			(len(logRecord.Value) == 0 || bytes.Compare(logRecord.Value, s.prefix) > 0) {
+			events = append(events, ChangeEvent{Type: ChangeDeleteRange, Key: realKey, Value: logRecord.Value})
+		}
+	} else if bytes.HasPrefix(realKey, s.prefix) && !isNamespaceKey(realKey) {
+		// namespaces are not in the change stream
+		event := ChangeEvent{Type: ChangePut, Key: realKey, Value: logRecord.Value}
+		if logRecord.Type == data.DELETE {
+			event.Type, event.Value = ChangeDelete, nil
+		} else if logRecord.Type == data.MERGE_OPERAND {
+			event.Type = ChangeMerge
+		}
+		events = append(events, event)
+	}
+	if seqNo == NonTxnSeqNo {
+		return s.send(seqNo, events)
+	}
+	// keep the batch until its commit record
+	s.pending[seqNo] = append(s.pending[seqNo], events...)
+	return nil
+}
+
+func (s *Subscription) send(seqNo uint64, events []ChangeEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	batch := &ChangeBatch{
+		SeqNo:   seqNo,
+		Events:  events,
+		NextSeq: uint64(s.fid)<<32 | uint64(s.offset),
+	}
+	select {
+	case s.ch <- batch:
+		return nil
+	case <-s.done:
+		return errSubscriptionClosed
+	}
+}
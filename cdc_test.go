@@ -0,0 +1,126 @@
+package KVstore
+
+import (
+	"KVstore/fio"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func receiveBatch(t *testing.T, sub *Subscription) *ChangeBatch {
+	select {
+	case batch, ok := <-sub.Events():
+		assert.True(t, ok)
+		return batch
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change received")
+		return nil
+	}
+}
+
+func TestDB_Subscribe(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-subscribe")
+	opts.DirPath = dir + "/"
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.Put([]byte("user-1"), []byte("a")))
+	assert.Nil(t, db.Put([]byte("order-1"), []byte("b")))
+	sub, err := db.Subscribe([]byte("user-"), 0)
+	assert.Nil(t, err)
+	batch := receiveBatch(t, sub)
+	assert.Equal(t, NonTxnSeqNo, batch.SeqNo)
+	assert.Equal(t, []ChangeEvent{{Type: ChangePut, Key: []byte("user-1"), Value: []byte("a")}}, batch.Events)
+
+	// changes written after subscribing, a batch is sent as a whole
+	wb := db.NewWriteBatch(DefaultWriteBatchConfigs)
+	assert.Nil(t, wb.Put([]byte("user-2"), []byte("c")))
+	assert.Nil(t, wb.Put([]byte("user-3"), []byte("d")))
+	assert.Nil(t, wb.Put([]byte("order-2"), []byte("e")))
+	assert.Nil(t, wb.Commit())
+	batch = receiveBatch(t, sub)
+	assert.NotEqual(t, NonTxnSeqNo, batch.SeqNo)
+	assert.Equal(t, 2, len(batch.Events))
+	assert.Nil(t, db.Delete([]byte("user-1")))
+	batch = receiveBatch(t, sub)
+	assert.Equal(t, ChangeDelete, batch.Events[0].Type)
+	assert.Equal(t, []byte("user-1"), batch.Events[0].Key)
+	resumeSeq := batch.NextSeq
+	sub.Close()
+	assert.Nil(t, sub.Err())
+
+	// resume from the saved position after restart
+	assert.Nil(t, db.Put([]byte("user-4"), []byte("f")))
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	sub, err = db.Subscribe([]byte("user-"), resumeSeq)
+	assert.Nil(t, err)
+	defer sub.Close()
+	batch = receiveBatch(t, sub)
+	assert.Equal(t, []byte("user-4"), batch.Events[0].Key)
+	assert.Nil(t, db.Put([]byte("user-5"), []byte("g")))
+	batch = receiveBatch(t, sub)
+	assert.Equal(t, []byte("user-5"), batch.Events[0].Key)
+}
+
+// failCommitIO fails the write after the given number of writes, like a full disk
+type failCommitIO struct {
+	fio.IOManager
+	writes int
+}
+
+func (f *failCommitIO) Write(b []byte) (int, error) {
+	f.writes--
+	if f.writes != 0 {
+		return f.IOManager.Write(b)
+	}
+	n, _ := f.IOManager.Write(b[:len(b)/2])
+	return n, syscall.ENOSPC
+}
+
+// a batch without its commit record is dropped by the subscription
+func TestDB_SubscribeUncommittedBatch(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-subscribe-uncommitted")
+	opts.DirPath = dir + "/"
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("user-1"), []byte("a")))
+
+	// the commit record of the second batch fails, its records are left in the log
+	sub, err := db.Subscribe([]byte("user-"), 0)
+	assert.Nil(t, err)
+	receiveBatch(t, sub)
+	io := &failCommitIO{IOManager: db.activeFile.IOManager, writes: 3}
+	db.activeFile.IOManager = io
+	wb := db.NewWriteBatch(DefaultWriteBatchConfigs)
+	assert.Nil(t, wb.Put([]byte("user-2"), []byte("b")))
+	assert.Nil(t, wb.Put([]byte("user-3"), []byte("c")))
+	assert.Equal(t, syscall.ENOSPC, wb.Commit())
+	assert.Nil(t, db.Resume())
+
+	check := func(sub *Subscription) {
+		assert.Nil(t, db.Put([]byte("user-4"), []byte("d")))
+		batch := receiveBatch(t, sub)
+		assert.Equal(t, []ChangeEvent{{Type: ChangePut, Key: []byte("user-4"), Value: []byte("d")}}, batch.Events)
+		sub.Close()
+		assert.Equal(t, 0, len(sub.pending))
+	}
+	check(sub)
+
+	// the records are still there after reopen
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	sub, err = db.Subscribe([]byte("user-"), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("user-1"), receiveBatch(t, sub).Events[0].Key)
+	assert.Equal(t, []byte("user-4"), receiveBatch(t, sub).Events[0].Key)
+	check(sub)
+}
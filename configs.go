@@ -2,6 +2,7 @@ package KVstore
 
 import (
 	"KVstore/index"
+	"time"
 )
 
 type Configs struct {
@@ -16,10 +17,61 @@ type Configs struct {
 	MMapLoad     bool
 	//threshold of merge
 	DataFileMergeRatio float32
+	// use a bloom filter to skip index lookups of missing keys,
+	// useful for B+ tree index which reads from disk
+	BloomFilter bool
+	// false positive rate of the bloom filter, in (0, 1)
+	BloomFalsePositiveRate float64
+	// write a snapshot of the in-memory index when closing,
+	// so that Open only replays records written after it
+	IndexSnapshot bool
+	// folds operands written by MergeValue, nil if MergeValue is not used
+	MergeOperator MergeOperator
+	// once a key has this many operands they are folded into one value,
+	// so reads don't fold long chains, 0 means only merge folds them
+	MaxOperandChain int
+	// never write or delete any file, writes return ErrorReadOnly. A shared lock
+	// is taken, so many read only processes can open the db but a writer can't
+	ReadOnly bool
+	// read only without taking the lock, so the db can be opened while a writer
+	// is running, records appended by the writer are read by TryCatchUp
+	Secondary bool
+	// call TryCatchUp this often in secondary mode, 0 means only by hand
+	CatchUpInterval time.Duration
+	// past the soft limits writes are slowed down and a merge is requested,
+	// past the hard limits writes fail with ErrorWriteStopped, 0 means no limit.
+	// Disk usage is the size of files in DirPath in bytes
+	DiskSoftLimit int64
+	DiskHardLimit int64
+	// reclaimable size / disk usage
+	ReclaimSoftRatio float32
+	ReclaimHardRatio float32
+	// how long a write waits past the soft limits
+	WriteSlowdownDelay time.Duration
+	// nil means no log
+	Logger Logger
+	// nil means no events
+	EventListener EventListener
+	// bytes per second written by merge and copied by backup, they share one
+	// token bucket, 0 means no limit. DB.SetRateLimit changes it at runtime
+	RateLimit int64
+	// foreground writes take tokens from the same bucket too
+	RateLimitWrites bool
 }
 type IteratorConfigs struct {
 	Reverse bool
 	Prefix  []byte
+	// keys in [LowerBound, UpperBound), nil means unbounded
+	LowerBound []byte
+	UpperBound []byte
+	// only iterate keys, never read values from data files
+	KeyOnly bool
+}
+type NamespaceOptions struct {
+	// keys written to the namespace expire after it, 0 means never
+	TTL time.Duration
+	// sync on every write to the namespace, even if the db doesn't
+	SyncWrites bool
 }
 type WriteBatchConfigs struct {
 	MaxBatchNum uint
@@ -27,20 +79,46 @@ type WriteBatchConfigs struct {
 }
 
 var DefaultConfigs = Configs{
-	DirPath:            "./",
-	IndexerDirPath:     "./",
-	DataFileSize:       256 * 1024 * 1024, //256MB
-	SyncWrites:         false,
-	IndexerType:        index.Btree,
-	BytesPerSync:       0,
-	MMapLoad:           false, //whether use mmap to load data file
-	DataFileMergeRatio: 0.5,
+	DirPath:                "./",
+	IndexerDirPath:         "./",
+	DataFileSize:           256 * 1024 * 1024, //256MB
+	SyncWrites:             false,
+	IndexerType:            index.Btree,
+	BytesPerSync:           0,
+	MMapLoad:               false, //whether use mmap to load data file
+	DataFileMergeRatio:     0.5,
+	BloomFilter:            false,
+	BloomFalsePositiveRate: 0.01,
+	IndexSnapshot:          true,
+	MaxOperandChain:        100,
+	WriteSlowdownDelay:     time.Millisecond,
 }
 var DefaultIteratorConfigs = IteratorConfigs{
-	Reverse: false,
-	Prefix:  nil,
+	Reverse:    false,
+	Prefix:     nil,
+	LowerBound: nil,
+	UpperBound: nil,
+	KeyOnly:    false,
 }
 var DefaultWriteBatchConfigs = WriteBatchConfigs{
 	MaxBatchNum: 10000,
 	SyncWrites:  true,
 }
+
+// RestoreConfigs restore to a point in time, at most one of them is set.
+// Records only know their order in the log and WriteBatch commits know their
+// SeqNo and commit time, so the restored db ends right after a WriteBatch commit.
+// Writes out of a WriteBatch have no time, if any of them is between the last commit
+// before Timestamp and the next commit (or the end of the backup), it can't be told
+// whether they are before Timestamp and ErrorRestorePointAmbiguous is returned.
+type RestoreConfigs struct {
+	// restore up to the commit of the WriteBatch with this SeqNo, 0 means all
+	SeqNo uint64
+	// restore up to the last WriteBatch committed before this time, zero means all
+	Timestamp time.Time
+}
+
+var DefaultRestoreConfigs = RestoreConfigs{
+	SeqNo:     0,
+	Timestamp: time.Time{},
+}
@@ -0,0 +1,151 @@
+package KVstore
+
+import (
+	"context"
+	"time"
+)
+
+// Context variants of the API stop waiting once ctx is done and return ctx.Err().
+// Writes only check ctx until they start appending to the log, once started a write
+// is never interrupted and its own result is returned even if ctx is done meanwhile,
+// so a write returning ctx.Err() is not applied.
+
+func (db *DB) PutContext(ctx context.Context, key []byte, value []byte) (err error) {
+	defer db.metrics.observe(opPut, time.Now(), &err)
+	if len(key) == 0 {
+		return ErrorKeyEmpty
+	}
+	if isNamespaceKey(key) {
+		return ErrorKeyReserved
+	}
+	if err := db.waitWrite(ctx, int64(len(key)+len(value))); err != nil {
+		return err
+	}
+	return db.runLocked(ctx, func() error {
+		return db.put(key, value)
+	})
+}
+
+func (db *DB) GetContext(ctx context.Context, key []byte) (value []byte, err error) {
+	defer db.metrics.observe(opGet, time.Now(), &err)
+	if err := db.rlockContext(ctx); err != nil {
+		return nil, err
+	}
+	defer db.mutex.RUnlock()
+	return db.get(key)
+}
+
+func (db *DB) DeleteContext(ctx context.Context, key []byte) (err error) {
+	defer db.metrics.observe(opDelete, time.Now(), &err)
+	if len(key) == 0 {
+		return ErrorKeyEmpty
+	}
+	if err := db.waitWrite(ctx, int64(len(key))); err != nil {
+		return err
+	}
+	return db.runLocked(ctx, func() error {
+		return db.deleteIfExists(key)
+	})
+}
+
+// MultiGetContext keys not read when ctx is done get ctx.Err() as their error
+func (db *DB) MultiGetContext(ctx context.Context, keys [][]byte) ([][]byte, []error) {
+	if err := db.rlockContext(ctx); err != nil {
+		errs := make([]error, len(keys))
+		for i := range errs {
+			errs[i] = err
+		}
+		return make([][]byte, len(keys)), errs
+	}
+	defer db.mutex.RUnlock()
+	return db.multiGet(ctx, keys)
+}
+
+// FoldContext ctx is checked before each key
+func (db *DB) FoldContext(ctx context.Context, fn func(key []byte, value []byte) bool) error {
+	if err := db.rlockContext(ctx); err != nil {
+		return err
+	}
+	defer db.mutex.RUnlock()
+	return db.fold(ctx, fn)
+}
+
+// SyncContext bound a slow fsync, it goes on in the background after ctx is done
+func (db *DB) SyncContext(ctx context.Context) error {
+	if db.activeFile == nil {
+		return nil
+	}
+	return db.runLockedInBackground(ctx, func() error {
+		return db.syncActiveFile()
+	})
+}
+
+// lockContext acquire the db mutex unless ctx is done first
+func (db *DB) lockContext(ctx context.Context) error {
+	return acquireContext(ctx, db.mutex.TryLock, db.mutex.Lock, db.mutex.Unlock)
+}
+func (db *DB) rlockContext(ctx context.Context) error {
+	return acquireContext(ctx, db.mutex.TryRLock, db.mutex.RLock, db.mutex.RUnlock)
+}
+func acquireContext(ctx context.Context, tryLock func() bool, lock func(), unlock func()) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if tryLock() {
+		return nil
+	}
+	locked := make(chan struct{})
+	go func() {
+		lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		// give it back once it is acquired
+		go func() {
+			<-locked
+			unlock()
+		}()
+		return ctx.Err()
+	}
+}
+
+// runLocked run fn under the db mutex unless ctx is done before it is acquired,
+// once fn starts its result is returned whatever happens to ctx
+func (db *DB) runLocked(ctx context.Context, fn func() error) error {
+	if err := db.lockContext(ctx); err != nil {
+		return err
+	}
+	defer db.mutex.Unlock()
+	// the lock may be acquired just as ctx is done
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return fn()
+}
+
+// runLockedInBackground run fn under the db mutex, if ctx is done before fn returns,
+// return ctx.Err() and let fn finish in the background
+func (db *DB) runLockedInBackground(ctx context.Context, fn func() error) error {
+	if err := db.lockContext(ctx); err != nil {
+		return err
+	}
+	// never done, no need for another goroutine
+	if ctx.Done() == nil {
+		defer db.mutex.Unlock()
+		return fn()
+	}
+	done := make(chan error, 1)
+	go func() {
+		defer db.mutex.Unlock()
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,113 @@
+package KVstore
+
+import (
+	"KVstore/fio"
+	"KVstore/utils"
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDB_Context(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-context")
+	opts.DirPath = dir
+	opts.DataFileMergeRatio = 0.01
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.PutContext(ctx, utils.GetTestKey(i), utils.RandomValue(16)))
+	}
+	assert.Nil(t, db.DeleteContext(ctx, utils.GetTestKey(0)))
+	_, err = db.GetContext(ctx, utils.GetTestKey(0))
+	assert.Equal(t, ErrorKeyNotFound, err)
+
+	// stop in the middle of fold
+	ctx, cancel := context.WithCancel(context.Background())
+	var folded int
+	err = db.FoldContext(ctx, func(key []byte, value []byte) bool {
+		folded++
+		if folded == 10 {
+			cancel()
+		}
+		return true
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 10, folded)
+
+	// canceled before starting
+	assert.Equal(t, context.Canceled, db.PutContext(ctx, []byte("key"), []byte("value")))
+	assert.Equal(t, context.Canceled, db.MergeContext(ctx))
+	assert.Equal(t, context.Canceled, db.BackupToContext(ctx, &bytes.Buffer{}))
+	wb := db.NewWriteBatch(DefaultWriteBatchConfigs)
+	assert.Nil(t, wb.Put([]byte("key"), []byte("value")))
+	assert.Equal(t, context.Canceled, wb.CommitContext(ctx))
+	_, err = db.Get([]byte("key"))
+	assert.Equal(t, ErrorKeyNotFound, err)
+
+	// the deadline passes while waiting for the db
+	db.mutex.Lock()
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, db.PutContext(ctx, []byte("key"), []byte("value")))
+	_, errs := db.MultiGetContext(ctx, [][]byte{utils.GetTestKey(1)})
+	assert.Equal(t, context.DeadlineExceeded, errs[0])
+	db.mutex.Unlock()
+
+	// the db works after canceled calls
+	assert.Nil(t, wb.Commit())
+	val, err := db.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+	assert.Nil(t, db.Merge())
+}
+
+// cancelingIO cancels the context while the record is written
+type cancelingIO struct {
+	fio.IOManager
+	cancel context.CancelFunc
+}
+
+func (c *cancelingIO) Write(b []byte) (int, error) {
+	c.cancel()
+	return c.IOManager.Write(b)
+}
+
+func TestDB_ContextDoneWhileWriting(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-context-writing")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("key"), []byte("value")))
+
+	// a started write returns its own result, not ctx.Err()
+	io := &cancelingIO{IOManager: db.activeFile.IOManager}
+	db.activeFile.IOManager = io
+	ctx, cancel := context.WithCancel(context.Background())
+	io.cancel = cancel
+	assert.Nil(t, db.PutContext(ctx, []byte("put"), []byte("value")))
+	_, err = db.Get([]byte("put"))
+	assert.Nil(t, err)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	io.cancel = cancel
+	assert.Nil(t, db.DeleteContext(ctx, []byte("key")))
+	_, err = db.Get([]byte("key"))
+	assert.Equal(t, ErrorKeyNotFound, err)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	io.cancel = cancel
+	wb := db.NewWriteBatch(DefaultWriteBatchConfigs)
+	assert.Nil(t, wb.Put([]byte("batch"), []byte("value")))
+	assert.Nil(t, wb.CommitContext(ctx))
+	_, err = db.Get([]byte("batch"))
+	assert.Nil(t, err)
+}
@@ -13,6 +13,8 @@ const FileSuffix = ".data"
 const HintFileName = "hint_index"
 const MergeFinishedFileName = "merge_FIN"
 const SeqNoFileName = "SeqNo"
+const BloomFilterFileName = "bloom_filter"
+const IndexSnapshotFileName = "index_snapshot"
 
 var (
 	ErrorCRC = errors.New("the crc is wrong ")
@@ -22,6 +24,7 @@ type File struct {
 	FileId      uint32
 	WriteOffset int64 //store where to write next,only for active file
 	IOManager   fio.IOManager
+	mode        fio.OpenMode
 }
 
 func OpenFile(dirPath string, fileId uint32, ioType fio.FileIOTypes) (*File, error) {
@@ -29,6 +32,12 @@ func OpenFile(dirPath string, fileId uint32, ioType fio.FileIOTypes) (*File, err
 	return NewDataFile(fileName, fileId, ioType)
 }
 
+// OpenReadOnlyFile open a data file for reading, it must exist
+func OpenReadOnlyFile(dirPath string, fileId uint32, ioType fio.FileIOTypes) (*File, error) {
+	fileName := GetDataFileName(dirPath, fileId)
+	return newDataFile(fileName, fileId, ioType, fio.ReadOnly)
+}
+
 // OpenHintFile open hint file
 func OpenHintFile(dirPath string) (*File, error) {
 	fileName := filepath.Join(dirPath, HintFileName)
@@ -42,11 +51,23 @@ func OpenSeqNoFile(dirPath string) (*File, error) {
 	fileName := filepath.Join(dirPath, SeqNoFileName)
 	return NewDataFile(fileName, 0, fio.StandardIO)
 }
+func OpenBloomFilterFile(dirPath string) (*File, error) {
+	fileName := filepath.Join(dirPath, BloomFilterFileName)
+	return NewDataFile(fileName, 0, fio.StandardIO)
+}
 func GetDataFileName(dir string, fileId uint32) string {
-	return filepath.Join(dir + fmt.Sprintf("%09d", fileId) + FileSuffix)
+	return filepath.Join(dir, fmt.Sprintf("%09d", fileId)+FileSuffix)
 }
 func NewDataFile(fileName string, fileId uint32, ioType fio.FileIOTypes) (*File, error) {
-	ioManager, err := fio.InitIOManager(fileName, ioType)
+	return newDataFile(fileName, fileId, ioType, fio.ReadWrite)
+}
+
+// NewReadOnlyDataFile open any file of the db for reading, it must exist
+func NewReadOnlyDataFile(fileName string, fileId uint32, ioType fio.FileIOTypes) (*File, error) {
+	return newDataFile(fileName, fileId, ioType, fio.ReadOnly)
+}
+func newDataFile(fileName string, fileId uint32, ioType fio.FileIOTypes, mode fio.OpenMode) (*File, error) {
+	ioManager, err := fio.OpenIOManager(fileName, ioType, mode)
 	if err != nil {
 		return nil, err
 	}
@@ -54,6 +75,7 @@ func NewDataFile(fileName string, fileId uint32, ioType fio.FileIOTypes) (*File,
 		FileId:      fileId,
 		WriteOffset: 0,
 		IOManager:   ioManager,
+		mode:        mode,
 	}, nil
 }
 
@@ -77,6 +99,12 @@ func (file *File) WriteHintRecord(key []byte, pos *LogRecordPos) error {
 
 	return file.Write(encRecord)
 }
+
+// Truncate drop data after size, the next write goes to size
+func (file *File) Truncate(size int64) error {
+	file.WriteOffset = size
+	return file.IOManager.Truncate(size)
+}
 func (file *File) Sync() error {
 	return file.IOManager.Sync()
 }
@@ -134,6 +162,29 @@ func (file *File) Read(offset int64) (*LogRecord, int64, error) {
 	}
 	return &logRecord, recordSize, nil
 }
+
+// RunsToEnd whether the record at offset, as its header says, reaches the end of
+// the file, which is where a write cut by a crash leaves it
+func (file *File) RunsToEnd(offset int64) (bool, error) {
+	fileSize, err := file.IOManager.Size()
+	if err != nil {
+		return false, err
+	}
+	// not even room for a whole header
+	if offset+maxLogRecordHeaderSize >= fileSize {
+		return true, nil
+	}
+	headerBuf, err := file.readNBytes(maxLogRecordHeaderSize, offset)
+	if err != nil {
+		return false, err
+	}
+	header, headerSize := DecodeLogRecordHeader(headerBuf)
+	if header == nil {
+		return true, nil
+	}
+	recordSize := headerSize + int64(header.KeySize) + int64(header.ValueSize)
+	return offset+recordSize >= fileSize, nil
+}
 func (file *File) readNBytes(n int64, offset int64) (b []byte, err error) {
 	b = make([]byte, n)
 	_, err = file.IOManager.Read(b, offset)
@@ -143,7 +194,7 @@ func (file *File) SetIOType(dirPath string, ioType fio.FileIOTypes) error {
 	if err := file.IOManager.Close(); err != nil {
 		return err
 	}
-	ioM, err := fio.InitIOManager(GetDataFileName(dirPath, file.FileId), ioType)
+	ioM, err := fio.OpenIOManager(GetDataFileName(dirPath, file.FileId), ioType, file.mode)
 	if err != nil {
 		return err
 	}
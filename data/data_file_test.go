@@ -108,3 +108,25 @@ func TestDataFile_ReadLogRecord(t *testing.T) {
 	assert.Equal(t, rec3, readRec3)
 	assert.Equal(t, size3, readSize3)
 }
+
+func TestDataFile_RunsToEnd(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-runs-to-end")
+	defer os.RemoveAll(dir)
+	dataFile, err := OpenFile(dir, 0, fio.StandardIO)
+	assert.Nil(t, err)
+	defer dataFile.Close()
+
+	res1, size1 := EncodeLogRecord(&LogRecord{Key: []byte("name"), Value: []byte("bitcask kv go")})
+	assert.Nil(t, dataFile.Write(res1))
+	res2, _ := EncodeLogRecord(&LogRecord{Key: []byte("name"), Value: []byte("a new value")})
+	assert.Nil(t, dataFile.Write(res2[:len(res2)-2]))
+
+	// a record followed by others
+	end, err := dataFile.RunsToEnd(0)
+	assert.Nil(t, err)
+	assert.False(t, end)
+	// the last record is cut
+	end, err = dataFile.RunsToEnd(size1)
+	assert.Nil(t, err)
+	assert.True(t, end)
+}
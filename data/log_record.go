@@ -3,6 +3,7 @@ package data
 import (
 	"encoding/binary"
 	"hash/crc32"
+	"io"
 )
 
 type RecordType = byte
@@ -11,6 +12,10 @@ const (
 	PUT RecordType = iota
 	DELETE
 	COMMIT
+	// delete keys in [Key, Value), empty Value means no upper bound
+	DELETE_RANGE
+	// an operand folded onto the value by the merge operator
+	MERGE_OPERAND
 )
 
 // crc type keySize valueSize
@@ -86,6 +91,33 @@ func DecodeLogRecordHeader(buf []byte) (*logRecordHeader, int64) {
 
 	return &header, int64(index)
 }
+
+// DecodeLogRecord decode a whole log record from the beginning of buf,
+// return the record and its size, io.EOF if buf doesn't hold a whole record
+func DecodeLogRecord(buf []byte) (*LogRecord, int64, error) {
+	headerBytes := len(buf)
+	if headerBytes > maxLogRecordHeaderSize {
+		headerBytes = maxLogRecordHeaderSize
+	}
+	header, headerSize := DecodeLogRecordHeader(buf[:headerBytes])
+	if header == nil {
+		return nil, 0, io.EOF
+	}
+	keySize, valueSize := int64(header.KeySize), int64(header.ValueSize)
+	recordSize := headerSize + keySize + valueSize
+	if recordSize > int64(len(buf)) {
+		return nil, 0, io.EOF
+	}
+	logRecord := &LogRecord{
+		Key:   buf[headerSize : headerSize+keySize],
+		Value: buf[headerSize+keySize : recordSize],
+		Type:  header.Type,
+	}
+	if getCRC(logRecord, buf[crc32.Size:headerSize]) != header.CRC {
+		return nil, 0, ErrorCRC
+	}
+	return logRecord, recordSize, nil
+}
 func getCRC(log *LogRecord, header []byte) uint32 {
 	if log == nil {
 		return 0
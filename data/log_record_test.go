@@ -3,6 +3,7 @@ package data
 import (
 	"github.com/stretchr/testify/assert"
 	"hash/crc32"
+	"io"
 	"testing"
 )
 
@@ -93,3 +94,38 @@ func TestGetCRC(t *testing.T) {
 	crc3 := getCRC(rec3, headerBuf3[crc32.Size:])
 	assert.Equal(t, uint32(3421942876), crc3)
 }
+
+func TestDecodeLogRecord(t *testing.T) {
+	rec1 := &LogRecord{
+		Key:   []byte("name"),
+		Value: []byte("jerry"),
+		Type:  PUT,
+	}
+	rec2 := &LogRecord{
+		Key:  []byte("name"),
+		Type: DELETE,
+	}
+	buf1, n1 := EncodeLogRecord(rec1)
+	buf2, n2 := EncodeLogRecord(rec2)
+	buf := append(buf1, buf2...)
+
+	res1, size1, err := DecodeLogRecord(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, n1, size1)
+	assert.Equal(t, rec1.Key, res1.Key)
+	assert.Equal(t, rec1.Value, res1.Value)
+
+	res2, size2, err := DecodeLogRecord(buf[size1:])
+	assert.Nil(t, err)
+	assert.Equal(t, n2, size2)
+	assert.Equal(t, DELETE, res2.Type)
+
+	// incomplete record
+	_, _, err = DecodeLogRecord(buf1[:n1-1])
+	assert.Equal(t, io.EOF, err)
+
+	// broken record
+	buf1[n1-1]++
+	_, _, err = DecodeLogRecord(buf1)
+	assert.Equal(t, ErrorCRC, err)
+}
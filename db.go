@@ -5,6 +5,8 @@ import (
 	"KVstore/fio"
 	"KVstore/index"
 	"KVstore/utils"
+	"bytes"
+	"context"
 	"github.com/gofrs/flock"
 	"io"
 	"os"
@@ -13,6 +15,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 const (
@@ -21,41 +24,72 @@ const (
 )
 
 type DB struct {
-	config     *Configs
-	mutex      *sync.RWMutex
-	activeFile *data.File
-	olderFiles map[uint32]*data.File
-	index      index.Indexer
-	fileIds    []int // only used for loading index
-	seqNo      uint64
-	isMerging  bool
-	// when using b+ tree, if cannot get seqNo when loading,
-	// then we can't use WriteBatch
-	seqNoFileExist bool
-	isInitial      bool // used for write batch check
-	fileLock       *flock.Flock
-	BytesWrite     uint
-	reclaimSize    int64 // how many bytes to reclaim
+	config      *Configs
+	mutex       *sync.RWMutex
+	activeFile  *data.File
+	olderFiles  map[uint32]*data.File
+	index       index.Indexer
+	fileIds     []int // only used for loading index
+	seqNo       uint64
+	isMerging   bool
+	fileLock    *flock.Flock
+	BytesWrite  uint
+	reclaimSize int64              // how many bytes to reclaim
+	bloom       *index.BloomFilter // nil if bloom filter is disabled
+	// records before it are loaded from index snapshot, nil if no snapshot
+	snapshotPos *data.LogRecordPos
+	changed     chan struct{} // closed on the next write to wake up subscriptions
+	isClosed    bool
+	// namespaces by name and id, changed under both mutex and nsMutex,
+	// nsMutex only lets merge route records without the db mutex
+	namespaces      map[string]*Namespace
+	namespaceIds    map[uint32]*Namespace
+	namespaceMeta   index.Indexer // the registry of namespaces
+	nextNamespaceId uint32
+	nsMutex         *sync.RWMutex
+	// keys with operands written by MergeValue since their last Put
+	operands map[string]*operandChain
+	// records of batches not committed yet, only kept in secondary mode
+	pendingTxns map[uint64][]*data.TxnRecord
+	// stop and wait for the TryCatchUp loop, nil if it is not running
+	catchUpStop chan struct{}
+	catchUpDone chan struct{}
+	// size of files in DirPath, counted on writes for write stall
+	diskSize int64
+	// cancel and wait for the merge requested by write stall, nil if not requested
+	mergeCancel context.CancelFunc
+	mergeDone   chan struct{}
+	metrics     *metrics
+	limiter     *rateLimiter
+	// write stall of the last write, for WriteStallChange events
+	lastWriteStall WriteStall
+	// sticky error of a failed write or sync, the db is read only until Resume
+	bgError error
+	// merges installed in DirPath, merged files reuse file ids so it is part of versions
+	mergeGeneration uint32
+	// the finished merge waiting for the next Open to install it, its dir is on disk
+	// along with the files it replaces, their reclaimable size is handled by it
+	mergeDirSize      int64
+	mergedReclaimSize int64
 }
 type Stat struct {
 	KeyNum          uint  // number of keys
 	DataFileNUm     uint  // number of data files
 	ReclaimableSize int64 // reclaimable size in bytes
 	DiskSize        int64 // disk size in bytes
+	IndexMemory     int64 // estimated memory used by the index in bytes
+	// estimated index memory per key in bytes
+	IndexMemoryPerKey float64
+	// bloom filter statistics, all zero if bloom filter is disabled
+	BloomLookups        uint64 // lookups checked by the bloom filter
+	BloomNegatives      uint64 // lookups answered without touching the index
+	BloomFalsePositives uint64 // lookups passed the filter but key not found
+	WriteStall          WriteStall
 }
 
 /*
 APIs for user
 */
-func (db *DB) Backup(dir string) error {
-	//check backup dir
-	if dir[len(dir)-1] != '/' {
-		dir += "/"
-	}
-	db.mutex.Lock()
-	defer db.mutex.Unlock()
-	return utils.CopyDir(db.config.DirPath, dir, []string{fileLockName})
-}
 func (db *DB) Stat() *Stat {
 	db.mutex.RLock()
 	defer db.mutex.RUnlock()
@@ -65,61 +99,156 @@ func (db *DB) Stat() *Stat {
 	}
 	dirSize, err := utils.DirSize(db.config.DirPath)
 	if err != nil {
-		panic("failed to get dir size")
+		// the size counted on writes
+		dirSize = db.diskSize
 	}
-	return &Stat{
+	stat := &Stat{
 		KeyNum:          uint(db.index.Size()),
 		DataFileNUm:     dataFiles,
 		ReclaimableSize: db.reclaimSize,
 		DiskSize:        dirSize,
+		IndexMemory:     db.index.MemorySize(),
+		WriteStall:      db.writeStall(),
+	}
+	if stat.KeyNum > 0 {
+		stat.IndexMemoryPerKey = float64(stat.IndexMemory) / float64(stat.KeyNum)
+	}
+	if db.bloom != nil {
+		bloomStat := db.bloom.Stat()
+		stat.BloomLookups = bloomStat.Lookups
+		stat.BloomNegatives = bloomStat.Negatives
+		stat.BloomFalsePositives = bloomStat.FalsePositives
 	}
+	return stat
 }
-func (db *DB) Put(key []byte, value []byte) error {
+func (db *DB) Put(key []byte, value []byte) (err error) {
+	defer db.metrics.observe(opPut, time.Now(), &err)
 	//check if the key is empty
 	if len(key) == 0 {
 		return ErrorKeyEmpty
 	}
+	if isNamespaceKey(key) {
+		return ErrorKeyReserved
+	}
+	if err := db.waitWrite(context.Background(), int64(len(key)+len(value))); err != nil {
+		return err
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	return db.put(key, value)
+}
+
+// need a mutex before reaching this func
+func (db *DB) put(key []byte, value []byte) error {
 	//construct the log record
 	logRecord := data.LogRecord{
 		Key:   logRecordKeyWithSeqNo(key, NonTxnSeqNo),
 		Value: value,
 		Type:  data.PUT,
 	}
-	pos, err := db.appendLogRecordWithLock(&logRecord)
+	pos, err := db.appendLogRecord(&logRecord)
 	if err != nil {
 		return err
 	}
-	//update index
-	if oldPos := db.index.Put(key, pos); oldPos != nil {
+	//update index, operands of the key are overwritten too
+	if oldPos := db.index.Put(key, pos); !db.dropOperands(key) && oldPos != nil {
 		db.reclaimSize += int64(oldPos.Size)
 	}
-	return nil
+	return db.addToBloomFilter(key)
 }
-func (db *DB) Get(key []byte) ([]byte, error) {
+func (db *DB) Get(key []byte) (value []byte, err error) {
+	defer db.metrics.observe(opGet, time.Now(), &err)
 	db.mutex.RLock()
 	defer db.mutex.RUnlock()
+	return db.get(key)
+}
+
+// need a mutex before reaching this func
+func (db *DB) get(key []byte) ([]byte, error) {
 	// check if the key valid or exists
 	if len(key) == 0 {
 		return nil, ErrorInvalidKey
 	}
-	logRecordPos := db.index.Get(key)
+	logRecordPos := db.getIndexPos(key)
 	if logRecordPos == nil {
 		return nil, ErrorKeyNotFound
 	}
 	//get the value from the file
-	return db.getValueByPosition(logRecordPos)
+	return db.getValue(key, logRecordPos)
+}
+
+// MultiGet get values of keys against one view of the index, values and errors
+// are in the order of keys, reads are sorted by position to reduce seeks
+func (db *DB) MultiGet(keys [][]byte) ([][]byte, []error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.multiGet(context.Background(), keys)
 }
-func (db *DB) Delete(key []byte) error {
+
+// keys not read when ctx is done get ctx.Err()
+// need a mutex before reaching this func
+func (db *DB) multiGet(ctx context.Context, keys [][]byte) ([][]byte, []error) {
+	values := make([][]byte, len(keys))
+	errs := make([]error, len(keys))
+	type read struct {
+		idx int
+		pos *data.LogRecordPos
+	}
+	reads := make([]read, 0, len(keys))
+	for i, key := range keys {
+		if len(key) == 0 {
+			errs[i] = ErrorInvalidKey
+			continue
+		}
+		pos := db.getIndexPos(key)
+		if pos == nil {
+			errs[i] = ErrorKeyNotFound
+			continue
+		}
+		reads = append(reads, read{idx: i, pos: pos})
+	}
+	sort.Slice(reads, func(i, j int) bool {
+		if reads[i].pos.Fid != reads[j].pos.Fid {
+			return reads[i].pos.Fid < reads[j].pos.Fid
+		}
+		return reads[i].pos.Offset < reads[j].pos.Offset
+	})
+	for _, r := range reads {
+		if err := ctx.Err(); err != nil {
+			errs[r.idx] = err
+			continue
+		}
+		values[r.idx], errs[r.idx] = db.getValue(keys[r.idx], r.pos)
+	}
+	return values, errs
+}
+func (db *DB) Delete(key []byte) (err error) {
+	defer db.metrics.observe(opDelete, time.Now(), &err)
 	if len(key) == 0 {
 		return ErrorKeyEmpty
 	}
+	if err := db.waitWrite(context.Background(), int64(len(key))); err != nil {
+		return err
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	return db.deleteIfExists(key)
+}
+
+// need a mutex before reaching this func
+func (db *DB) deleteIfExists(key []byte) error {
 	//check if key exists in the indexer
-	if pos := db.index.Get(key); pos == nil {
+	if pos := db.getIndexPos(key); pos == nil {
 		return nil
 	}
+	return db.delete(key)
+}
+
+// need a mutex before reaching this func
+func (db *DB) delete(key []byte) error {
 	//add a tombstone record
 	logRecord := data.LogRecord{Key: logRecordKeyWithSeqNo(key, NonTxnSeqNo), Type: data.DELETE}
-	pos, err := db.appendLogRecordWithLock(&logRecord)
+	pos, err := db.appendLogRecord(&logRecord)
 	if err != nil {
 		return err
 	}
@@ -129,12 +258,52 @@ func (db *DB) Delete(key []byte) error {
 	if !ok {
 		return ErrorUpdateIndex
 	}
-	if oldPos != nil {
+	if !db.dropOperands(key) && oldPos != nil {
 		db.reclaimSize += int64(oldPos.Size)
 
 	}
 	return nil
 }
+
+// DeleteRange delete all keys in [start, end) by one record
+func (db *DB) DeleteRange(start []byte, end []byte) error {
+	if len(start) == 0 || len(end) == 0 {
+		return ErrorKeyEmpty
+	}
+	if bytes.Compare(start, end) >= 0 {
+		return ErrorInvalidRange
+	}
+	return db.deleteRange(start, end)
+}
+
+// DeletePrefix delete all keys with the prefix by one record
+func (db *DB) DeletePrefix(prefix []byte) error {
+	if len(prefix) == 0 {
+		return ErrorKeyEmpty
+	}
+	return db.deleteRange(prefix, prefixSuccessor(prefix))
+}
+func (db *DB) deleteRange(start []byte, end []byte) error {
+	if isNamespaceKey(start) {
+		return ErrorKeyReserved
+	}
+	logRecord := data.LogRecord{
+		Key:   logRecordKeyWithSeqNo(start, NonTxnSeqNo),
+		Value: end,
+		Type:  data.DELETE_RANGE,
+	}
+	if err := db.waitWrite(context.Background(), int64(len(start)+len(end))); err != nil {
+		return err
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	pos, err := db.appendLogRecord(&logRecord)
+	if err != nil {
+		return err
+	}
+	db.deleteRangeFromIndex(start, end, pos)
+	return nil
+}
 func (db *DB) ListKeys() [][]byte {
 	iter := db.index.Iterator(false)
 	defer iter.Close()
@@ -151,10 +320,18 @@ func (db *DB) ListKeys() [][]byte {
 func (db *DB) Fold(fn func(key []byte, value []byte) bool) error {
 	db.mutex.RLock()
 	defer db.mutex.RUnlock()
+	return db.fold(context.Background(), fn)
+}
+
+// need a mutex before reaching this func
+func (db *DB) fold(ctx context.Context, fn func(key []byte, value []byte) bool) error {
 	iter := db.index.Iterator(false)
 	defer iter.Close()
 	for iter.Rewind(); iter.Valid(); iter.Next() {
-		val, err := db.getValueByPosition(iter.Value())
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		val, err := db.getValue(iter.Key(), iter.Value())
 		if err != nil {
 			return err
 		}
@@ -165,50 +342,96 @@ func (db *DB) Fold(fn func(key []byte, value []byte) bool) error {
 	return nil
 }
 
-func Open(configs Configs) (*DB, error) {
+func Open(configs Configs) (_ *DB, err error) {
+	start := time.Now()
 	// firstly check the config
-	err := checkConfigs(&configs)
+	err = checkConfigs(&configs)
 	if err != nil {
 		return nil, err
 	}
+	if configs.Secondary {
+		configs.ReadOnly = true
+	}
 	//check the dir, if not exist then create a new one
-	var isInitial bool
 	if _, err := os.Stat(configs.DirPath); os.IsNotExist(err) {
+		if configs.ReadOnly {
+			return nil, err
+		}
 		if err := os.MkdirAll(configs.DirPath, os.ModePerm); err != nil {
 			return nil, err
 		}
-		isInitial = true
 	}
-	// check if DB is in use
-	fileLock := flock.New(filepath.Join(configs.DirPath, fileLockName))
-	hold, err := fileLock.TryLock()
-	if err != nil {
-		return nil, err
+	// check if DB is in use, secondary runs along with the writer so takes no lock.
+	// Read only opens never create files, if there is no lock file yet nothing is locked.
+	fileLockPath := filepath.Join(configs.DirPath, fileLockName)
+	fileLock := flock.New(fileLockPath)
+	needLock := !configs.Secondary
+	if needLock && configs.ReadOnly {
+		if _, err := os.Stat(fileLockPath); os.IsNotExist(err) {
+			needLock = false
+		}
 	}
-	if !hold {
-		return nil, ErrorDataBaseIsInUse
+	if needLock {
+		tryLock := fileLock.TryLock
+		if configs.ReadOnly {
+			tryLock = fileLock.TryRLock
+		}
+		hold, err := tryLock()
+		if err != nil {
+			return nil, err
+		}
+		if !hold {
+			return nil, ErrorDataBaseIsInUse
+		}
 	}
+	var db *DB
+	// release the lock and what is opened so far, the dir can be opened again
+	defer func() {
+		if err == nil {
+			return
+		}
+		if db != nil {
+			db.closeFiles()
+		}
+		_ = fileLock.Unlock()
+	}()
 
-	entries, err := os.ReadDir(configs.DirPath)
-	if err != nil {
-		return nil, err
-	}
-	if len(entries) == 0 {
-		isInitial = true
-	}
 	//init DB structure
-	db := &DB{
+	db = &DB{
 		config:     &configs,
 		mutex:      new(sync.RWMutex),
 		olderFiles: make(map[uint32]*data.File),
-		index: index.NewIndexr(configs.IndexerType,
+		fileLock:   fileLock,
+		// namespaces live in the same data files
+		namespaces:      make(map[string]*Namespace),
+		namespaceIds:    make(map[uint32]*Namespace),
+		namespaceMeta:   index.NewBTree(),
+		nextNamespaceId: metaNamespaceId + 1,
+		nsMutex:         new(sync.RWMutex),
+		operands:        make(map[string]*operandChain),
+		metrics:         newMetrics(),
+		limiter:         newRateLimiter(configs.RateLimit),
+	}
+	if configs.ReadOnly && configs.IndexerType == index.BPTree {
+		db.index, err = index.OpenBPlusTreeReadOnly(configs.IndexerDirPath)
+	} else {
+		db.index, err = index.NewIndexr(configs.IndexerType,
 			configs.IndexerDirPath,
-			configs.SyncWrites),
-		isInitial: isInitial,
-		fileLock:  fileLock,
+			configs.SyncWrites,
+			db.getKeyByPosition)
 	}
-	// load merge files
-	if err := db.loadMergeFiles(); err != nil {
+	if err != nil {
+		db.index = nil
+		return nil, err
+	}
+	// load merge files, a read only db reads the files not merged yet,
+	// they are still complete
+	if !configs.ReadOnly {
+		if err := db.loadMergeFiles(); err != nil {
+			return nil, err
+		}
+	}
+	if db.mergeGeneration, err = getMergeGeneration(configs.DirPath); err != nil {
 		return nil, err
 	}
 	// load files
@@ -216,19 +439,19 @@ func Open(configs Configs) (*DB, error) {
 		return nil, err
 	}
 	if configs.IndexerType != index.BPTree {
-		if err := db.loadIndexFromHint(); err != nil {
+		loaded, err := db.loadIndexSnapshot()
+		if err != nil {
 			return nil, err
 		}
+		if !loaded {
+			if err := db.loadIndexFromHint(); err != nil {
+				return nil, err
+			}
+		}
 		// load indexer
 		if err := db.loadIndexer(); err != nil {
 			return nil, err
 		}
-		// reset IOManager Type  to standard IO
-		if db.config.MMapLoad {
-			if err := db.resetIOType(); err != nil {
-				return nil, err
-			}
-		}
 	}
 	if configs.IndexerType == index.BPTree {
 		if err := db.loadSeqNo(); err != nil {
@@ -243,9 +466,46 @@ func Open(configs Configs) (*DB, error) {
 			db.activeFile.WriteOffset = size
 		}
 	}
+	// reset IOManager Type  to standard IO
+	if db.config.MMapLoad {
+		if err := db.resetIOType(); err != nil {
+			return nil, err
+		}
+	}
+	if configs.BloomFilter {
+		if err := db.loadBloomFilter(); err != nil {
+			return nil, err
+		}
+	}
+	if db.diskSize, err = utils.DirSize(configs.DirPath); err != nil {
+		return nil, err
+	}
+	if configs.Secondary && configs.CatchUpInterval > 0 {
+		db.catchUpStop = make(chan struct{})
+		db.catchUpDone = make(chan struct{})
+		go db.catchUpLoop(configs.CatchUpInterval)
+	}
+	configs.Logger.Info("db opened", "dir", configs.DirPath, "files", len(db.fileIds),
+		"keys", db.index.Size(), "read_only", configs.ReadOnly, "duration", time.Since(start))
 	return db, nil
 }
 func (db *DB) Close() error {
+	if db.catchUpStop != nil {
+		close(db.catchUpStop)
+		<-db.catchUpDone
+	}
+	// subscriptions read the rest of the log then exit
+	db.mutex.Lock()
+	db.isClosed = true
+	db.notifyChange()
+	cancelMerge, mergeDone := db.mergeCancel, db.mergeDone
+	db.mutex.Unlock()
+	// a merge requested by write stall is done next time
+	if cancelMerge != nil {
+		cancelMerge()
+		<-mergeDone
+	}
+	db.config.Logger.Info("db closed", "dir", db.config.DirPath)
 	defer func() {
 		// unlock fileLock
 		if err := db.fileLock.Unlock(); err != nil {
@@ -263,6 +523,41 @@ func (db *DB) Close() error {
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
 
+	// files may be broken after a failed write, leave them as they are
+	if !db.config.ReadOnly && db.bgError == nil {
+		if err := db.saveOnClose(); err != nil {
+			return err
+		}
+	}
+	// close active file
+	if err := db.activeFile.Close(); err != nil {
+		return err
+	}
+	// close old files
+	for _, file := range db.olderFiles {
+		if err := file.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close the index and the data files of a db failed to open, errors are ignored
+func (db *DB) closeFiles() {
+	if db.index != nil {
+		_ = db.index.Close()
+	}
+	if db.activeFile != nil {
+		_ = db.activeFile.Close()
+	}
+	for _, file := range db.olderFiles {
+		_ = file.Close()
+	}
+}
+
+// save SeqNo, index snapshot and bloom filter to speed up next Open
+// need a mutex before reaching this func
+func (db *DB) saveOnClose() error {
 	// save the SeqNo
 	seqNoFile, err := data.OpenSeqNoFile(db.config.DirPath)
 	if err != nil {
@@ -279,13 +574,15 @@ func (db *DB) Close() error {
 	if err := seqNoFile.Sync(); err != nil {
 		return err
 	}
-	// close active file
-	if err := db.activeFile.Close(); err != nil {
-		return err
+	// save the in-memory index to speed up next Open
+	if db.config.IndexSnapshot && db.config.IndexerType != index.BPTree {
+		if err := db.checkpointIndex(); err != nil {
+			return err
+		}
 	}
-	// close old files
-	for _, file := range db.olderFiles {
-		if err := file.Close(); err != nil {
+	// save the bloom filter, B+ tree index won't be loaded from data files
+	if db.bloom != nil && db.config.IndexerType == index.BPTree {
+		if err := db.saveBloomFilter(); err != nil {
 			return err
 		}
 	}
@@ -299,7 +596,7 @@ func (db *DB) Sync() error {
 	}
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
-	return db.activeFile.Sync()
+	return db.syncActiveFile()
 }
 
 /*
@@ -311,6 +608,16 @@ func (db *DB) appendLogRecordWithLock(record *data.LogRecord) (*data.LogRecordPo
 	return db.appendLogRecord(record)
 }
 func (db *DB) appendLogRecord(record *data.LogRecord) (*data.LogRecordPos, error) {
+	// every write goes through here
+	if db.config.ReadOnly {
+		return nil, ErrorReadOnly
+	}
+	if db.bgError != nil {
+		return nil, ErrorDegraded
+	}
+	if err := db.checkWriteStall(); err != nil {
+		return nil, err
+	}
 	// check if exist active file
 	// if not, create a new file
 	if db.activeFile == nil {
@@ -324,36 +631,46 @@ func (db *DB) appendLogRecord(record *data.LogRecord) (*data.LogRecordPos, error
 	//check if threshold value exceeded
 	if db.activeFile.WriteOffset+lens > db.config.DataFileSize {
 		//firstly persist the Datafile
-		if err := db.activeFile.Sync(); err != nil {
+		if err := db.syncActiveFile(); err != nil {
 			return nil, err
 		}
-		// activeFile -> OlderFile
-		db.olderFiles[db.activeFile.FileId] = db.activeFile
-		// open a new Datafile
+		// open a new Datafile, activeFile -> OlderFile once it is there
+		oldFile := db.activeFile
 		if err := db.setActivateFile(); err != nil {
+			db.setBackgroundError(err)
 			return nil, err
 		}
+		db.olderFiles[oldFile.FileId] = oldFile
+		oldFileId := oldFile.FileId
+		db.config.Logger.Debug("data file rollover", "old", oldFileId, "new", db.activeFile.FileId)
+		db.config.EventListener.OnFileRollover(FileRolloverInfo{OldFileId: oldFileId, NewFileId: db.activeFile.FileId})
 	}
 	// write data into file
 	writeOff := db.activeFile.WriteOffset
 	if err := db.activeFile.Write(encRecord); err != nil {
-		return nil, err
+		return nil, db.failWrite(err, writeOff)
 	}
-	db.BytesWrite += uint(lens)
 	// check users want to persist
 	var needSync = db.config.SyncWrites
 	if !needSync && db.config.BytesPerSync > 0 &&
-		db.BytesWrite >= db.config.BytesPerSync {
+		db.BytesWrite+uint(lens) >= db.config.BytesPerSync {
 		needSync = true
 	}
 
 	if needSync {
-		if err := db.activeFile.Sync(); err != nil {
-			return nil, err
+		if err := db.fsync(); err != nil {
+			db.syncFailed(err)
+			return nil, db.failWrite(err, writeOff)
 		}
 		// reset BytesWrite
 		db.BytesWrite = 0
+	} else {
+		db.BytesWrite += uint(lens)
 	}
+	// the record is there, count it and wake up subscriptions
+	db.diskSize += lens
+	db.metrics.write(lens)
+	db.notifyChange()
 	pos := &data.LogRecordPos{
 		Fid:    db.activeFile.FileId,
 		Offset: writeOff,
@@ -405,7 +722,11 @@ func (db *DB) loadFiles() error {
 		if db.config.MMapLoad {
 			ioType = fio.MemoryMappedIO
 		}
-		dataFile, err := data.OpenFile(db.config.DirPath, uint32(id), ioType)
+		openFile := data.OpenFile
+		if db.config.ReadOnly {
+			openFile = data.OpenReadOnlyFile
+		}
+		dataFile, err := openFile(db.config.DirPath, uint32(id), ioType)
 		if err != nil {
 			return err
 		}
@@ -427,7 +748,7 @@ func (db *DB) loadIndexer() error {
 	hasMerge, nonMergeFileId := false, uint32(0)
 	mergeFinFileName := filepath.Join(db.config.DirPath, data.MergeFinishedFileName)
 	if _, err := os.Stat(mergeFinFileName); err == nil {
-		fid, err := db.getNonMergeFileID(db.config.DirPath)
+		fid, err := getNonMergeFileID(db.config.DirPath)
 		if err != nil {
 			return err
 		}
@@ -435,21 +756,8 @@ func (db *DB) loadIndexer() error {
 		nonMergeFileId = fid
 	}
 
-	updateIndex := func(key []byte, typ data.RecordType, pos *data.LogRecordPos) {
-		var oldPos *data.LogRecordPos
-		if typ == data.DELETE {
-			oldPos, _ = db.index.Delete(key)
-			db.reclaimSize += int64(pos.Size)
-		} else {
-			oldPos = db.index.Put(key, pos)
-		}
-		if oldPos != nil {
-			db.reclaimSize += int64(oldPos.Size)
-		}
-	}
 	// txn logs
 	txnRecords := make(map[uint64][]*data.TxnRecord)
-	var curSeqNo = NonTxnSeqNo
 
 	for i, id := range db.fileIds {
 		var fileId = uint32(id)
@@ -457,6 +765,10 @@ func (db *DB) loadIndexer() error {
 		if hasMerge && fileId < nonMergeFileId {
 			continue
 		}
+		// check if the file is already loaded from index snapshot
+		if db.snapshotPos != nil && fileId < db.snapshotPos.Fid {
+			continue
+		}
 		var file *data.File
 		//load the file
 		if fileId == db.activeFile.FileId {
@@ -465,50 +777,197 @@ func (db *DB) loadIndexer() error {
 			file = db.olderFiles[fileId]
 		}
 		var offset int64 = 0
-		for {
-			logRecord, lens, err := file.Read(offset)
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				return err
+		if db.snapshotPos != nil && fileId == db.snapshotPos.Fid {
+			offset = db.snapshotPos.Offset
+		}
+		offset, err := db.replayFile(file, offset, txnRecords)
+		// a partial record at the end of the log is left by a crash, or the writer
+		// of a secondary is in the middle of it
+		if err == data.ErrorCRC && i == len(db.fileIds)-1 {
+			err = db.truncateTornTail(file, offset)
+		}
+		if err != nil {
+			return err
+		}
+		//if is the active file,update the WriteOffset
+		if i == len(db.fileIds)-1 {
+			db.activeFile.WriteOffset = offset
+		}
+	}
+	if db.config.Secondary {
+		db.pendingTxns = txnRecords
+	}
+	return nil
+}
+
+// drop the partial record at offset of the last file, read only db only skips it.
+// Return ErrorCRC if the record ends before the end of the file, it is not cut
+// by a crash but corrupted.
+func (db *DB) truncateTornTail(file *data.File, offset int64) error {
+	torn, err := file.RunsToEnd(offset)
+	if err != nil {
+		return err
+	}
+	if !torn {
+		return data.ErrorCRC
+	}
+	if db.config.ReadOnly {
+		return nil
+	}
+	size, err := file.IOManager.Size()
+	if err != nil {
+		return err
+	}
+	// the mapping is read only, truncate through the file
+	if db.config.MMapLoad {
+		if err := file.SetIOType(db.config.DirPath, fio.StandardIO); err != nil {
+			return err
+		}
+	}
+	if err := file.Truncate(offset); err != nil {
+		return err
+	}
+	info := TruncationInfo{FileId: file.FileId, Offset: offset, Size: size - offset, Err: data.ErrorCRC}
+	db.config.Logger.Warn("partial record truncated", "file", info.FileId, "offset", info.Offset, "size", info.Size)
+	db.config.EventListener.OnRecoveryTruncation(info)
+	return nil
+}
+
+// replayFile update index with records of file from offset, records of batches are
+// kept in txnRecords until their commit, return the offset after the last record read
+// need a mutex before reaching this func
+func (db *DB) replayFile(file *data.File, offset int64, txnRecords map[uint64][]*data.TxnRecord) (int64, error) {
+	for {
+		logRecord, lens, err := file.Read(offset)
+		if err != nil {
+			if err == io.EOF {
+				return offset, nil
 			}
+			return offset, err
+		}
 
-			//create indexer in memory
-			logRecordPos := data.LogRecordPos{
-				Fid:    file.FileId,
-				Offset: offset,
-				Size:   uint32(lens),
+		//create indexer in memory
+		logRecordPos := data.LogRecordPos{
+			Fid:    file.FileId,
+			Offset: offset,
+			Size:   uint32(lens),
+		}
+		//update indexer
+		//get key and SeqNo
+		realKey, SeqNo := parseKeyWithSeqNo(logRecord.Key)
+		if SeqNo == NonTxnSeqNo {
+			if err := db.replayRecord(realKey, logRecord, &logRecordPos); err != nil {
+				return offset, err
 			}
-			//update indexer
-			//get key and SeqNo
-			realKey, SeqNo := parseKeyWithSeqNo(logRecord.Key)
-			if SeqNo == NonTxnSeqNo {
-				updateIndex(realKey, logRecord.Type, &logRecordPos)
-			} else {
-				// Txn commit valid
-				if logRecord.Type == data.COMMIT {
-					for _, txnRecord := range txnRecords[SeqNo] {
-						updateIndex(txnRecord.Record.Key, txnRecord.Record.Type, txnRecord.Pos)
+		} else {
+			// Txn commit valid
+			if logRecord.Type == data.COMMIT {
+				for _, txnRecord := range txnRecords[SeqNo] {
+					if err := db.replayRecord(txnRecord.Record.Key, txnRecord.Record, txnRecord.Pos); err != nil {
+						return offset, err
 					}
-				} else {
-					txnRecords[SeqNo] = append(txnRecords[SeqNo], &data.TxnRecord{
-						logRecord, &logRecordPos,
-					})
 				}
+				delete(txnRecords, SeqNo)
+			} else {
+				logRecord.Key = realKey
+				txnRecords[SeqNo] = append(txnRecords[SeqNo], &data.TxnRecord{
+					Record: logRecord, Pos: &logRecordPos,
+				})
 			}
-			if SeqNo > curSeqNo {
-				curSeqNo = SeqNo
-			}
-			//keyWithSeqNo := logRecord.Key
-			offset += lens
 		}
-		//if is the active file,update the WriteOffset
-		if i == len(db.fileIds)-1 {
-			db.activeFile.WriteOffset = offset
+		// SeqNo may be loaded from index snapshot
+		if SeqNo > db.seqNo {
+			db.seqNo = SeqNo
 		}
+		offset += lens
+	}
+}
+
+// the bloom filter is only there when catching up, it is built after loading
+func (db *DB) replayRecord(key []byte, record *data.LogRecord, pos *data.LogRecordPos) error {
+	if err := db.applyRecord(key, record, pos); err != nil {
+		return err
+	}
+	if record.Type == data.PUT || record.Type == data.MERGE_OPERAND {
+		return db.addToBloomFilter(key)
+	}
+	return nil
+}
+
+// update index with a record of any type, key is the real key of it
+func (db *DB) applyRecord(key []byte, record *data.LogRecord, pos *data.LogRecordPos) error {
+	switch record.Type {
+	case data.DELETE_RANGE:
+		db.deleteRangeFromIndex(key, record.Value, pos)
+		return nil
+	case data.MERGE_OPERAND:
+		db.applyOperand(key, pos)
+		return nil
+	}
+	return db.updateIndex(key, record.Type, pos)
+}
+
+// delete keys in [start, end) of the default namespace from index, an empty end
+// means no end. Keys are collected first since B+ tree can't be changed while iterating,
+// the index only walks the range, the B+ tree cursor stops at end below.
+func (db *DB) deleteRangeFromIndex(start []byte, end []byte, pos *data.LogRecordPos) {
+	db.reclaimSize += int64(pos.Size)
+	var upper []byte
+	if len(end) > 0 {
+		upper = end
+	}
+	var keys [][]byte
+	iter := db.index.RangeIterator(false, start, upper)
+	for iter.Seek(start); iter.Valid(); iter.Next() {
+		if len(end) > 0 && bytes.Compare(iter.Key(), end) >= 0 {
+			break
+		}
+		keys = append(keys, iter.Key())
+	}
+	iter.Close()
+	for _, key := range keys {
+		if oldPos, _ := db.index.Delete(key); !db.dropOperands(key) && oldPos != nil {
+			db.reclaimSize += int64(oldPos.Size)
+		}
+	}
+}
+
+// update index with a record read from data files, the record is routed
+// to the index of its namespace, records of dropped namespaces are reclaimable
+func (db *DB) updateIndex(key []byte, typ data.RecordType, pos *data.LogRecordPos) error {
+	idx, idxKey, ns := db.indexOf(key)
+	if idx == nil {
+		db.reclaimSize += int64(pos.Size)
+		return nil
+	}
+	var oldPos *data.LogRecordPos
+	var reclaim int64
+	if typ == data.DELETE {
+		oldPos, _ = idx.Delete(idxKey)
+		reclaim += int64(pos.Size)
+	} else {
+		oldPos = idx.Put(idxKey, pos)
+	}
+	// operands of the key are overwritten too
+	if idx == db.index && db.dropOperands(idxKey) {
+		oldPos = nil
+	}
+	if oldPos != nil {
+		reclaim += int64(oldPos.Size)
+	}
+	db.reclaimSize += reclaim
+	if ns != nil {
+		ns.reclaimSize += reclaim
+		if typ != data.DELETE {
+			ns.liveSize += int64(pos.Size)
+		}
+		if oldPos != nil {
+			ns.liveSize -= int64(oldPos.Size)
+		}
+	}
+	if idx == db.namespaceMeta {
+		return db.updateNamespaceMeta(idxKey, typ, pos)
 	}
-	db.seqNo = curSeqNo
 	return nil
 }
 func checkConfigs(config *Configs) error {
@@ -521,6 +980,29 @@ func checkConfigs(config *Configs) error {
 	if config.DataFileMergeRatio <= 0 || config.DataFileMergeRatio > 1 {
 		return ConfigErrorMergeRatio
 	}
+	if config.BloomFilter &&
+		(config.BloomFalsePositiveRate <= 0 || config.BloomFalsePositiveRate >= 1) {
+		return ConfigErrorBloomFilterRate
+	}
+	if config.DiskSoftLimit < 0 || config.DiskHardLimit < 0 ||
+		(config.DiskSoftLimit > 0 && config.DiskHardLimit > 0 && config.DiskSoftLimit > config.DiskHardLimit) ||
+		config.ReclaimSoftRatio < 0 || config.ReclaimSoftRatio > 1 ||
+		config.ReclaimHardRatio < 0 || config.ReclaimHardRatio > 1 ||
+		(config.ReclaimSoftRatio > 0 && config.ReclaimHardRatio > 0 && config.ReclaimSoftRatio > config.ReclaimHardRatio) {
+		return ConfigErrorWriteStall
+	}
+	if config.RateLimit < 0 {
+		return ConfigErrorRateLimit
+	}
+	if config.Logger == nil {
+		config.Logger = nopLogger{}
+	}
+	if config.EventListener == nil {
+		config.EventListener = NopEventListener{}
+	}
+	if config.Secondary && config.IndexerType == index.BPTree {
+		return ErrorSecondaryUnsupported
+	}
 	if config.DirPath[len(config.DirPath)-1] != '/' {
 		config.DirPath += "/"
 	}
@@ -550,26 +1032,81 @@ func (db *DB) getValueByPosition(logRecordPos *data.LogRecordPos) ([]byte, error
 	return logRecord.Value, nil
 
 }
+
+// get the real key of the record, used by Fingerprint index to verify keys
+func (db *DB) getKeyByPosition(logRecordPos *data.LogRecordPos) ([]byte, error) {
+	var dataFile *data.File
+	if db.activeFile != nil && logRecordPos.Fid == db.activeFile.FileId {
+		dataFile = db.activeFile
+	} else {
+		dataFile = db.olderFiles[logRecordPos.Fid]
+	}
+	if dataFile == nil {
+		return nil, ErrorFileNotFound
+	}
+	logRecord, _, err := dataFile.Read(logRecordPos.Offset)
+	if err != nil {
+		return nil, err
+	}
+	realKey, _ := parseKeyWithSeqNo(logRecord.Key)
+	return realKey, nil
+}
 func (db *DB) loadSeqNo() error {
 	fileName := filepath.Join(db.config.DirPath, data.SeqNoFileName)
 	if _, err := os.Stat(fileName); os.IsNotExist(err) {
-		return nil
+		// the db is not closed normally, find the SeqNo from data files
+		return db.loadSeqNoFromFiles()
 	}
 
-	seqNoFile, err := data.OpenSeqNoFile(db.config.DirPath)
+	seqNoFile, err := data.NewReadOnlyDataFile(fileName, 0, fio.StandardIO)
 	if err != nil {
 		return err
 	}
+	defer seqNoFile.Close()
 	record, _, err := seqNoFile.Read(0)
+	if err != nil {
+		return err
+	}
 	seqNo, err := strconv.ParseUint(string(record.Value), 10, 64)
 	if err != nil {
 		return err
 	}
 	db.seqNo = seqNo
-	db.seqNoFileExist = true
-
+	if db.config.ReadOnly {
+		return nil
+	}
 	return os.Remove(fileName)
 }
+
+// loadSeqNoFromFiles scan keys of all data files to find the max SeqNo,
+// only used by B+ tree index which doesn't load index from data files
+func (db *DB) loadSeqNoFromFiles() error {
+	var curSeqNo = NonTxnSeqNo
+	for _, id := range db.fileIds {
+		var file *data.File
+		if uint32(id) == db.activeFile.FileId {
+			file = db.activeFile
+		} else {
+			file = db.olderFiles[uint32(id)]
+		}
+		var offset int64 = 0
+		for {
+			logRecord, lens, err := file.Read(offset)
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				return err
+			}
+			if _, seqNo := parseKeyWithSeqNo(logRecord.Key); seqNo > curSeqNo {
+				curSeqNo = seqNo
+			}
+			offset += lens
+		}
+	}
+	db.seqNo = curSeqNo
+	return nil
+}
 func (db *DB) resetIOType() error {
 	if db.activeFile == nil {
 		return nil
@@ -584,3 +1121,102 @@ func (db *DB) resetIOType() error {
 	}
 	return nil
 }
+
+// get the position of the key, the bloom filter is checked first to skip
+// lookups of keys that don't exist
+// need a mutex before reaching this func
+func (db *DB) getIndexPos(key []byte) *data.LogRecordPos {
+	if db.bloom != nil && !db.bloom.MayContain(key) {
+		return nil
+	}
+	pos := db.index.Get(key)
+	if pos == nil && db.bloom != nil {
+		db.bloom.RecordFalsePositive()
+	}
+	return pos
+}
+
+// add the key to bloom filter, rebuild a bigger one if it is full
+// need a mutex before reaching this func
+func (db *DB) addToBloomFilter(key []byte) error {
+	if db.bloom == nil {
+		return nil
+	}
+	if db.bloom.Full() {
+		return db.rebuildBloomFilter()
+	}
+	db.bloom.Add(key)
+	return nil
+}
+
+// rebuild the bloom filter from all keys in the index,
+// the deleted keys are dropped from the filter
+// need a mutex before reaching this func
+func (db *DB) rebuildBloomFilter() error {
+	capacity := uint64(db.index.Size()) * 2
+	if db.bloom != nil && capacity < db.bloom.Capacity() {
+		capacity = db.bloom.Capacity()
+	}
+	bloom := index.NewBloomFilter(capacity, db.config.BloomFalsePositiveRate)
+	iter := db.index.Iterator(false)
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		bloom.Add(iter.Key())
+	}
+	if db.bloom != nil {
+		bloom.InheritStat(db.bloom)
+	}
+	db.bloom = bloom
+	return nil
+}
+
+// load bloom filter saved with B+ tree index, or build it from the index
+func (db *DB) loadBloomFilter() error {
+	if db.config.IndexerType != index.BPTree {
+		return db.rebuildBloomFilter()
+	}
+	fileName := filepath.Join(db.config.IndexerDirPath, data.BloomFilterFileName)
+	if _, err := os.Stat(fileName); os.IsNotExist(err) {
+		return db.rebuildBloomFilter()
+	}
+	bloomFile, err := data.NewReadOnlyDataFile(fileName, 0, fio.StandardIO)
+	if err != nil {
+		return err
+	}
+	record, _, err := bloomFile.Read(0)
+	_ = bloomFile.Close()
+	if err == nil {
+		db.bloom, err = index.DecodeBloomFilter(record.Value)
+	}
+	if err != nil {
+		// broken filter file, the index is still right
+		if err := db.rebuildBloomFilter(); err != nil {
+			return err
+		}
+	}
+	if db.config.ReadOnly {
+		return nil
+	}
+	// like SeqNo, remove it so that a crash won't leave a stale filter
+	return os.Remove(fileName)
+}
+func (db *DB) saveBloomFilter() error {
+	fileName := filepath.Join(db.config.IndexerDirPath, data.BloomFilterFileName)
+	if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	bloomFile, err := data.OpenBloomFilterFile(db.config.IndexerDirPath)
+	if err != nil {
+		return err
+	}
+	defer bloomFile.Close()
+	record := data.LogRecord{
+		Key:   []byte(data.BloomFilterFileName),
+		Value: db.bloom.Encode(),
+	}
+	encRecord, _ := data.EncodeLogRecord(&record)
+	if err := bloomFile.Write(encRecord); err != nil {
+		return err
+	}
+	return bloomFile.Sync()
+}
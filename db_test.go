@@ -1,9 +1,15 @@
 package KVstore
 
 import (
+	"KVstore/data"
+	"KVstore/index"
 	"KVstore/utils"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 )
@@ -37,6 +43,60 @@ func TestOpen(t *testing.T) {
 	assert.NotNil(t, db)
 }
 
+func TestOpen_Error(t *testing.T) {
+	configs := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-open-error")
+	configs.DirPath = dir
+	db, err := Open(configs)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("key"), []byte("value")))
+	assert.Nil(t, db.Close())
+
+	// the files are loaded before the broken merge finished file is read
+	finFile := filepath.Join(dir, data.MergeFinishedFileName)
+	assert.Nil(t, os.WriteFile(finFile, []byte("broken merge finished file"), 0644))
+	_, err = Open(configs)
+	assert.NotNil(t, err)
+	// the lock is released, the same error is returned again
+	_, err2 := Open(configs)
+	assert.Equal(t, err, err2)
+
+	assert.Nil(t, os.Remove(finFile))
+	db, err = Open(configs)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	val, err := db.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+}
+
+func TestOpen_CorruptedRecord(t *testing.T) {
+	configs := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-corrupted-record")
+	configs.DirPath = dir
+	configs.IndexSnapshot = false
+	db, err := Open(configs)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	fileName := data.GetDataFileName(dir, db.activeFile.FileId)
+	size := db.activeFile.WriteOffset
+	assert.Nil(t, db.Close())
+
+	// a byte in the middle of the log is flipped, the records after it are not dropped
+	content, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	content[size/2] ^= 0xff
+	assert.Nil(t, os.WriteFile(fileName, content, 0644))
+	_, err = Open(configs)
+	assert.Equal(t, data.ErrorCRC, err)
+	info, err := os.Stat(fileName)
+	assert.Nil(t, err)
+	assert.Equal(t, size, info.Size())
+}
+
 func TestDB_Put(t *testing.T) {
 	configs := DefaultConfigs
 	dir, _ := os.MkdirTemp("./", "tests")
@@ -365,3 +425,334 @@ func TestDB_Backup(t *testing.T) {
 	destroyDB(db)
 	destroyDB(db2)
 }
+
+func TestDB_BloomFilter(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-bloom")
+	opts.DirPath = dir + "/"
+	opts.IndexerDirPath = dir + "/"
+	opts.IndexerType = index.BPTree
+	opts.BloomFilter = true
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(24))
+		assert.Nil(t, err)
+	}
+	for i := 100; i < 1100; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Equal(t, ErrorKeyNotFound, err)
+	}
+	err = db.Delete(utils.GetTestKey(2000))
+	assert.Nil(t, err)
+	stat := db.Stat()
+	assert.Equal(t, uint64(1001), stat.BloomLookups)
+	assert.Greater(t, stat.BloomNegatives, uint64(900))
+
+	// the filter is saved when closing and loaded when opening
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db2)
+	for i := 0; i < 100; i++ {
+		_, err := db2.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	_, err = db2.Get(utils.GetTestKey(100))
+	assert.Equal(t, ErrorKeyNotFound, err)
+}
+
+func TestDB_FingerprintIndex(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-fingerprint")
+	opts.DirPath = dir + "/"
+	opts.IndexerType = index.Fingerprint
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Delete(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	wb := db.NewWriteBatch(DefaultWriteBatchConfigs)
+	err = wb.Put(utils.GetTestKey(2), []byte("batch"))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+
+	stat := db.Stat()
+	assert.Equal(t, uint(999), stat.KeyNum)
+	assert.Greater(t, stat.IndexMemoryPerKey, float64(0))
+
+	// reload from data files, keys in batch are verified without SeqNo
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	_, err = db2.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrorKeyNotFound, err)
+	val, err := db2.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("batch"), val)
+	assert.Equal(t, 999, len(db2.ListKeys()))
+}
+
+func TestDB_DeleteRange(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-delete-range")
+	opts.DirPath = dir
+	opts.IndexSnapshot = false
+	opts.DataFileMergeRatio = 0.01
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("user-%03d", i)), utils.RandomValue(16)))
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("order-%03d", i)), utils.RandomValue(16)))
+	}
+	assert.Equal(t, ErrorInvalidRange, db.DeleteRange([]byte("b"), []byte("a")))
+	assert.Nil(t, db.DeletePrefix([]byte("user-")))
+	assert.Nil(t, db.DeleteRange([]byte("order-050"), []byte("order-060")))
+	assert.Equal(t, 90, len(db.ListKeys()))
+	_, err = db.Get([]byte("user-001"))
+	assert.Equal(t, ErrorKeyNotFound, err)
+	// keys written after the range are kept
+	assert.Nil(t, db.Put([]byte("user-001"), []byte("new")))
+
+	// replayed in the order of the log
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 91, len(db.ListKeys()))
+	_, err = db.Get([]byte("order-055"))
+	assert.Equal(t, ErrorKeyNotFound, err)
+
+	// deleted keys are dropped by merge
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Equal(t, 91, len(db.ListKeys()))
+	val, err := db.Get([]byte("user-001"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new"), val)
+}
+
+func TestDB_CompareAndSwap(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-cas")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	ok, err := db.PutIfAbsent([]byte("key"), []byte("a"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = db.PutIfAbsent([]byte("key"), []byte("b"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	ok, err = db.CompareAndSwap([]byte("key"), []byte("b"), []byte("c"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = db.CompareAndSwap([]byte("key"), []byte("a"), []byte("c"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	val, version, err := db.GetWithVersion([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("c"), val)
+	assert.NotZero(t, version)
+	ok, err = db.PutIfVersion([]byte("key"), []byte("d"), version)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	// the version is changed by the write
+	ok, err = db.PutIfVersion([]byte("key"), []byte("e"), version)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	ok, err = db.DeleteIfEquals([]byte("key"), []byte("c"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = db.DeleteIfEquals([]byte("key"), []byte("d"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	_, _, err = db.GetWithVersion([]byte("key"))
+	assert.Equal(t, ErrorKeyNotFound, err)
+
+	// concurrent increments never lose an update
+	assert.Nil(t, db.Put([]byte("counter"), []byte("0")))
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; {
+				val, version, err := db.GetWithVersion([]byte("counter"))
+				assert.Nil(t, err)
+				n, _ := strconv.Atoi(string(val))
+				ok, err := db.PutIfVersion([]byte("counter"), []byte(strconv.Itoa(n+1)), version)
+				assert.Nil(t, err)
+				if ok {
+					i++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	val, err = db.Get([]byte("counter"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("200"), val)
+}
+
+func TestDB_VersionAfterMerge(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-version-merge")
+	opts.DirPath = dir
+	opts.DataFileMergeRatio = 0.01
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	// the first record of key is at the start of the log
+	assert.Nil(t, db.Put([]byte("key"), []byte("a")))
+	_, version, err := db.GetWithVersion([]byte("key"))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("key"), []byte("b")))
+	ok, err := db.DeleteIfEquals(namespaceKey(1, []byte("key")), []byte("b"))
+	assert.Equal(t, ErrorKeyReserved, err)
+	assert.False(t, ok)
+
+	// the merged record of the new value is at the start of the log again
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	val, newVersion, err := db.GetWithVersion([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("b"), val)
+	assert.NotEqual(t, version, newVersion)
+	ok, err = db.PutIfVersion([]byte("key"), []byte("c"), version)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = db.PutIfVersion([]byte("key"), []byte("c"), newVersion)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
+
+func TestDB_MultiGet(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-multi-get")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), []byte(strconv.Itoa(i))))
+	}
+	assert.Nil(t, db.Delete(utils.GetTestKey(5)))
+	keys := [][]byte{utils.GetTestKey(999), utils.GetTestKey(5), nil, utils.GetTestKey(0), []byte("missing")}
+	values, errs := db.MultiGet(keys)
+	assert.Equal(t, len(keys), len(values))
+	assert.Equal(t, []byte("999"), values[0])
+	assert.Nil(t, errs[0])
+	assert.Equal(t, ErrorKeyNotFound, errs[1])
+	assert.Equal(t, ErrorInvalidKey, errs[2])
+	assert.Equal(t, []byte("0"), values[3])
+	assert.Nil(t, errs[3])
+	assert.Equal(t, ErrorKeyNotFound, errs[4])
+}
+
+func TestDB_WriteStall(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-write-stall")
+	opts.DirPath = dir
+	opts.DiskHardLimit = 16 * 1024
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	// past the hard limit writes fail fast
+	var i int
+	for ; i < 1000; i++ {
+		if err = db.Put(utils.GetTestKey(i), utils.RandomValue(128)); err != nil {
+			break
+		}
+	}
+	assert.Equal(t, ErrorWriteStopped, err)
+	assert.Less(t, i, 1000)
+	assert.Equal(t, WriteStallStop, db.Stat().WriteStall)
+	assert.Equal(t, ErrorWriteStopped, db.Delete(utils.GetTestKey(0)))
+	_, err = db.Get(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+
+	// past the soft limit writes are slowed down and a merge is requested
+	opts.DiskHardLimit = 0
+	opts.ReclaimSoftRatio = 0.3
+	opts.DataFileMergeRatio = 0.3
+	opts.WriteSlowdownDelay = 20 * time.Millisecond
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, WriteStallNone, db.Stat().WriteStall)
+	for j := 0; j < i/2; j++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(j)))
+		if db.Stat().WriteStall != WriteStallNone {
+			break
+		}
+	}
+	assert.Equal(t, WriteStallSlowdown, db.Stat().WriteStall)
+	start := time.Now()
+	assert.Nil(t, db.Put([]byte("key"), []byte("value")))
+	assert.GreaterOrEqual(t, time.Since(start), opts.WriteSlowdownDelay)
+	mergeFinFile := filepath.Join(db.getMergePath(), data.MergeFinishedFileName)
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(mergeFinFile)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	// the stall is cleared by the merge without reopening
+	assert.Eventually(t, func() bool {
+		return db.Stat().WriteStall == WriteStallNone
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		db.mutex.RLock()
+		defer db.mutex.RUnlock()
+		return db.mergeDone == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	start = time.Now()
+	assert.Nil(t, db.Put([]byte("key"), []byte("value")))
+	assert.Less(t, time.Since(start), opts.WriteSlowdownDelay)
+
+	// the merged copy is on disk along with the old files until it is installed
+	db.mutex.Lock()
+	assert.Greater(t, db.mergeDirSize, int64(0))
+	opts.DiskSoftLimit = db.diskSize + 1
+	db.config.DiskSoftLimit = opts.DiskSoftLimit
+	db.mutex.Unlock()
+	assert.Equal(t, WriteStallSlowdown, db.Stat().WriteStall)
+
+	// the merged files are installed on open
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Equal(t, WriteStallNone, db.Stat().WriteStall)
+	val, err := db.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+
+	opts.DiskSoftLimit, opts.DiskHardLimit = 2, 1
+	_, err = Open(opts)
+	assert.Equal(t, ConfigErrorWriteStall, err)
+}
@@ -0,0 +1,84 @@
+package KVstore
+
+// failWrite drop the records after offset of the active file and make the db
+// read only until Resume, return err
+// need a mutex before reaching this func
+func (db *DB) failWrite(err error, offset int64) error {
+	// if it fails, Resume tries it again
+	_ = db.activeFile.Truncate(offset)
+	db.setBackgroundError(err)
+	return err
+}
+
+// need a mutex before reaching this func
+func (db *DB) setBackgroundError(err error) {
+	db.bgError = err
+	db.config.Logger.Error("db is read only after a failed write", "err", err)
+	db.config.EventListener.OnBackgroundError(err)
+}
+
+func (db *DB) syncFailed(err error) {
+	db.config.Logger.Error("sync failed", "file", db.activeFile.FileId, "err", err)
+	db.config.EventListener.OnSyncError(db.activeFile.FileId, err)
+}
+
+// a failed sync may lose any write since the last one, the db is read only until Resume
+// need a mutex before reaching this func
+func (db *DB) syncActiveFile() error {
+	if err := db.fsync(); err != nil {
+		db.syncFailed(err)
+		db.setBackgroundError(err)
+		return err
+	}
+	return nil
+}
+
+// BackgroundError the error of the failed write or sync which made the db read only,
+// nil if writes are allowed
+func (db *DB) BackgroundError() error {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.bgError
+}
+
+// Resume allow writes again once the cause of the failed write is fixed, e.g. disk
+// space is freed. The partial record is dropped, the active file is synced and its
+// records are read back, if any of it fails the db stays read only.
+// Records are read back through the page cache, after a failed sync the kernel may
+// have dropped pages which never reached the disk, those writes are lost on a crash.
+func (db *DB) Resume() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.bgError == nil {
+		return nil
+	}
+	if db.activeFile != nil {
+		if err := db.activeFile.Truncate(db.activeFile.WriteOffset); err != nil {
+			return err
+		}
+		if err := db.fsync(); err != nil {
+			return err
+		}
+		if err := db.verifyActiveFile(); err != nil {
+			return err
+		}
+	}
+	db.bgError = nil
+	db.config.Logger.Info("db resumed", "dir", db.config.DirPath)
+	return nil
+}
+
+// read every record of the active file up to WriteOffset, return the error of
+// the first broken one
+// need a mutex before reaching this func
+func (db *DB) verifyActiveFile() error {
+	var offset int64
+	for offset < db.activeFile.WriteOffset {
+		_, size, err := db.activeFile.Read(offset)
+		if err != nil {
+			return err
+		}
+		offset += size
+	}
+	return nil
+}
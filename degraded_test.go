@@ -0,0 +1,141 @@
+package KVstore
+
+import (
+	"KVstore/data"
+	"KVstore/fio"
+	"KVstore/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// failingIO writes half of the data then fails, like a full disk
+type failingIO struct {
+	fio.IOManager
+	failWrite bool
+	failSync  bool
+}
+
+func (f *failingIO) Write(b []byte) (int, error) {
+	if !f.failWrite {
+		return f.IOManager.Write(b)
+	}
+	n, _ := f.IOManager.Write(b[:len(b)/2])
+	return n, syscall.ENOSPC
+}
+
+func (f *failingIO) Sync() error {
+	if f.failSync {
+		return syscall.EIO
+	}
+	return f.IOManager.Sync()
+}
+
+func TestDB_Degraded(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-degraded")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+
+	// the partial record is dropped and writes are rejected
+	io := &failingIO{IOManager: db.activeFile.IOManager, failWrite: true}
+	db.activeFile.IOManager = io
+	assert.Equal(t, syscall.ENOSPC, db.Put([]byte("failed"), []byte("value")))
+	assert.Equal(t, syscall.ENOSPC, db.BackgroundError())
+	size, err := io.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, db.activeFile.WriteOffset, size)
+	io.failWrite = false
+	assert.Equal(t, ErrorDegraded, db.Put([]byte("key"), []byte("value")))
+	assert.Equal(t, ErrorDegraded, db.Merge())
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(1), val)
+
+	assert.Nil(t, db.Resume())
+	assert.Nil(t, db.BackgroundError())
+	assert.Nil(t, db.Put([]byte("key"), []byte("value")))
+
+	// a failed sync is not counted as a write
+	db.config.SyncWrites = true
+	io.failSync = true
+	diskSize, changed := db.diskSize, db.changed
+	assert.Equal(t, syscall.EIO, db.Put([]byte("synced"), []byte("value")))
+	assert.Equal(t, diskSize, db.diskSize)
+	if changed != nil {
+		select {
+		case <-changed:
+			t.Fatal("subscriptions are woken up by a failed write")
+		default:
+		}
+	}
+	io.failSync = false
+	db.config.SyncWrites = false
+	assert.Nil(t, db.Resume())
+
+	// a batch is not committed if its sync fails
+	io.failSync = true
+	wb := db.NewWriteBatch(DefaultWriteBatchConfigs)
+	assert.Nil(t, wb.Put([]byte("batch"), []byte("value")))
+	assert.Equal(t, syscall.EIO, wb.Commit())
+	assert.Equal(t, ErrorDegraded, db.Put([]byte("key"), []byte("value")))
+	assert.Equal(t, syscall.EIO, db.Resume())
+	io.failSync = false
+	assert.Nil(t, db.Resume())
+	assert.Nil(t, db.Close())
+
+	db, err = Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Equal(t, 11, len(db.ListKeys()))
+	_, err = db.Get([]byte("failed"))
+	assert.Equal(t, ErrorKeyNotFound, err)
+	_, err = db.Get([]byte("batch"))
+	assert.Equal(t, ErrorKeyNotFound, err)
+	val, err = db.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+}
+
+func TestDB_DegradedRollover(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-degraded-rollover")
+	opts.DirPath = dir
+	opts.DataFileSize = 4 * 1024
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(utils.GetTestKey(0), utils.RandomValue(128)))
+
+	// the next data file can't be created
+	activeFileId := db.activeFile.FileId
+	nextFile := data.GetDataFileName(dir, activeFileId+1)
+	assert.Nil(t, os.Mkdir(nextFile, os.ModePerm))
+	var i int
+	for i = 1; i < 100; i++ {
+		if err = db.Put(utils.GetTestKey(i), utils.RandomValue(128)); err != nil {
+			break
+		}
+	}
+	assert.NotNil(t, err)
+	assert.Equal(t, activeFileId, db.activeFile.FileId)
+	_, ok := db.olderFiles[activeFileId]
+	assert.False(t, ok)
+
+	assert.Nil(t, os.Remove(nextFile))
+	assert.Nil(t, db.Resume())
+	assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+	assert.Equal(t, activeFileId+1, db.activeFile.FileId)
+	_, ok = db.olderFiles[activeFileId]
+	assert.True(t, ok)
+	assert.Nil(t, db.Close())
+
+	db, err = Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Equal(t, i+1, len(db.ListKeys()))
+}
@@ -3,19 +3,53 @@ package KVstore
 import "errors"
 
 var (
-	ErrorKeyEmpty             = errors.New("key is empty")
-	ErrorUpdateIndex          = errors.New("cannot update index")
-	ErrorInvalidKey           = errors.New("no such key")
-	ErrorKeyNotFound          = errors.New("key not found")
-	ErrorFileNotFound         = errors.New("data file not found")
-	ConfigErrorDBDirEmpty     = errors.New("database dir path is empty")
-	ConfigErrorSize           = errors.New("invalid data file size")
-	ErrorLoadFiles            = errors.New("cannot load files")
-	ErrorParse                = errors.New("the file name may be corrupted ")
-	ErrorExceedMaxBatchNum    = errors.New("exceed max batch num")
-	ErrorIsMerging            = errors.New("the db is merging")
-	ErrorDataBaseIsInUse      = errors.New("the db is in use")
-	ConfigErrorMergeRatio     = errors.New("invalid merge ratio")
-	ErrorMergeRationUnReached = errors.New("merge ratio is not reached")
-	ErrorNoEnoughSpace        = errors.New("no enough space")
+	ErrorKeyEmpty                 = errors.New("key is empty")
+	ErrorUpdateIndex              = errors.New("cannot update index")
+	ErrorInvalidKey               = errors.New("no such key")
+	ErrorKeyNotFound              = errors.New("key not found")
+	ErrorFileNotFound             = errors.New("data file not found")
+	ConfigErrorDBDirEmpty         = errors.New("database dir path is empty")
+	ConfigErrorSize               = errors.New("invalid data file size")
+	ErrorLoadFiles                = errors.New("cannot load files")
+	ErrorParse                    = errors.New("the file name may be corrupted ")
+	ErrorExceedMaxBatchNum        = errors.New("exceed max batch num")
+	ErrorIsMerging                = errors.New("the db is merging")
+	ErrorDataBaseIsInUse          = errors.New("the db is in use")
+	ConfigErrorMergeRatio         = errors.New("invalid merge ratio")
+	ErrorMergeRationUnReached     = errors.New("merge ratio is not reached")
+	ErrorNoEnoughSpace            = errors.New("no enough space")
+	ConfigErrorBloomFilterRate    = errors.New("invalid bloom filter false positive rate")
+	ErrorBackupCorrupted          = errors.New("backup file is corrupted")
+	ErrorRestoreDirNotEmpty       = errors.New("restore target dir is not empty")
+	ErrorRestorePointNotFound     = errors.New("restore point is not found in the log")
+	ErrorRestorePointUnsupported  = errors.New("restore point is not supported by backups of B+ tree index")
+	ErrorRestorePointAmbiguous    = errors.New("restore time falls among writes without a commit time")
+	ErrorCheckpointDirNotEmpty    = errors.New("checkpoint dir is not empty")
+	ErrorDataFileTooLarge         = errors.New("data file size is too large for change stream")
+	ErrorChangeStreamCompacted    = errors.New("change stream position is removed by merge")
+	ErrorReplicationProtocol      = errors.New("unexpected replication data from the leader")
+	ErrorReplicationCompacted     = errors.New("follower position is removed by merge on the leader")
+	ConfigErrorShards             = errors.New("no shard dir is given")
+	ConfigErrorShardBoundaries    = errors.New("range boundaries must be sorted and one less than shards")
+	ErrorCrossShardBatch          = errors.New("keys of a write batch must be in the same shard")
+	ErrorShardManifestMismatch    = errors.New("sharded configs don't match the manifest of the shard dir")
+	ErrorShardManifestCorrupted   = errors.New("shard manifest is corrupted")
+	ErrorIteratorKeyOnly          = errors.New("iterator is key only, no value to read")
+	ErrorKeyReserved              = errors.New("key prefix is reserved for namespaces")
+	ErrorNamespaceNameEmpty       = errors.New("namespace name is empty")
+	ErrorNamespaceExists          = errors.New("namespace already exists")
+	ErrorNamespaceNotFound        = errors.New("namespace not found")
+	ErrorNamespaceUnsupported     = errors.New("namespaces are not supported by B+ tree index")
+	ErrorNamespaceCorrupted       = errors.New("namespace record is corrupted")
+	ErrorInvalidRange             = errors.New("range start must be less than end")
+	ErrorNoMergeOperator          = errors.New("key has operands but no merge operator is set")
+	ErrorInvalidOperand           = errors.New("invalid operand for the merge operator")
+	ErrorMergeOperatorUnsupported = errors.New("merge operator is not supported by B+ tree index")
+	ErrorReadOnly                 = errors.New("db is opened read only")
+	ErrorNotSecondary             = errors.New("db is not opened in secondary mode")
+	ErrorSecondaryUnsupported     = errors.New("secondary mode is not supported by B+ tree index")
+	ErrorWriteStopped             = errors.New("writes are stopped by disk usage limits, merge and reopen the db")
+	ConfigErrorWriteStall         = errors.New("invalid write stall limits")
+	ConfigErrorRateLimit          = errors.New("rate limit must not be negative")
+	ErrorDegraded                 = errors.New("db is read only after a failed write, call Resume once it is fixed")
 )
@@ -0,0 +1,64 @@
+package KVstore
+
+import "time"
+
+// EventListener is told about background work and failures of the db. Callbacks
+// are called synchronously, possibly with the db mutex held, so they must be
+// quick and must not call the db. Embed NopEventListener to only implement some.
+type EventListener interface {
+	// the active file is full and a new one is created
+	OnFileRollover(info FileRolloverInfo)
+	OnMergeBegin(info MergeInfo)
+	// Err is set if merge failed
+	OnMergeEnd(info MergeInfo)
+	// a partial record at the end of the log is dropped on open
+	OnRecoveryTruncation(info TruncationInfo)
+	OnSyncError(fileId uint32, err error)
+	// the db is read only after a failed write or sync until Resume
+	OnBackgroundError(err error)
+	OnBackupBegin(info BackupInfo)
+	// Err is set if backup failed
+	OnBackupEnd(info BackupInfo)
+	OnWriteStallChange(from WriteStall, to WriteStall)
+}
+
+type FileRolloverInfo struct {
+	OldFileId uint32
+	NewFileId uint32
+}
+
+type MergeInfo struct {
+	// files before it are merged
+	NonMergeFileId uint32
+	Duration       time.Duration
+	Err            error
+}
+
+type TruncationInfo struct {
+	FileId uint32
+	// the partial record starts here
+	Offset int64
+	// bytes dropped
+	Size int64
+	Err  error
+}
+
+type BackupInfo struct {
+	// empty for BackupTo
+	Dir      string
+	Duration time.Duration
+	Err      error
+}
+
+// NopEventListener does nothing, used when Configs.EventListener is nil
+type NopEventListener struct{}
+
+func (NopEventListener) OnFileRollover(FileRolloverInfo)           {}
+func (NopEventListener) OnMergeBegin(MergeInfo)                    {}
+func (NopEventListener) OnMergeEnd(MergeInfo)                      {}
+func (NopEventListener) OnRecoveryTruncation(TruncationInfo)       {}
+func (NopEventListener) OnSyncError(uint32, error)                 {}
+func (NopEventListener) OnBackgroundError(error)                   {}
+func (NopEventListener) OnBackupBegin(BackupInfo)                  {}
+func (NopEventListener) OnBackupEnd(BackupInfo)                    {}
+func (NopEventListener) OnWriteStallChange(WriteStall, WriteStall) {}
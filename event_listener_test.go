@@ -0,0 +1,113 @@
+package KVstore
+
+import (
+	"KVstore/data"
+	"KVstore/utils"
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+type recordingListener struct {
+	NopEventListener
+	mutex       sync.Mutex
+	rollovers   int
+	merges      []MergeInfo
+	truncations []TruncationInfo
+	syncErrors  int
+	bgErrors    []error
+	backups     []BackupInfo
+}
+
+func (l *recordingListener) OnFileRollover(FileRolloverInfo) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.rollovers++
+}
+func (l *recordingListener) OnMergeEnd(info MergeInfo) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.merges = append(l.merges, info)
+}
+func (l *recordingListener) OnRecoveryTruncation(info TruncationInfo) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.truncations = append(l.truncations, info)
+}
+func (l *recordingListener) OnSyncError(uint32, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.syncErrors++
+}
+func (l *recordingListener) OnBackgroundError(err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.bgErrors = append(l.bgErrors, err)
+}
+func (l *recordingListener) OnBackupEnd(info BackupInfo) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.backups = append(l.backups, info)
+}
+
+func TestDB_EventListener(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-event-listener")
+	opts.DirPath = dir
+	opts.DataFileSize = 4 * 1024
+	opts.DataFileMergeRatio = 0.01
+	listener := &recordingListener{}
+	opts.EventListener = listener
+	var logs bytes.Buffer
+	opts.Logger = NewStdLogger(log.New(&logs, "", 0))
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Contains(t, logs.String(), "INFO db opened dir="+opts.DirPath)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.Greater(t, listener.rollovers, 0)
+	assert.Nil(t, db.Delete(utils.GetTestKey(0)))
+	assert.Nil(t, db.Merge())
+	assert.Equal(t, 1, len(listener.merges))
+	assert.Nil(t, listener.merges[0].Err)
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-event-listener-backup")
+	defer os.RemoveAll(backupDir)
+	assert.Nil(t, db.Backup(backupDir))
+	assert.Equal(t, []BackupInfo{{Dir: backupDir, Duration: listener.backups[0].Duration}}, listener.backups)
+
+	io := &failingIO{IOManager: db.activeFile.IOManager, failSync: true}
+	db.activeFile.IOManager = io
+	assert.Equal(t, syscall.EIO, db.Sync())
+	assert.Equal(t, 1, listener.syncErrors)
+	assert.Equal(t, []error{syscall.EIO}, listener.bgErrors)
+	assert.Contains(t, logs.String(), "ERROR sync failed")
+	io.failSync = false
+	assert.Nil(t, db.Resume())
+
+	// a partial record left by a crash is dropped on open
+	key := utils.GetTestKey(1000)
+	encRecord, _ := data.EncodeLogRecord(&data.LogRecord{
+		Key:   logRecordKeyWithSeqNo(key, NonTxnSeqNo),
+		Value: []byte("value"),
+		Type:  data.PUT,
+	})
+	assert.Nil(t, db.activeFile.Write(encRecord[:len(encRecord)-2]))
+	activeFileId, offset := db.activeFile.FileId, db.activeFile.WriteOffset-int64(len(encRecord)-2)
+	assert.Nil(t, db.Close())
+	opts.IndexSnapshot = false
+	db, err = Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Equal(t, []TruncationInfo{{FileId: activeFileId, Offset: offset, Size: int64(len(encRecord) - 2), Err: data.ErrorCRC}}, listener.truncations)
+	assert.Equal(t, 99, len(db.ListKeys()))
+	assert.Nil(t, db.Put(key, []byte("value")))
+	val, err := db.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+}
@@ -22,15 +22,30 @@ type IOManager interface {
 	// Close the file
 	Close() error
 	Size() (int64, error)
+	// Truncate the file to size
+	Truncate(size int64) error
 }
 
+// OpenMode how a file is opened, a read only file is never created
+type OpenMode byte
+
+const (
+	ReadWrite OpenMode = iota
+	ReadOnly
+)
+
 // InitIOManager init IO manager,support standard file system IO
 func InitIOManager(fileName string, ioType FileIOTypes) (IOManager, error) {
+	return OpenIOManager(fileName, ioType, ReadWrite)
+}
+
+// OpenIOManager init IO manager with the open mode
+func OpenIOManager(fileName string, ioType FileIOTypes, mode OpenMode) (IOManager, error) {
 	switch ioType {
 	case StandardIO:
-		return NewFileIOManager(fileName)
+		return openFileIO(fileName, mode)
 	case MemoryMappedIO:
-		return NewMMapIOManager(fileName)
+		return openMMapIO(fileName, mode)
 	default:
 		panic("not supported io type")
 	}
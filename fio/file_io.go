@@ -8,11 +8,15 @@ type FileIO struct {
 }
 
 func NewFileIOManager(fileName string) (*FileIO, error) {
-	fd, err := os.OpenFile(
-		fileName,
-		os.O_CREATE|os.O_RDWR|os.O_APPEND,
-		DataFilePerm,
-	)
+	return openFileIO(fileName, ReadWrite)
+}
+
+func openFileIO(fileName string, mode OpenMode) (*FileIO, error) {
+	flag := os.O_CREATE | os.O_RDWR | os.O_APPEND
+	if mode == ReadOnly {
+		flag = os.O_RDONLY
+	}
+	fd, err := os.OpenFile(fileName, flag, DataFilePerm)
 	if err != nil {
 		return nil, err
 	}
@@ -34,6 +38,10 @@ func (f *FileIO) Sync() error {
 func (f *FileIO) Close() error {
 	return f.fd.Close()
 }
+
+func (f *FileIO) Truncate(size int64) error {
+	return f.fd.Truncate(size)
+}
 func (f *FileIO) Size() (int64, error) {
 	stat, err := f.fd.Stat()
 	if err != nil {
@@ -65,3 +65,29 @@ func TestFileIO_Close(t *testing.T) {
 	assert.Nil(t, err)
 	destroyFile(filepath.Join(curFile, "test.data"))
 }
+func TestFileIO_ReadOnly(t *testing.T) {
+	curFile, err := os.Getwd()
+	name := filepath.Join(curFile, "test.data")
+	// a read only file is never created
+	_, err = OpenIOManager(name, StandardIO, ReadOnly)
+	assert.True(t, os.IsNotExist(err))
+	_, err = OpenIOManager(name, MemoryMappedIO, ReadOnly)
+	assert.True(t, os.IsNotExist(err))
+
+	fio, err := NewFileIOManager(name)
+	assert.Nil(t, err)
+	_, err = fio.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	assert.Nil(t, fio.Close())
+
+	readIO, err := OpenIOManager(name, StandardIO, ReadOnly)
+	assert.Nil(t, err)
+	bytes := make([]byte, 5)
+	_, err = readIO.Read(bytes, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-a"), bytes)
+	_, err = readIO.Write([]byte("b"))
+	assert.NotNil(t, err)
+	assert.Nil(t, readIO.Close())
+	destroyFile(name)
+}
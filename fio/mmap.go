@@ -1,18 +1,29 @@
 package fio
 
 import (
+	"errors"
 	"golang.org/x/exp/mmap"
 	"os"
 )
 
+var ErrorMMapReadOnly = errors.New("memory mapped file is read only")
+
 type MMapIO struct {
 	readerAt *mmap.ReaderAt
 }
 
 func NewMMapIOManager(fileName string) (*MMapIO, error) {
-	_, err := os.OpenFile(fileName, os.O_CREATE, DataFilePerm)
-	if err != nil {
-		return nil, err
+	return openMMapIO(fileName, ReadWrite)
+}
+
+// the mapping is always read only, the file is created only in ReadWrite mode
+func openMMapIO(fileName string, mode OpenMode) (*MMapIO, error) {
+	if mode == ReadWrite {
+		fd, err := os.OpenFile(fileName, os.O_CREATE, DataFilePerm)
+		if err != nil {
+			return nil, err
+		}
+		_ = fd.Close()
 	}
 	readerAt, err := mmap.Open(fileName)
 	if err != nil {
@@ -33,6 +44,11 @@ func (mmap *MMapIO) Sync() error {
 	return nil
 }
 
+// Truncate the mapping is only for reading, open the file with standard IO to truncate it
+func (mmap *MMapIO) Truncate(size int64) error {
+	return ErrorMMapReadOnly
+}
+
 func (mmap *MMapIO) Close() error {
 	return mmap.readerAt.Close()
 }
@@ -40,4 +40,10 @@ func TestMMap_Read(t *testing.T) {
 	n2, err := mmapIO2.Read(b2, 0)
 	assert.Nil(t, err)
 	assert.Equal(t, 2, n2)
+
+	// the mapping can't drop data
+	assert.Equal(t, ErrorMMapReadOnly, mmapIO2.Truncate(2))
+	size, err = mmapIO2.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6), size)
 }
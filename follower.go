@@ -0,0 +1,326 @@
+package KVstore
+
+import (
+	"KVstore/data"
+	"KVstore/fio"
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// the follower retries to connect the leader after this long
+const replicationRetryInterval = 500 * time.Millisecond
+
+// Follower a hot standby of the leader, it tails the data files of the leader
+// into its own dir with the same layout, and only serves reads until promoted
+type Follower struct {
+	db         *DB
+	leaderAddr string
+	mutex      *sync.Mutex // protects conn and stat
+	conn       net.Conn
+	stat       ReplicationStat
+	done       chan struct{} // closed by Close or Promote
+	finished   chan struct{} // closed when replication exits
+	once       sync.Once
+
+	// bytes received but not a whole record yet
+	tail       []byte
+	tailFid    uint32
+	tailOffset int64
+	// records not written yet, a WriteBatch is written as a whole
+	unflushed []*replicatedRecord
+	openTxn   uint64 // seqNo of the batch waiting for its commit record
+	txnStart  int    // first record of openTxn in unflushed
+}
+
+// ReplicationStat state of the follower
+type ReplicationStat struct {
+	Connected     bool
+	AppliedFid    uint32 // the follower has applied the log before (AppliedFid, AppliedOffset)
+	AppliedOffset int64
+	LagBytes      int64     // bytes of the leader log not applied yet
+	LastContact   time.Time // when the last frame is received from the leader
+	LastError     error     // why the last connection is broken
+}
+
+type replicatedRecord struct {
+	raw       []byte
+	record    *data.LogRecord
+	pos       data.LogRecordPos
+	skipIndex bool // belongs to a batch which is never committed
+}
+
+// OpenFollower open the db in configs as a follower of the leader at leaderAddr
+func OpenFollower(configs Configs, leaderAddr string) (*Follower, error) {
+	db, err := Open(configs)
+	if err != nil {
+		return nil, err
+	}
+	f := &Follower{
+		db:         db,
+		leaderAddr: leaderAddr,
+		mutex:      new(sync.Mutex),
+		done:       make(chan struct{}),
+		finished:   make(chan struct{}),
+	}
+	go f.run()
+	return f, nil
+}
+
+func (f *Follower) Get(key []byte) ([]byte, error) {
+	return f.db.Get(key)
+}
+func (f *Follower) NewIterator(config IteratorConfigs) *Iterator {
+	return f.db.NewIterator(config)
+}
+func (f *Follower) ListKeys() [][]byte {
+	return f.db.ListKeys()
+}
+
+func (f *Follower) Stat() ReplicationStat {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.stat
+}
+
+// Promote stop replication and return the db to accept writes,
+// the follower must not be used anymore
+func (f *Follower) Promote() (*DB, error) {
+	f.stop()
+	return f.db, nil
+}
+
+// Close stop replication and close the db
+func (f *Follower) Close() error {
+	f.stop()
+	return f.db.Close()
+}
+
+func (f *Follower) stop() {
+	f.once.Do(func() {
+		close(f.done)
+		f.mutex.Lock()
+		if f.conn != nil {
+			_ = f.conn.Close()
+		}
+		f.mutex.Unlock()
+	})
+	<-f.finished
+}
+
+// keep replicating until stopped, reconnect if the connection is broken
+func (f *Follower) run() {
+	defer close(f.finished)
+	for {
+		err := f.replicate()
+		f.mutex.Lock()
+		f.stat.Connected = false
+		f.stat.LastError = err
+		f.conn = nil
+		f.mutex.Unlock()
+		// a broken stream is received again from the applied position
+		f.tail, f.unflushed, f.openTxn = nil, nil, 0
+		select {
+		case <-f.done:
+			return
+		case <-time.After(replicationRetryInterval):
+		}
+	}
+}
+
+func (f *Follower) replicate() error {
+	conn, err := net.DialTimeout("tcp", f.leaderAddr, replicationTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	f.mutex.Lock()
+	select {
+	case <-f.done:
+		f.mutex.Unlock()
+		return nil
+	default:
+	}
+	f.conn = conn
+	f.mutex.Unlock()
+
+	fid, offset := f.appliedPosition()
+	var handshake [replicationHandshakeSize]byte
+	binary.BigEndian.PutUint32(handshake[0:4], fid)
+	binary.BigEndian.PutUint64(handshake[4:12], uint64(offset))
+	if _, err := conn.Write(handshake[:]); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	_ = conn.SetReadDeadline(time.Now().Add(replicationTimeout))
+	status, err := reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	if status == replicationStatusCompacted {
+		return ErrorReplicationCompacted
+	}
+	f.tailFid, f.tailOffset = fid, offset
+	f.mutex.Lock()
+	f.stat.Connected = true
+	f.mutex.Unlock()
+
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(replicationTimeout))
+		frame, err := readReplicationFrame(reader)
+		if err != nil {
+			return err
+		}
+		if err := f.handleFrame(frame); err != nil {
+			return err
+		}
+	}
+}
+
+// the end of the log in the follower dir
+func (f *Follower) appliedPosition() (uint32, int64) {
+	f.db.mutex.RLock()
+	defer f.db.mutex.RUnlock()
+	if f.db.activeFile == nil {
+		return 0, 0
+	}
+	return f.db.activeFile.FileId, f.db.activeFile.WriteOffset
+}
+
+func (f *Follower) handleFrame(frame *replicationFrame) error {
+	if len(frame.data) > 0 {
+		if frame.fid != f.tailFid {
+			// a broken record at the end of a sealed file, never complete
+			f.tail, f.tailFid, f.tailOffset = nil, frame.fid, frame.offset
+		}
+		if frame.offset != f.tailOffset+int64(len(f.tail)) {
+			return ErrorReplicationProtocol
+		}
+		f.tail = append(f.tail, frame.data...)
+		if err := f.parseTail(); err != nil {
+			return err
+		}
+	}
+
+	fid, offset := f.appliedPosition()
+	lag := frame.remaining + int64(len(f.tail))
+	for _, r := range f.unflushed {
+		lag += int64(len(r.raw))
+	}
+	f.mutex.Lock()
+	f.stat.AppliedFid, f.stat.AppliedOffset = fid, offset
+	f.stat.LagBytes = lag
+	f.stat.LastContact = time.Now()
+	f.mutex.Unlock()
+	return nil
+}
+
+// decode whole records in tail, and write them when no batch is open
+func (f *Follower) parseTail() error {
+	var consumed int64 = 0
+	for {
+		logRecord, size, err := data.DecodeLogRecord(f.tail[consumed:])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		raw := make([]byte, size)
+		copy(raw, f.tail[consumed:consumed+size])
+		logRecord, _, _ = data.DecodeLogRecord(raw)
+		r := &replicatedRecord{
+			raw:    raw,
+			record: logRecord,
+			pos:    data.LogRecordPos{Fid: f.tailFid, Offset: f.tailOffset + consumed, Size: uint32(size)},
+		}
+		consumed += size
+
+		_, seqNo := parseKeyWithSeqNo(logRecord.Key)
+		// records of a batch are written together, another record means
+		// the batch is never committed (e.g. the leader crashed)
+		if f.openTxn != NonTxnSeqNo && seqNo != f.openTxn {
+			for _, txnRecord := range f.unflushed[f.txnStart:] {
+				txnRecord.skipIndex = true
+			}
+			f.openTxn = NonTxnSeqNo
+		}
+		if seqNo != NonTxnSeqNo && f.openTxn == NonTxnSeqNo && logRecord.Type != data.COMMIT {
+			f.openTxn, f.txnStart = seqNo, len(f.unflushed)
+		}
+		f.unflushed = append(f.unflushed, r)
+		if logRecord.Type == data.COMMIT && seqNo == f.openTxn {
+			f.openTxn = NonTxnSeqNo
+		}
+		if f.openTxn == NonTxnSeqNo {
+			if err := f.db.applyReplicatedRecords(f.unflushed); err != nil {
+				return err
+			}
+			f.unflushed = nil
+		}
+	}
+	f.tail = f.tail[consumed:]
+	f.tailOffset += consumed
+	return nil
+}
+
+// write records received from the leader at the same position, and update index
+func (db *DB) applyReplicatedRecords(records []*replicatedRecord) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.bgError != nil {
+		return ErrorDegraded
+	}
+	for _, r := range records {
+		if db.activeFile == nil || db.activeFile.FileId != r.pos.Fid {
+			if db.activeFile != nil {
+				if r.pos.Fid < db.activeFile.FileId {
+					return ErrorReplicationProtocol
+				}
+				if err := db.syncActiveFile(); err != nil {
+					return err
+				}
+				db.olderFiles[db.activeFile.FileId] = db.activeFile
+			}
+			dataFile, err := data.OpenFile(db.config.DirPath, r.pos.Fid, fio.StandardIO)
+			if err != nil {
+				return err
+			}
+			db.activeFile = dataFile
+		}
+		if r.pos.Offset != db.activeFile.WriteOffset {
+			return ErrorReplicationProtocol
+		}
+		if err := db.activeFile.Write(r.raw); err != nil {
+			return db.failWrite(err, r.pos.Offset)
+		}
+		db.metrics.write(int64(len(r.raw)))
+
+		realKey, seqNo := parseKeyWithSeqNo(r.record.Key)
+		if seqNo > db.seqNo {
+			db.seqNo = seqNo
+		}
+		if r.skipIndex || r.record.Type == data.COMMIT {
+			continue
+		}
+		pos := r.pos
+		if err := db.applyRecord(realKey, r.record, &pos); err != nil {
+			return err
+		}
+		if r.record.Type == data.PUT && !isNamespaceKey(realKey) {
+			if err := db.addToBloomFilter(realKey); err != nil {
+				return err
+			}
+		}
+	}
+	if db.config.SyncWrites {
+		if err := db.syncActiveFile(); err != nil {
+			return err
+		}
+	}
+	db.notifyChange()
+	return nil
+}
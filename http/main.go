@@ -109,12 +109,28 @@ func HandleStat(writer http.ResponseWriter, request *http.Request) {
 	writer.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(writer).Encode(stat)
 }
+
+// curl "localhost:8088/mykv/backup" -o backup.tar
+func HandleBackup(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(writer, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/x-tar")
+	writer.Header().Set("Content-Disposition", `attachment; filename="backup.tar"`)
+	// the status is sent with the first write, a failed stream is only logged
+	if err := db.BackupTo(writer); err != nil {
+		log.Println("failed to stream backup:", err)
+	}
+}
 func main() {
 	http.HandleFunc("/mykv/get", handleGet)
 	http.HandleFunc("/mykv/put", handlePut)
 	http.HandleFunc("/mykv/delete", handleDelete)
 	http.HandleFunc("/mykv/listkeys", HandleListKeys)
 	http.HandleFunc("/mykv/stat", HandleStat)
+	http.HandleFunc("/mykv/backup", HandleBackup)
+	http.Handle("/metrics", db.MetricsHandler())
 
 	// start http server
 	_ = http.ListenAndServe("localhost:8088", nil)
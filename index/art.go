@@ -9,8 +9,9 @@ import (
 )
 
 type AdaptiveRadixTree struct {
-	tree goart.Tree
-	lock *sync.RWMutex
+	tree     goart.Tree
+	lock     *sync.RWMutex
+	keyBytes int64 // total length of keys
 }
 
 func NewART() *AdaptiveRadixTree {
@@ -23,7 +24,10 @@ func NewART() *AdaptiveRadixTree {
 func (art *AdaptiveRadixTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
 	art.lock.Lock()
 	defer art.lock.Unlock()
-	oldValue, _ := art.tree.Insert(key, pos)
+	oldValue, updated := art.tree.Insert(key, pos)
+	if !updated {
+		art.keyBytes += int64(len(key))
+	}
 	if oldValue == nil {
 		return nil
 	}
@@ -44,6 +48,9 @@ func (art *AdaptiveRadixTree) Delete(key []byte) (*data.LogRecordPos, bool) {
 	art.lock.Lock()
 	defer art.lock.Unlock()
 	value, deleted := art.tree.Delete(key)
+	if deleted {
+		art.keyBytes -= int64(len(key))
+	}
 	if value == nil {
 		return nil, false
 	}
@@ -51,9 +58,12 @@ func (art *AdaptiveRadixTree) Delete(key []byte) (*data.LogRecordPos, bool) {
 }
 
 func (art *AdaptiveRadixTree) Iterator(reverse bool) IndexrIterator {
+	return art.RangeIterator(reverse, nil, nil)
+}
+func (art *AdaptiveRadixTree) RangeIterator(reverse bool, lower []byte, upper []byte) IndexrIterator {
 	art.lock.RLock()
 	defer art.lock.RUnlock()
-	return newARTIterator(art.tree, reverse)
+	return newARTIterator(art.tree, reverse, lower, upper)
 }
 
 func (art *AdaptiveRadixTree) Size() int {
@@ -61,6 +71,11 @@ func (art *AdaptiveRadixTree) Size() int {
 	defer art.lock.RUnlock()
 	return art.tree.Size()
 }
+func (art *AdaptiveRadixTree) MemorySize() int64 {
+	art.lock.RLock()
+	defer art.lock.RUnlock()
+	return art.keyBytes + int64(art.tree.Size())*itemMemorySize
+}
 func (art *AdaptiveRadixTree) Close() error {
 	return nil
 }
@@ -84,28 +99,41 @@ func (art *AdaptiveRadixTree) ArtIterator(reverse bool) IndexrIterator {
 	}
 	art.lock.RLock()
 	defer art.lock.RUnlock()
-	return newARTIterator(art.tree, reverse)
+	return newARTIterator(art.tree, reverse, nil, nil)
 }
-func newARTIterator(tree goart.Tree, reverse bool) *ARTIterator {
-	var idx int
-	values := make([]*Item, tree.Size())
-	if reverse {
-		idx = tree.Size() - 1
+func newARTIterator(tree goart.Tree, reverse bool, lower []byte, upper []byte) *ARTIterator {
+	var values []*Item
+	if lower == nil && upper == nil {
+		values = make([]*Item, 0, tree.Size())
 	}
+	// leaves are visited in order, stop once they pass upper
 	saveValues := func(node goart.Node) bool {
-		item := &Item{
-			key: node.Key(),
-			pos: node.Value().(*data.LogRecordPos),
+		if node.Kind() != goart.Leaf {
+			return true
 		}
-		values[idx] = item
-		if reverse {
-			idx--
-		} else {
-			idx++
+		key := node.Key()
+		if upper != nil && bytes.Compare(key, upper) >= 0 {
+			return false
+		}
+		if lower == nil || bytes.Compare(key, lower) >= 0 {
+			values = append(values, &Item{
+				key: key,
+				pos: node.Value().(*data.LogRecordPos),
+			})
 		}
 		return true
 	}
-	tree.ForEach(saveValues)
+	// keys in the range share the prefix of both bounds, only walk that subtree
+	if prefix := commonPrefix(lower, upper); len(prefix) > 0 {
+		tree.ForEachPrefix(prefix, saveValues)
+	} else {
+		tree.ForEach(saveValues)
+	}
+	if reverse {
+		for i, j := 0, len(values)-1; i < j; i, j = i+1, j-1 {
+			values[i], values[j] = values[j], values[i]
+		}
+	}
 	return &ARTIterator{
 		currentIndex: 0,
 		reverse:      reverse,
@@ -113,6 +141,18 @@ func newARTIterator(tree goart.Tree, reverse bool) *ARTIterator {
 	}
 }
 
+// the longest prefix of a and b, nil if either is nil
+func commonPrefix(a []byte, b []byte) []byte {
+	if a == nil || b == nil {
+		return nil
+	}
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return a[:n]
+}
+
 func (artIter *ARTIterator) Rewind() {
 	artIter.currentIndex = 0
 }
@@ -130,6 +170,33 @@ func (artIter *ARTIterator) Seek(key []byte) {
 	}
 }
 
+func (artIter *ARTIterator) SeekForPrev(key []byte) {
+	// the first key that passes the target, the one before it is what we want
+	var idx int
+	if artIter.reverse {
+		idx = sort.Search(len(artIter.values), func(i int) bool {
+			return bytes.Compare(artIter.values[i].key, key) < 0
+		})
+	} else {
+		idx = sort.Search(len(artIter.values), func(i int) bool {
+			return bytes.Compare(artIter.values[i].key, key) > 0
+		})
+	}
+	artIter.currentIndex = idx - 1
+	if artIter.currentIndex < 0 {
+		// nothing before the key, make the iterator invalid
+		artIter.currentIndex = len(artIter.values)
+	}
+}
+func (artIter *ARTIterator) SeekBefore(key []byte) {
+	// the one before the first key that reaches the target
+	artIter.Seek(key)
+	artIter.currentIndex--
+	if artIter.currentIndex < 0 {
+		artIter.currentIndex = len(artIter.values)
+	}
+}
+
 func (artIter *ARTIterator) Next() {
 	artIter.currentIndex++
 }
@@ -76,3 +76,39 @@ func TestAdaptiveRadixTree_Iterator(t *testing.T) {
 		assert.NotNil(t, iter.Value())
 	}
 }
+
+// only keys in [lower, upper) are collected
+func TestAdaptiveRadixTree_RangeIterator(t *testing.T) {
+	art := NewART()
+	for _, key := range []string{"a", "ab", "abc", "b", "ba", "c"} {
+		art.Put([]byte(key), &data.LogRecordPos{Fid: 1, Offset: 1})
+	}
+	cases := []struct {
+		lower, upper []byte
+		keys         []string
+	}{
+		{nil, nil, []string{"a", "ab", "abc", "b", "ba", "c"}},
+		{[]byte("ab"), nil, []string{"ab", "abc", "b", "ba", "c"}},
+		{nil, []byte("b"), []string{"a", "ab", "abc"}},
+		{[]byte("ab"), []byte("ac"), []string{"ab", "abc"}},
+		{[]byte("aa"), []byte("ba"), []string{"ab", "abc", "b"}},
+		{[]byte("d"), nil, nil},
+	}
+	for _, c := range cases {
+		for _, reverse := range []bool{false, true} {
+			var keys []string
+			iter := art.RangeIterator(reverse, c.lower, c.upper)
+			for iter.Rewind(); iter.Valid(); iter.Next() {
+				keys = append(keys, string(iter.Key()))
+			}
+			iter.Close()
+			expected := append([]string(nil), c.keys...)
+			if reverse {
+				for i, j := 0, len(expected)-1; i < j; i, j = i+1, j-1 {
+					expected[i], expected[j] = expected[j], expected[i]
+				}
+			}
+			assert.Equal(t, expected, keys)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package index
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+const minBloomCapacity = 1 << 14
+
+var ErrorBloomFilterCorrupted = errors.New("bloom filter data is corrupted")
+
+// BloomFilter tells whether a key is definitely not in the index,
+// so that we can skip the index lookup (e.g. a bbolt read transaction).
+// Keys can't be removed from it, deleted keys only become false positives
+// until the filter is rebuilt.
+type BloomFilter struct {
+	lock     *sync.RWMutex
+	bits     []uint64
+	m        uint64 // number of bits
+	k        uint64 // number of hash functions
+	capacity uint64 // number of keys the filter is sized for
+	count    uint64 // number of keys added
+
+	lookups        uint64 // keys checked
+	negatives      uint64 // keys filtered out without touching the index
+	falsePositives uint64 // keys passed the filter but not found in the index
+}
+
+// BloomStat hit statistics of the bloom filter
+type BloomStat struct {
+	Lookups        uint64
+	Negatives      uint64
+	FalsePositives uint64
+}
+
+// NewBloomFilter init a bloom filter for capacity keys with the false positive rate
+func NewBloomFilter(capacity uint64, fpRate float64) *BloomFilter {
+	if capacity < minBloomCapacity {
+		capacity = minBloomCapacity
+	}
+	// m = -n*ln(p)/ln(2)^2, k = m/n*ln(2)
+	m := uint64(math.Ceil(-float64(capacity) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Round(float64(m) / float64(capacity) * math.Ln2))
+	if k == 0 {
+		k = 1
+	}
+	return &BloomFilter{
+		lock:     new(sync.RWMutex),
+		bits:     make([]uint64, (m+63)/64),
+		m:        m,
+		k:        k,
+		capacity: capacity,
+	}
+}
+
+// Add the key into the filter
+func (bf *BloomFilter) Add(key []byte) {
+	h1, h2 := bloomHash(key)
+	bf.lock.Lock()
+	defer bf.lock.Unlock()
+	for i := uint64(0); i < bf.k; i++ {
+		bit := (h1 + i*h2) % bf.m
+		bf.bits[bit/64] |= 1 << (bit % 64)
+	}
+	bf.count++
+}
+
+// MayContain return false if the key is definitely not added
+func (bf *BloomFilter) MayContain(key []byte) bool {
+	atomic.AddUint64(&bf.lookups, 1)
+	h1, h2 := bloomHash(key)
+	bf.lock.RLock()
+	defer bf.lock.RUnlock()
+	for i := uint64(0); i < bf.k; i++ {
+		bit := (h1 + i*h2) % bf.m
+		if bf.bits[bit/64]&(1<<(bit%64)) == 0 {
+			atomic.AddUint64(&bf.negatives, 1)
+			return false
+		}
+	}
+	return true
+}
+
+// RecordFalsePositive is called when MayContain said yes but the key is not found
+func (bf *BloomFilter) RecordFalsePositive() {
+	atomic.AddUint64(&bf.falsePositives, 1)
+}
+
+// Full return true if more keys than capacity are added, the false positive rate
+// will grow beyond the configured one, so the filter should be rebuilt
+func (bf *BloomFilter) Full() bool {
+	bf.lock.RLock()
+	defer bf.lock.RUnlock()
+	return bf.count >= bf.capacity
+}
+func (bf *BloomFilter) Capacity() uint64 {
+	return bf.capacity
+}
+
+// InheritStat take over the statistics of the old filter after rebuilding
+func (bf *BloomFilter) InheritStat(old *BloomFilter) {
+	stat := old.Stat()
+	atomic.AddUint64(&bf.lookups, stat.Lookups)
+	atomic.AddUint64(&bf.negatives, stat.Negatives)
+	atomic.AddUint64(&bf.falsePositives, stat.FalsePositives)
+}
+func (bf *BloomFilter) Stat() BloomStat {
+	return BloomStat{
+		Lookups:        atomic.LoadUint64(&bf.lookups),
+		Negatives:      atomic.LoadUint64(&bf.negatives),
+		FalsePositives: atomic.LoadUint64(&bf.falsePositives),
+	}
+}
+
+// Encode the filter
+// m k capacity count || bits
+func (bf *BloomFilter) Encode() []byte {
+	bf.lock.RLock()
+	defer bf.lock.RUnlock()
+	buf := make([]byte, binary.MaxVarintLen64*4+len(bf.bits)*8)
+	var index = 0
+	index += binary.PutUvarint(buf[index:], bf.m)
+	index += binary.PutUvarint(buf[index:], bf.k)
+	index += binary.PutUvarint(buf[index:], bf.capacity)
+	index += binary.PutUvarint(buf[index:], bf.count)
+	for _, word := range bf.bits {
+		binary.LittleEndian.PutUint64(buf[index:], word)
+		index += 8
+	}
+	return buf[:index]
+}
+
+// DecodeBloomFilter decode the filter encoded by Encode
+func DecodeBloomFilter(buf []byte) (*BloomFilter, error) {
+	var header [4]uint64
+	var index = 0
+	for i := range header {
+		v, n := binary.Uvarint(buf[index:])
+		if n <= 0 {
+			return nil, ErrorBloomFilterCorrupted
+		}
+		header[i] = v
+		index += n
+	}
+	m, k := header[0], header[1]
+	words := (m + 63) / 64
+	if m == 0 || k == 0 || uint64(len(buf)-index) != words*8 {
+		return nil, ErrorBloomFilterCorrupted
+	}
+	bits := make([]uint64, words)
+	for i := range bits {
+		bits[i] = binary.LittleEndian.Uint64(buf[index:])
+		index += 8
+	}
+	return &BloomFilter{
+		lock:     new(sync.RWMutex),
+		bits:     bits,
+		m:        m,
+		k:        k,
+		capacity: header[2],
+		count:    header[3],
+	}, nil
+}
+
+// double hashing, get k hashes from two halves of a 64-bit hash
+func bloomHash(key []byte) (uint64, uint64) {
+	h := fnv.New64a()
+	_, _ = h.Write(key)
+	sum := h.Sum64()
+	h1, h2 := sum>>32, sum&0xffffffff
+	// h2 must not be 0, otherwise all k bits are the same
+	return h1, h2 | 1
+}
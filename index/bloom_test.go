@@ -0,0 +1,51 @@
+package index
+
+import (
+	"KVstore/utils"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBloomFilter_MayContain(t *testing.T) {
+	bf := NewBloomFilter(10000, 0.01)
+	for i := 0; i < 10000; i++ {
+		bf.Add(utils.GetTestKey(i))
+	}
+	// no false negatives
+	for i := 0; i < 10000; i++ {
+		assert.True(t, bf.MayContain(utils.GetTestKey(i)))
+	}
+	// false positives are around the rate
+	var falsePositives int
+	for i := 10000; i < 20000; i++ {
+		if bf.MayContain(utils.GetTestKey(i)) {
+			falsePositives++
+		}
+	}
+	assert.Less(t, falsePositives, 300)
+
+	stat := bf.Stat()
+	assert.Equal(t, uint64(20000), stat.Lookups)
+	assert.Equal(t, uint64(10000-falsePositives), stat.Negatives)
+	// sized for at least minBloomCapacity keys
+	assert.False(t, bf.Full())
+	for i := 10000; i < minBloomCapacity; i++ {
+		bf.Add(utils.GetTestKey(i))
+	}
+	assert.True(t, bf.Full())
+}
+
+func TestBloomFilter_Encode(t *testing.T) {
+	bf := NewBloomFilter(100, 0.01)
+	bf.Add([]byte("aaa"))
+	bf.Add([]byte("bbb"))
+
+	bf2, err := DecodeBloomFilter(bf.Encode())
+	assert.Nil(t, err)
+	assert.True(t, bf2.MayContain([]byte("aaa")))
+	assert.True(t, bf2.MayContain([]byte("bbb")))
+	assert.Equal(t, bf.Capacity(), bf2.Capacity())
+
+	_, err = DecodeBloomFilter([]byte{1, 2, 3})
+	assert.Equal(t, ErrorBloomFilterCorrupted, err)
+}
@@ -2,35 +2,67 @@ package index
 
 import (
 	"KVstore/data"
+	"bytes"
+	"encoding/binary"
 	"go.etcd.io/bbolt"
+	"io"
 	"path/filepath"
 )
 
 const (
-	bptreeIndexFileName = "bptree_index"
+	BPTreeIndexFileName = "bptree_index"
 )
 
-var indexBucketName = []byte("bitcask-index")
+var (
+	indexBucketName = []byte("bitcask-index")
+	metaBucketName  = []byte("bitcask-meta")
+	// the nonMergeFileId of the last merge applied to the index
+	mergeFileIdKey = []byte("merge-file-id")
+)
 
 type BPlusTree struct {
 	tree *bbolt.DB
 }
 
 func NewBPlusTree(path string, syncWrites bool) *BPlusTree {
+	bpt, err := OpenBPlusTree(path, syncWrites)
+	if err != nil {
+		panic("failed to open B+ tree")
+	}
+	return bpt
+}
+
+// OpenBPlusTree open the B+ tree index file in path, return error instead of panic
+func OpenBPlusTree(path string, syncWrites bool) (*BPlusTree, error) {
 	config := bbolt.DefaultOptions
 	config.NoSync = !syncWrites
-	bptree, err := bbolt.Open(filepath.Join(path+bptreeIndexFileName), 0644, config)
+	bptree, err := bbolt.Open(filepath.Join(path, BPTreeIndexFileName), 0644, config)
 	if err != nil {
-		panic("failed to open B+ tree")
+		return nil, err
 	}
 	if err := bptree.Update(func(tx *bbolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(indexBucketName)
+		if _, err := tx.CreateBucketIfNotExists(indexBucketName); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(metaBucketName)
 		return err
 	}); err != nil {
-		panic("failed to create bucket in B+ Tree")
+		_ = bptree.Close()
+		return nil, err
 	}
 
-	return &BPlusTree{tree: bptree}
+	return &BPlusTree{tree: bptree}, nil
+}
+
+// OpenBPlusTreeReadOnly open an existing B+ tree index file in path without writing it
+func OpenBPlusTreeReadOnly(path string) (*BPlusTree, error) {
+	config := *bbolt.DefaultOptions
+	config.ReadOnly = true
+	bptree, err := bbolt.Open(filepath.Join(path, BPTreeIndexFileName), 0644, &config)
+	if err != nil {
+		return nil, err
+	}
+	return &BPlusTree{tree: bptree}, nil
 }
 
 func (bpt *BPlusTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
@@ -84,6 +116,11 @@ func (bpt *BPlusTree) Iterator(reverse bool) IndexrIterator {
 	return newBpTreeIterator(bpt.tree, reverse)
 }
 
+// RangeIterator the cursor reads keys on demand, seeking to the bounds is left to the caller
+func (bpt *BPlusTree) RangeIterator(reverse bool, lower []byte, upper []byte) IndexrIterator {
+	return newBpTreeIterator(bpt.tree, reverse)
+}
+
 func (bpt *BPlusTree) Size() int {
 	var size int
 	if err := bpt.tree.View(func(tx *bbolt.Tx) error {
@@ -95,10 +132,91 @@ func (bpt *BPlusTree) Size() int {
 	}
 	return size
 }
+
+// MemorySize B+ tree index is on disk
+func (bpt *BPlusTree) MemorySize() int64 {
+	return 0
+}
 func (bpt *BPlusTree) Close() error {
 	return bpt.tree.Close()
 }
 
+// MergedFileId get the nonMergeFileId of the last merge applied by ApplyMerge
+func (bpt *BPlusTree) MergedFileId() (uint32, error) {
+	var fileId uint32
+	err := bpt.tree.View(func(tx *bbolt.Tx) error {
+		value := tx.Bucket(metaBucketName).Get(mergeFileIdKey)
+		if len(value) != 0 {
+			id, _ := binary.Uvarint(value)
+			fileId = uint32(id)
+		}
+		return nil
+	})
+	return fileId, err
+}
+
+// ApplyMerge point the index to the merged files in one transaction.
+// Keys in files before nonMergeFileId are moved to the positions in hints,
+// or removed if they are not in the merged files.
+// Keys written after the merge started are kept.
+func (bpt *BPlusTree) ApplyMerge(nonMergeFileId uint32, hints map[string]*data.LogRecordPos) error {
+	return bpt.tree.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(indexBucketName)
+		// cursor may be invalidated by changing data, collect the changes first
+		var puts, deletes [][]byte
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			if data.DecodeLogRecordPos(v).Fid >= nonMergeFileId {
+				continue
+			}
+			key := append([]byte(nil), k...)
+			if _, ok := hints[string(k)]; ok {
+				puts = append(puts, key)
+			} else {
+				deletes = append(deletes, key)
+			}
+		}
+		for _, key := range puts {
+			if err := bucket.Put(key, data.EncodeLogRecordPos(hints[string(key)])); err != nil {
+				return err
+			}
+		}
+		for _, key := range deletes {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		buf := make([]byte, binary.MaxVarintLen32)
+		n := binary.PutUvarint(buf, uint64(nonMergeFileId))
+		return tx.Bucket(metaBucketName).Put(mergeFileIdKey, buf[:n])
+	})
+}
+
+// BPlusTreeSnapshot a consistent copy of the index file at the time it is taken,
+// it holds a read transaction until Close
+type BPlusTreeSnapshot struct {
+	tx *bbolt.Tx
+}
+
+func (bpt *BPlusTree) Snapshot() (*BPlusTreeSnapshot, error) {
+	tx, err := bpt.tree.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	return &BPlusTreeSnapshot{tx: tx}, nil
+}
+
+// Size of the index file written by WriteTo
+func (s *BPlusTreeSnapshot) Size() int64 {
+	return s.tx.Size()
+}
+func (s *BPlusTreeSnapshot) WriteTo(w io.Writer) (int64, error) {
+	return s.tx.WriteTo(w)
+}
+func (s *BPlusTreeSnapshot) Close() error {
+	return s.tx.Rollback()
+}
+
 /*
 Iterator methods
 */
@@ -116,22 +234,60 @@ func newBpTreeIterator(tree *bbolt.DB, reverse bool) *bptreeIterator {
 	if err != nil {
 		panic("failed to begin a transaction")
 	}
-	return &bptreeIterator{
+	bpi := &bptreeIterator{
 		tx:      tx,
-		cursor:  tx.Cursor(),
+		cursor:  tx.Bucket(indexBucketName).Cursor(),
 		reverse: reverse,
 	}
+	bpi.Rewind()
+	return bpi
 }
 
 func (bpi *bptreeIterator) Rewind() {
 	if bpi.reverse {
 		bpi.curKey, bpi.curValue = bpi.cursor.Last()
+	} else {
+		bpi.curKey, bpi.curValue = bpi.cursor.First()
 	}
-	bpi.curKey, bpi.curValue = bpi.cursor.First()
 }
 
 func (bpi *bptreeIterator) Seek(key []byte) {
+	if bpi.reverse {
+		bpi.seekLessOrEqual(key)
+	} else {
+		bpi.curKey, bpi.curValue = bpi.cursor.Seek(key)
+	}
+}
+
+func (bpi *bptreeIterator) SeekForPrev(key []byte) {
+	if bpi.reverse {
+		bpi.curKey, bpi.curValue = bpi.cursor.Seek(key)
+	} else {
+		bpi.seekLessOrEqual(key)
+	}
+}
+
+func (bpi *bptreeIterator) SeekBefore(key []byte) {
 	bpi.curKey, bpi.curValue = bpi.cursor.Seek(key)
+	if bpi.reverse {
+		if bytes.Equal(bpi.curKey, key) {
+			bpi.curKey, bpi.curValue = bpi.cursor.Next()
+		}
+	} else if bpi.curKey == nil {
+		bpi.curKey, bpi.curValue = bpi.cursor.Last()
+	} else {
+		bpi.curKey, bpi.curValue = bpi.cursor.Prev()
+	}
+}
+
+// bbolt cursor only seeks to the first key >= key, step back if it passed the key
+func (bpi *bptreeIterator) seekLessOrEqual(key []byte) {
+	bpi.curKey, bpi.curValue = bpi.cursor.Seek(key)
+	if bpi.curKey == nil {
+		bpi.curKey, bpi.curValue = bpi.cursor.Last()
+	} else if !bytes.Equal(bpi.curKey, key) {
+		bpi.curKey, bpi.curValue = bpi.cursor.Prev()
+	}
 }
 
 func (bpi *bptreeIterator) Next() {
@@ -143,7 +299,7 @@ func (bpi *bptreeIterator) Next() {
 }
 
 func (bpi *bptreeIterator) Valid() bool {
-	return len(bpi.curKey) == 0
+	return len(bpi.curKey) != 0
 }
 
 func (bpi *bptreeIterator) Key() []byte {
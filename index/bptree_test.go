@@ -102,8 +102,29 @@ func TestBPlusTree_Iterator(t *testing.T) {
 	tree.Put([]byte("bbba"), &data.LogRecordPos{Fid: 123, Offset: 999})
 
 	iter := tree.Iterator(true)
+	var keys []string
 	for iter.Rewind(); iter.Valid(); iter.Next() {
 		assert.NotNil(t, iter.Key())
 		assert.NotNil(t, iter.Value())
+		keys = append(keys, string(iter.Key()))
 	}
+	assert.Equal(t, []string{"ccec", "caac", "bbca", "bbba", "acce"}, keys)
+
+	// seek in reverse order
+	iter.Seek([]byte("bbc"))
+	assert.Equal(t, []byte("bbba"), iter.Key())
+	iter.SeekForPrev([]byte("bbc"))
+	assert.Equal(t, []byte("bbca"), iter.Key())
+	iter.SeekBefore([]byte("bbca"))
+	assert.Equal(t, []byte("caac"), iter.Key())
+	iter.Close()
+
+	forward := tree.Iterator(false)
+	forward.SeekBefore([]byte("bbca"))
+	assert.Equal(t, []byte("bbba"), forward.Key())
+	forward.SeekBefore([]byte("z"))
+	assert.Equal(t, []byte("ccec"), forward.Key())
+	forward.SeekBefore([]byte("acce"))
+	assert.False(t, forward.Valid())
+	forward.Close()
 }
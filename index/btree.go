@@ -16,8 +16,9 @@ type BTree struct {
 		goroutines, but Read operations are.
 		so we need to use our own lock to protect it.
 	*/
-	tree *btree.BTree
-	lock *sync.RWMutex
+	tree     *btree.BTree
+	lock     *sync.RWMutex
+	keyBytes int64 // total length of keys
 }
 
 // NewBTree init and return a new BTree
@@ -34,6 +35,7 @@ func (bt *BTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
 	defer bt.lock.Unlock()
 	oldItem := bt.tree.ReplaceOrInsert(&it)
 	if oldItem == nil {
+		bt.keyBytes += int64(len(key))
 		return nil
 	}
 	return oldItem.(*Item).pos
@@ -41,6 +43,8 @@ func (bt *BTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
 
 func (bt *BTree) Get(key []byte) *data.LogRecordPos {
 	it := Item{key: key}
+	bt.lock.RLock()
+	defer bt.lock.RUnlock()
 	lookUpvalue := bt.tree.Get(&it)
 	if lookUpvalue == nil {
 		return nil
@@ -56,11 +60,17 @@ func (bt *BTree) Delete(key []byte) (*data.LogRecordPos, bool) {
 	if oldItem == nil {
 		return nil, false
 	}
+	bt.keyBytes -= int64(len(key))
 	return oldItem.(*Item).pos, true
 }
 func (bt *BTree) Size() int {
 	return bt.tree.Len()
 }
+func (bt *BTree) MemorySize() int64 {
+	bt.lock.RLock()
+	defer bt.lock.RUnlock()
+	return bt.keyBytes + int64(bt.tree.Len())*itemMemorySize
+}
 func (bt *BTree) Close() error {
 	return nil
 }
@@ -75,26 +85,41 @@ type BTreeIterator struct {
 }
 
 func (bt BTree) Iterator(reverse bool) IndexrIterator {
+	return bt.RangeIterator(reverse, nil, nil)
+}
+func (bt BTree) RangeIterator(reverse bool, lower []byte, upper []byte) IndexrIterator {
 	if bt.tree == nil {
 		return nil
 	}
 	bt.lock.RLock()
 	defer bt.lock.RUnlock()
-	return newBTreeIterator(bt.tree, reverse)
+	return newBTreeIterator(bt.tree, reverse, lower, upper)
 }
-func newBTreeIterator(tree *btree.BTree, reverse bool) *BTreeIterator {
-	var idx int
-	values := make([]*Item, tree.Len())
+func newBTreeIterator(tree *btree.BTree, reverse bool, lower []byte, upper []byte) *BTreeIterator {
+	var values []*Item
+	if lower == nil && upper == nil {
+		values = make([]*Item, 0, tree.Len())
+	}
 
-	//put all logs into memory(values)
+	//put logs in the range into memory(values), the walk starts from the bound
+	//and stops once it leaves the range
 	saveValues := func(it btree.Item) bool {
-		values[idx] = it.(*Item)
-		idx++
+		item := it.(*Item)
+		if !inRange(item.key, lower, upper) {
+			// only upper itself is passed before the range when descending
+			return reverse && bytes.Equal(item.key, upper)
+		}
+		values = append(values, item)
 		return true
 	}
-	if reverse {
+	switch {
+	case reverse && upper != nil:
+		tree.DescendLessOrEqual(&Item{key: upper}, saveValues)
+	case reverse:
 		tree.Descend(saveValues)
-	} else {
+	case lower != nil:
+		tree.AscendGreaterOrEqual(&Item{key: lower}, saveValues)
+	default:
 		tree.Ascend(saveValues)
 	}
 	return &BTreeIterator{
@@ -121,6 +146,34 @@ func (it *BTreeIterator) Seek(key []byte) {
 	}
 }
 
+func (it *BTreeIterator) SeekForPrev(key []byte) {
+	// the first key that passes the target, the one before it is what we want
+	var idx int
+	if it.reverse {
+		idx = sort.Search(len(it.values), func(i int) bool {
+			return bytes.Compare(it.values[i].key, key) < 0
+		})
+	} else {
+		idx = sort.Search(len(it.values), func(i int) bool {
+			return bytes.Compare(it.values[i].key, key) > 0
+		})
+	}
+	it.currentIndex = idx - 1
+	if it.currentIndex < 0 {
+		// nothing before the key, make the iterator invalid
+		it.currentIndex = len(it.values)
+	}
+}
+
+func (it *BTreeIterator) SeekBefore(key []byte) {
+	// the one before the first key that reaches the target
+	it.Seek(key)
+	it.currentIndex--
+	if it.currentIndex < 0 {
+		it.currentIndex = len(it.values)
+	}
+}
+
 func (it *BTreeIterator) Next() {
 	it.currentIndex++
 }
@@ -100,3 +100,68 @@ func TestBTree_Iterator(t *testing.T) {
 		assert.NotNil(t, iter6.Key())
 	}
 }
+
+func TestBTree_IteratorSeekForPrev(t *testing.T) {
+	bt := index.NewBTree()
+	bt.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 1})
+	bt.Put([]byte("c"), &data.LogRecordPos{Fid: 1, Offset: 2})
+	bt.Put([]byte("e"), &data.LogRecordPos{Fid: 1, Offset: 3})
+
+	iter1 := bt.Iterator(false)
+	iter1.SeekForPrev([]byte("d"))
+	assert.Equal(t, []byte("c"), iter1.Key())
+	iter1.SeekForPrev([]byte("0"))
+	assert.Equal(t, false, iter1.Valid())
+
+	iter2 := bt.Iterator(true)
+	iter2.SeekForPrev([]byte("d"))
+	assert.Equal(t, []byte("e"), iter2.Key())
+	iter2.SeekForPrev([]byte("f"))
+	assert.Equal(t, false, iter2.Valid())
+
+	// the key itself is skipped by SeekBefore
+	iter1.SeekBefore([]byte("c"))
+	assert.Equal(t, []byte("a"), iter1.Key())
+	iter1.SeekBefore([]byte("a"))
+	assert.Equal(t, false, iter1.Valid())
+	iter2.SeekBefore([]byte("c"))
+	assert.Equal(t, []byte("e"), iter2.Key())
+	iter2.SeekBefore([]byte("e"))
+	assert.Equal(t, false, iter2.Valid())
+}
+
+// only keys in [lower, upper) are collected
+func TestBTree_RangeIterator(t *testing.T) {
+	bt := index.NewBTree()
+	for _, key := range []string{"a", "ab", "abc", "b", "ba", "c"} {
+		bt.Put([]byte(key), &data.LogRecordPos{Fid: 1, Offset: 1})
+	}
+	cases := []struct {
+		lower, upper []byte
+		keys         []string
+	}{
+		{nil, nil, []string{"a", "ab", "abc", "b", "ba", "c"}},
+		{[]byte("ab"), nil, []string{"ab", "abc", "b", "ba", "c"}},
+		{nil, []byte("b"), []string{"a", "ab", "abc"}},
+		{[]byte("ab"), []byte("ac"), []string{"ab", "abc"}},
+		{[]byte("aa"), []byte("ba"), []string{"ab", "abc", "b"}},
+		{[]byte("d"), nil, nil},
+	}
+	for _, c := range cases {
+		for _, reverse := range []bool{false, true} {
+			var keys []string
+			iter := bt.RangeIterator(reverse, c.lower, c.upper)
+			for iter.Rewind(); iter.Valid(); iter.Next() {
+				keys = append(keys, string(iter.Key()))
+			}
+			iter.Close()
+			expected := append([]string(nil), c.keys...)
+			if reverse {
+				for i, j := 0, len(expected)-1; i < j; i, j = i+1, j-1 {
+					expected[i], expected[j] = expected[j], expected[i]
+				}
+			}
+			assert.Equal(t, expected, keys)
+		}
+	}
+}
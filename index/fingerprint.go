@@ -0,0 +1,191 @@
+package index
+
+import (
+	"KVstore/data"
+	"bytes"
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// map key + LogRecordPos + map overhead, key length doesn't matter
+const fingerprintEntrySize = 48
+
+// KeyReader read the key of the record at pos from data files
+type KeyReader func(pos *data.LogRecordPos) ([]byte, error)
+
+// FingerprintIndex only keeps a 64-bit fingerprint of the key and the position in memory,
+// the full key stays in data files and is read back to verify on lookup.
+// Memory per key is fixed, no matter how long the key is,
+// but updates and lookups need an extra read, and iterating needs to read all keys.
+type FingerprintIndex struct {
+	lock    *sync.RWMutex
+	entries map[uint64]data.LogRecordPos
+	// keys whose fingerprint is the same as the one in entries, rare
+	collisions map[uint64][]data.LogRecordPos
+	readKey    KeyReader
+	size       int
+}
+
+func NewFingerprintIndex(readKey KeyReader) *FingerprintIndex {
+	return &FingerprintIndex{
+		lock:       new(sync.RWMutex),
+		entries:    make(map[uint64]data.LogRecordPos),
+		collisions: make(map[uint64][]data.LogRecordPos),
+		readKey:    readKey,
+	}
+}
+
+func (fi *FingerprintIndex) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+	fp := fingerprint(key)
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	oldPos, ok := fi.entries[fp]
+	if !ok {
+		fi.entries[fp] = *pos
+		fi.size++
+		return nil
+	}
+	if fi.keyMatches(&oldPos, key) {
+		fi.entries[fp] = *pos
+		return &oldPos
+	}
+	others := fi.collisions[fp]
+	for i := range others {
+		if fi.keyMatches(&others[i], key) {
+			oldPos = others[i]
+			others[i] = *pos
+			return &oldPos
+		}
+	}
+	fi.collisions[fp] = append(others, *pos)
+	fi.size++
+	return nil
+}
+
+func (fi *FingerprintIndex) Get(key []byte) *data.LogRecordPos {
+	fp := fingerprint(key)
+	fi.lock.RLock()
+	defer fi.lock.RUnlock()
+	pos, ok := fi.entries[fp]
+	if !ok {
+		return nil
+	}
+	if fi.keyMatches(&pos, key) {
+		return &pos
+	}
+	for _, other := range fi.collisions[fp] {
+		if fi.keyMatches(&other, key) {
+			return &other
+		}
+	}
+	return nil
+}
+
+func (fi *FingerprintIndex) Delete(key []byte) (*data.LogRecordPos, bool) {
+	fp := fingerprint(key)
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	pos, ok := fi.entries[fp]
+	if !ok {
+		return nil, false
+	}
+	others := fi.collisions[fp]
+	if fi.keyMatches(&pos, key) {
+		// move one of the collisions to entries
+		if len(others) > 0 {
+			fi.entries[fp] = others[len(others)-1]
+			fi.setCollisions(fp, others[:len(others)-1])
+		} else {
+			delete(fi.entries, fp)
+		}
+		fi.size--
+		return &pos, true
+	}
+	for i := range others {
+		if fi.keyMatches(&others[i], key) {
+			pos = others[i]
+			others[i] = others[len(others)-1]
+			fi.setCollisions(fp, others[:len(others)-1])
+			fi.size--
+			return &pos, true
+		}
+	}
+	return nil, false
+}
+
+// Iterator read all keys from data files and sort them
+func (fi *FingerprintIndex) Iterator(reverse bool) IndexrIterator {
+	return fi.RangeIterator(reverse, nil, nil)
+}
+
+// RangeIterator keys have to be read from data files to be compared,
+// only the keys in the range are kept and sorted
+func (fi *FingerprintIndex) RangeIterator(reverse bool, lower []byte, upper []byte) IndexrIterator {
+	fi.lock.RLock()
+	var values []*Item
+	if lower == nil && upper == nil {
+		values = make([]*Item, 0, fi.size)
+	}
+	addItem := func(pos data.LogRecordPos) {
+		key, err := fi.readKey(&pos)
+		if err != nil || !inRange(key, lower, upper) {
+			return
+		}
+		values = append(values, &Item{key: key, pos: &pos})
+	}
+	for fp, pos := range fi.entries {
+		addItem(pos)
+		for _, other := range fi.collisions[fp] {
+			addItem(other)
+		}
+	}
+	fi.lock.RUnlock()
+	sort.Slice(values, func(i, j int) bool {
+		if reverse {
+			return bytes.Compare(values[i].key, values[j].key) > 0
+		}
+		return bytes.Compare(values[i].key, values[j].key) < 0
+	})
+	return &BTreeIterator{
+		reverse: reverse,
+		values:  values,
+	}
+}
+
+func (fi *FingerprintIndex) Size() int {
+	fi.lock.RLock()
+	defer fi.lock.RUnlock()
+	return fi.size
+}
+
+func (fi *FingerprintIndex) MemorySize() int64 {
+	fi.lock.RLock()
+	defer fi.lock.RUnlock()
+	return int64(fi.size) * fingerprintEntrySize
+}
+
+func (fi *FingerprintIndex) Close() error {
+	return nil
+}
+
+// need a lock before reaching this func
+func (fi *FingerprintIndex) setCollisions(fp uint64, others []data.LogRecordPos) {
+	if len(others) == 0 {
+		delete(fi.collisions, fp)
+	} else {
+		fi.collisions[fp] = others
+	}
+}
+
+// read the key at pos and compare, a record that can't be read never matches
+func (fi *FingerprintIndex) keyMatches(pos *data.LogRecordPos, key []byte) bool {
+	storedKey, err := fi.readKey(pos)
+	return err == nil && bytes.Equal(storedKey, key)
+}
+
+func fingerprint(key []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(key)
+	return h.Sum64()
+}
@@ -0,0 +1,80 @@
+package index
+
+import (
+	"KVstore/data"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// keys stored by offset, as if they were in data files
+func newTestFingerprintIndex(keys map[int64][]byte) *FingerprintIndex {
+	return NewFingerprintIndex(func(pos *data.LogRecordPos) ([]byte, error) {
+		return keys[pos.Offset], nil
+	})
+}
+
+func TestFingerprintIndex_Put_Get_Delete(t *testing.T) {
+	keys := map[int64][]byte{1: []byte("aaa"), 2: []byte("bbb"), 3: []byte("aaa")}
+	fi := newTestFingerprintIndex(keys)
+
+	res1 := fi.Put([]byte("aaa"), &data.LogRecordPos{Fid: 1, Offset: 1})
+	assert.Nil(t, res1)
+	res2 := fi.Put([]byte("bbb"), &data.LogRecordPos{Fid: 1, Offset: 2})
+	assert.Nil(t, res2)
+	res3 := fi.Put([]byte("aaa"), &data.LogRecordPos{Fid: 1, Offset: 3})
+	assert.Equal(t, int64(1), res3.Offset)
+	assert.Equal(t, 2, fi.Size())
+
+	pos := fi.Get([]byte("aaa"))
+	assert.Equal(t, int64(3), pos.Offset)
+	assert.Nil(t, fi.Get([]byte("ccc")))
+
+	oldPos, ok := fi.Delete([]byte("aaa"))
+	assert.True(t, ok)
+	assert.Equal(t, int64(3), oldPos.Offset)
+	_, ok = fi.Delete([]byte("aaa"))
+	assert.False(t, ok)
+	assert.Equal(t, 1, fi.Size())
+	assert.Equal(t, int64(fingerprintEntrySize), fi.MemorySize())
+}
+
+func TestFingerprintIndex_Collision(t *testing.T) {
+	keys := map[int64][]byte{1: []byte("aaa"), 2: []byte("bbb")}
+	fi := newTestFingerprintIndex(keys)
+	// force both keys to the same fingerprint
+	fp := fingerprint([]byte("aaa"))
+	fi.entries[fp] = data.LogRecordPos{Offset: 2}
+	fi.size = 1
+	assert.Nil(t, fi.Get([]byte("aaa")))
+
+	res := fi.Put([]byte("aaa"), &data.LogRecordPos{Offset: 1})
+	assert.Nil(t, res)
+	assert.Equal(t, 2, fi.Size())
+	assert.Equal(t, int64(1), fi.Get([]byte("aaa")).Offset)
+
+	_, ok := fi.Delete([]byte("aaa"))
+	assert.True(t, ok)
+	assert.Nil(t, fi.Get([]byte("aaa")))
+	assert.Equal(t, 0, len(fi.collisions))
+}
+
+func TestFingerprintIndex_Iterator(t *testing.T) {
+	keys := map[int64][]byte{1: []byte("ccc"), 2: []byte("aaa"), 3: []byte("bbb")}
+	fi := newTestFingerprintIndex(keys)
+	for offset, key := range keys {
+		fi.Put(key, &data.LogRecordPos{Offset: offset})
+	}
+
+	var res []string
+	iter := fi.Iterator(false)
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		res = append(res, string(iter.Key()))
+	}
+	assert.Equal(t, []string{"aaa", "bbb", "ccc"}, res)
+
+	iter2 := fi.Iterator(true)
+	iter2.Seek([]byte("bbb"))
+	assert.Equal(t, []byte("bbb"), iter2.Key())
+	iter2.Next()
+	assert.Equal(t, []byte("aaa"), iter2.Key())
+}
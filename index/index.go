@@ -3,7 +3,9 @@ package index
 import (
 	"KVstore/data"
 	"bytes"
+	"errors"
 	"github.com/google/btree"
+	"unsafe"
 )
 
 type Indexer interface {
@@ -15,7 +17,11 @@ type Indexer interface {
 	Delete(key []byte) (*data.LogRecordPos, bool)
 
 	Iterator(reverse bool) IndexrIterator
+	// RangeIterator iterate keys in [lower, upper), nil means unbounded
+	RangeIterator(reverse bool, lower []byte, upper []byte) IndexrIterator
 	Size() int
+	// MemorySize estimated memory used by the index in bytes
+	MemorySize() int64
 	Close() error
 }
 
@@ -25,6 +31,12 @@ type IndexrIterator interface {
 	// Seek Find the first target key that is greater (or less) than or equal
 	// to the incoming key, then iterate from this key
 	Seek(key []byte)
+	// SeekForPrev Find the last target key that is less (or greater) than or equal
+	// to the incoming key, then iterate from this key
+	SeekForPrev(key []byte)
+	// SeekBefore Find the last target key that is strictly less (or greater)
+	// than the incoming key, then iterate from this key
+	SeekBefore(key []byte)
 
 	Next()                     // the next key
 	Valid() bool               // if the key and the position is valid, for exit the iteration
@@ -39,20 +51,34 @@ const (
 	Btree IndexType = iota + 1
 	ART
 	BPTree
+	// only fingerprints of keys in memory, full keys are read from data files
+	Fingerprint
 )
 
-// init Indexer by IndexType
-func NewIndexr(typ IndexType, path string, sync bool) Indexer {
+// estimated memory of one key in BTree and ART besides the key itself:
+// the Item, the LogRecordPos it points to and the slot in the tree node
+var itemMemorySize = int64(unsafe.Sizeof(Item{})+unsafe.Sizeof(data.LogRecordPos{})) + 16
+
+var ErrorUnsupportedIndexType = errors.New("unsupported index type")
+
+// init Indexer by IndexType, readKey is only used by Fingerprint index
+func NewIndexr(typ IndexType, path string, sync bool, readKey KeyReader) (Indexer, error) {
 	switch typ {
 	case Btree:
-		return NewBTree()
+		return NewBTree(), nil
 	case ART:
-		return NewART()
+		return NewART(), nil
 	case BPTree:
-		return NewBPlusTree(path, sync)
+		bpt, err := OpenBPlusTree(path, sync)
+		if err != nil {
+			return nil, err
+		}
+		return bpt, nil
+	case Fingerprint:
+		return NewFingerprintIndex(readKey), nil
 
 	default:
-		panic("unsupported idnex type")
+		return nil, ErrorUnsupportedIndexType
 	}
 }
 
@@ -65,3 +91,9 @@ type Item struct {
 func (a *Item) Less(b btree.Item) bool {
 	return bytes.Compare(a.key, b.(*Item).key) == -1
 }
+
+// whether key is in [lower, upper), nil means unbounded
+func inRange(key []byte, lower []byte, upper []byte) bool {
+	return (lower == nil || bytes.Compare(key, lower) >= 0) &&
+		(upper == nil || bytes.Compare(key, upper) < 0)
+}
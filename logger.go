@@ -0,0 +1,54 @@
+package KVstore
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Logger receives the log of the db, keyvals are pairs of key and value.
+// It must be safe for concurrent use.
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// nopLogger is used when Configs.Logger is nil
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+// NewStdLogger log to l as `LEVEL msg key=value ...`
+func NewStdLogger(l *log.Logger) Logger {
+	return &stdLogger{logger: l}
+}
+
+type stdLogger struct {
+	logger *log.Logger
+}
+
+func (l *stdLogger) Debug(msg string, keyvals ...interface{}) { l.output("DEBUG", msg, keyvals) }
+func (l *stdLogger) Info(msg string, keyvals ...interface{})  { l.output("INFO", msg, keyvals) }
+func (l *stdLogger) Warn(msg string, keyvals ...interface{})  { l.output("WARN", msg, keyvals) }
+func (l *stdLogger) Error(msg string, keyvals ...interface{}) { l.output("ERROR", msg, keyvals) }
+
+func (l *stdLogger) output(level string, msg string, keyvals []interface{}) {
+	var b strings.Builder
+	b.WriteString(level)
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		if i+1 < len(keyvals) {
+			_, _ = fmt.Fprintf(&b, " %v=%v", keyvals[i], keyvals[i+1])
+		} else {
+			_, _ = fmt.Fprintf(&b, " %v", keyvals[i])
+		}
+	}
+	// skip output and the level method
+	_ = l.logger.Output(3, b.String())
+}
@@ -2,26 +2,46 @@ package KVstore
 
 import (
 	"KVstore/data"
+	"KVstore/fio"
+	"KVstore/index"
 	"KVstore/utils"
+	"context"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
+	"time"
 )
 
 const (
-	mergeDirName     = "_merge"
-	mergeFinishedKey = "merge_FIN"
+	mergeDirName       = "_merge"
+	mergeFinishedKey   = "merge_FIN"
+	mergeGenerationKey = "merge_GEN"
 )
 
 func (db *DB) Merge() error {
+	return db.MergeContext(context.Background())
+}
+
+// MergeContext ctx is checked before each record, a canceled merge leaves an
+// unfinished merge dir which is ignored and removed later
+func (db *DB) MergeContext(ctx context.Context) (err error) {
+	if db.config.ReadOnly {
+		return ErrorReadOnly
+	}
 	if db.activeFile == nil {
 		return nil
 	}
-	db.mutex.Lock()
+	if err := db.lockContext(ctx); err != nil {
+		return err
+	}
 
+	if db.bgError != nil {
+		db.mutex.Unlock()
+		return ErrorDegraded
+	}
 	// check if the db is merging
 	if db.isMerging {
 		db.mutex.Unlock()
@@ -54,17 +74,17 @@ func (db *DB) Merge() error {
 		db.isMerging = false
 	}()
 
-	if err := db.activeFile.Sync(); err != nil {
+	if err := db.syncActiveFile(); err != nil {
 		db.mutex.Unlock()
 		return err
 	}
-	// transfer active file to old file
-	db.olderFiles[db.activeFile.FileId] = db.activeFile
-	// create a new file
+	// create a new file, transfer active file to old file once it is there
+	oldFile := db.activeFile
 	if err := db.setActivateFile(); err != nil {
 		db.mutex.Unlock()
 		return err
 	}
+	db.olderFiles[oldFile.FileId] = oldFile
 	//get fileId that not be merged
 	nonMergeFileId := db.activeFile.FileId
 	// get old files
@@ -72,8 +92,43 @@ func (db *DB) Merge() error {
 	for _, file := range db.olderFiles {
 		mergeFiles = append(mergeFiles, file)
 	}
+	// operand chains in the old files are folded after reading them
+	operands := db.operandsSnapshot()
+	reclaimSize := db.reclaimSize
+	// the dir of the last finished merge is replaced
+	db.mergeDirSize, db.mergedReclaimSize = 0, 0
 	db.mutex.Unlock()
 
+	var filesSize int64
+	for _, file := range mergeFiles {
+		if size, err := file.IOManager.Size(); err == nil {
+			filesSize += size
+		}
+	}
+	info := MergeInfo{NonMergeFileId: nonMergeFileId}
+	db.config.Logger.Info("merge begin", "non_merge_file", nonMergeFileId, "files", len(mergeFiles))
+	db.config.EventListener.OnMergeBegin(info)
+	start := time.Now()
+	defer func() {
+		info.Duration, info.Err = time.Since(start), err
+		if err != nil {
+			db.metrics.mergeFailed()
+			db.config.Logger.Error("merge failed", "err", err, "duration", info.Duration)
+		} else {
+			var reclaimed int64
+			mergedSize, sizeErr := utils.DirSize(db.getMergePath())
+			if sizeErr == nil && mergedSize < filesSize {
+				reclaimed = filesSize - mergedSize
+			}
+			db.metrics.merged(info.Duration, reclaimed)
+			db.mutex.Lock()
+			db.mergeDirSize, db.mergedReclaimSize = mergedSize, reclaimSize
+			db.mutex.Unlock()
+			db.config.Logger.Info("merge end", "non_merge_file", nonMergeFileId, "duration", info.Duration)
+		}
+		db.config.EventListener.OnMergeEnd(info)
+	}()
+
 	// from small to big
 	sort.Slice(mergeFiles, func(i, j int) bool {
 		return mergeFiles[i].FileId < mergeFiles[j].FileId
@@ -89,24 +144,31 @@ func (db *DB) Merge() error {
 	if err := os.MkdirAll(mergePath, os.ModePerm); err != nil {
 		return err
 	}
-	// get new db instance
+	// get new db instance, its index is never used,
+	// so don't open another B+ tree index file
 	mergeDB, err := Open(Configs{
-		DirPath:      mergePath,
-		IndexerType:  db.config.IndexerType,
-		SyncWrites:   false,
-		DataFileSize: db.config.DataFileSize,
+		DirPath:            mergePath,
+		IndexerType:        index.Btree,
+		SyncWrites:         false,
+		DataFileSize:       db.config.DataFileSize,
+		DataFileMergeRatio: db.config.DataFileMergeRatio,
 	})
 	if err != nil {
 		return err
 	}
+	defer mergeDB.Close()
 	// open hint file
 	hintFile, err := data.OpenHintFile(mergePath)
 	if err != nil {
 		return err
 	}
+	defer hintFile.Close()
 	for _, dataFile := range mergeFiles {
 		var offset int64 = 0
 		for {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 			logRecord, size, err := dataFile.Read(offset)
 			if err != nil {
 				if err == io.EOF {
@@ -116,19 +178,36 @@ func (db *DB) Merge() error {
 			}
 			// get real key
 			realKey, _ := parseKeyWithSeqNo(logRecord.Key)
-			logRecordPos := db.index.Get(realKey)
-			//compare logRecordPos from index and logRecordPos from dataFile
+			if _, ok := operands[string(realKey)]; ok || logRecord.Type == data.MERGE_OPERAND {
+				offset += size
+				continue
+			}
+			var logRecordPos *data.LogRecordPos
+			// records of dropped namespaces and expired values are dropped,
+			// Fingerprint index reads the data files so it is looked up under the db mutex
+			db.mutex.RLock()
+			if idx, idxKey, ns := db.indexOf(realKey); idx != nil &&
+				(ns == nil || !ns.expired(logRecord.Value)) {
+				logRecordPos = idx.Get(idxKey)
+			}
+			db.mutex.RUnlock()
+			//compare logRecordPos from index and logRecordPos from dataFile,
+			// keys with operands written during merge keep their base value
 			if logRecordPos != nil &&
 				logRecordPos.Fid == dataFile.FileId &&
-				logRecordPos.Offset == offset {
+				logRecordPos.Offset == offset ||
+				db.isOperandBase(realKey, &data.LogRecordPos{Fid: dataFile.FileId, Offset: offset}) {
 				// don't need SeqNo again
 				logRecord.Key = logRecordKeyWithSeqNo(realKey, NonTxnSeqNo)
+				if err := db.limiter.wait(ctx, size); err != nil {
+					return err
+				}
 				pos, err := mergeDB.appendLogRecord(logRecord)
 				if err != nil {
 					return err
 				}
 				//write logRecordPos to HintFile
-				if err := hintFile.WriteHintRecord(realKey, pos); err != nil {
+				if err := db.writeHintRecord(ctx, hintFile, realKey, pos); err != nil {
 					return err
 				}
 
@@ -136,6 +215,9 @@ func (db *DB) Merge() error {
 			offset += size
 		}
 	}
+	if err := db.mergeOperands(ctx, mergeDB, hintFile, operands, nonMergeFileId); err != nil {
+		return err
+	}
 	err = hintFile.Sync()
 	if err != nil {
 		return err
@@ -148,6 +230,7 @@ func (db *DB) Merge() error {
 	if err != nil {
 		return err
 	}
+	defer mergeFinFile.Close()
 	mergeFinRecord := data.LogRecord{
 		Key:   []byte(mergeFinishedKey),
 		Value: []byte(strconv.Itoa(int(nonMergeFileId))),
@@ -156,12 +239,87 @@ func (db *DB) Merge() error {
 	if err := mergeFinFile.Write(encRecord); err != nil {
 		return err
 	}
+	// versions of keys are changed when the merged files are installed
+	mergeGenRecord := data.LogRecord{
+		Key:   []byte(mergeGenerationKey),
+		Value: []byte(strconv.FormatUint(uint64(db.mergeGeneration+1), 10)),
+	}
+	encRecord, _ = data.EncodeLogRecord(&mergeGenRecord)
+	if err := mergeFinFile.Write(encRecord); err != nil {
+		return err
+	}
 	err = mergeFinFile.Sync()
 	if err != nil {
 		return err
 	}
+	// drop deleted keys from the bloom filter
+	if db.bloom != nil {
+		db.mutex.Lock()
+		defer db.mutex.Unlock()
+		return db.rebuildBloomFilter()
+	}
+	return nil
+}
+
+// mergeOperands fold the operands of each chain in the merged files onto its base,
+// operands written after them are folded onto the result when the key is read
+func (db *DB) mergeOperands(ctx context.Context, mergeDB *DB, hintFile *data.File,
+	operands map[string]*operandChain, nonMergeFileId uint32) error {
+	for key, chain := range operands {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// the base is before the operands, the whole chain is in the new files
+		if chain.base != nil && chain.base.Fid >= nonMergeFileId {
+			continue
+		}
+		var merged []*data.LogRecordPos
+		for _, pos := range chain.operands {
+			if pos.Fid < nonMergeFileId {
+				merged = append(merged, pos)
+			}
+		}
+		if chain.base == nil && len(merged) == 0 {
+			continue
+		}
+		db.mutex.RLock()
+		var value []byte
+		var err error
+		if len(merged) == 0 {
+			value, err = db.getValueByPosition(chain.base)
+		} else {
+			value, err = db.foldOperands([]byte(key), chain.base, merged)
+		}
+		db.mutex.RUnlock()
+		if err != nil {
+			return err
+		}
+		if err := db.limiter.wait(ctx, int64(len(key)+len(value))); err != nil {
+			return err
+		}
+		pos, err := mergeDB.appendLogRecord(&data.LogRecord{
+			Key:   logRecordKeyWithSeqNo([]byte(key), NonTxnSeqNo),
+			Value: value,
+			Type:  data.PUT,
+		})
+		if err != nil {
+			return err
+		}
+		if err := db.writeHintRecord(ctx, hintFile, []byte(key), pos); err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// write the hint record of key, throttled by the rate limit
+func (db *DB) writeHintRecord(ctx context.Context, hintFile *data.File, key []byte, pos *data.LogRecordPos) error {
+	if err := db.limiter.wait(ctx, int64(len(key)+len(data.EncodeLogRecordPos(pos)))); err != nil {
+		return err
+	}
+	return hintFile.WriteHintRecord(key, pos)
+}
+
 func (db *DB) getMergePath() string {
 	dir := path.Dir(path.Clean(db.config.DirPath))
 	base := path.Base(db.config.DirPath)
@@ -197,10 +355,20 @@ func (db *DB) loadMergeFiles() error {
 	}
 
 	//get non Merged file ID
-	nonMergeFileId, err := db.getNonMergeFileID(mergePath)
+	nonMergeFileId, err := getNonMergeFileID(mergePath)
 	if err != nil {
 		return err
 	}
+	// B+ tree index is persistent, point it to the merged files before installing them
+	if bpt, ok := db.index.(*index.BPlusTree); ok {
+		if err := db.applyMergeToBPTree(bpt, mergePath, nonMergeFileId); err != nil {
+			return err
+		}
+	}
+	// index snapshot points to the old data files
+	if err := db.removeIndexSnapshot(); err != nil {
+		return err
+	}
 	// delete old data files
 	var fileId uint32 = 0
 	for ; fileId < nonMergeFileId; fileId++ {
@@ -213,7 +381,8 @@ func (db *DB) loadMergeFiles() error {
 	}
 	// move new data file to dir
 	for _, fileName := range mergeFileNames {
-		if fileName == fileLockName {
+		// SeqNo of merge db is meaningless, don't overwrite ours
+		if fileName == fileLockName || fileName == data.SeqNoFileName {
 			continue
 		}
 		srcPath := filepath.Join(mergePath, fileName)
@@ -225,11 +394,13 @@ func (db *DB) loadMergeFiles() error {
 	return nil
 }
 
-func (db *DB) getNonMergeFileID(mergePath string) (uint32, error) {
-	mergeFinFile, err := data.OpenMergeFinishedFile(mergePath)
+func getNonMergeFileID(mergePath string) (uint32, error) {
+	fileName := filepath.Join(mergePath, data.MergeFinishedFileName)
+	mergeFinFile, err := data.NewReadOnlyDataFile(fileName, 0, fio.StandardIO)
 	if err != nil {
 		return 0, err
 	}
+	defer mergeFinFile.Close()
 	record, _, err := mergeFinFile.Read(0)
 	if err != nil {
 		return 0, err
@@ -241,16 +412,48 @@ func (db *DB) getNonMergeFileID(mergePath string) (uint32, error) {
 	return uint32(nonMergeFileId), nil
 
 }
+
+// the number of merges installed in dir, 0 if no merge finished file or it is written
+// before the generation is recorded
+func getMergeGeneration(dir string) (uint32, error) {
+	fileName := filepath.Join(dir, data.MergeFinishedFileName)
+	if _, err := os.Stat(fileName); os.IsNotExist(err) {
+		return 0, nil
+	}
+	mergeFinFile, err := data.NewReadOnlyDataFile(fileName, 0, fio.StandardIO)
+	if err != nil {
+		return 0, err
+	}
+	defer mergeFinFile.Close()
+	_, size, err := mergeFinFile.Read(0)
+	if err != nil {
+		return 0, err
+	}
+	record, _, err := mergeFinFile.Read(size)
+	if err == io.EOF {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	generation, err := strconv.ParseUint(string(record.Value), 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(generation), nil
+}
+
 func (db *DB) loadIndexFromHint() error {
 	fileName := filepath.Join(db.config.DirPath, data.HintFileName)
 	if _, err := os.Stat(fileName); os.IsNotExist(err) {
 		return nil
 	}
 	// open hint file
-	hintFile, err := data.OpenHintFile(fileName)
+	hintFile, err := data.NewReadOnlyDataFile(fileName, 0, fio.StandardIO)
 	if err != nil {
 		return err
 	}
+	defer hintFile.Close()
 
 	// load index according to hintFile
 	var offset int64 = 0
@@ -263,9 +466,43 @@ func (db *DB) loadIndexFromHint() error {
 			return err
 		}
 		pos := data.DecodeLogRecordPos(logRecord.Value)
-		db.index.Put(logRecord.Key, pos)
+		if err := db.updateIndex(logRecord.Key, data.PUT, pos); err != nil {
+			return err
+		}
 		offset += size
 	}
 	return nil
 
 }
+
+// applyMergeToBPTree update B+ tree index with the hint file of merge,
+// it is done in one transaction, and skipped if the merge is already applied
+// (e.g. crashed when moving the merged files)
+func (db *DB) applyMergeToBPTree(bpt *index.BPlusTree, mergePath string, nonMergeFileId uint32) error {
+	appliedFileId, err := bpt.MergedFileId()
+	if err != nil {
+		return err
+	}
+	if appliedFileId >= nonMergeFileId {
+		return nil
+	}
+	hintFile, err := data.OpenHintFile(mergePath)
+	if err != nil {
+		return err
+	}
+	defer hintFile.Close()
+	hints := make(map[string]*data.LogRecordPos)
+	var offset int64 = 0
+	for {
+		logRecord, size, err := hintFile.Read(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		hints[string(logRecord.Key)] = data.DecodeLogRecordPos(logRecord.Value)
+		offset += size
+	}
+	return bpt.ApplyMerge(nonMergeFileId, hints)
+}
@@ -0,0 +1,293 @@
+package KVstore
+
+import (
+	"KVstore/data"
+	"KVstore/index"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"strconv"
+)
+
+// MergeOperator folds operands written by MergeValue onto the value of a key
+type MergeOperator interface {
+	// Merge fold operands in the order they are written onto existing,
+	// existing is nil if the key has no value. Operands may be folded in
+	// several steps (e.g. by merge), so folding must be associative.
+	Merge(key []byte, existing []byte, operands [][]byte) ([]byte, error)
+}
+
+// Int64AddOperator values and operands are decimal int64, operands are added to the value
+type Int64AddOperator struct{}
+
+func (Int64AddOperator) Merge(key []byte, existing []byte, operands [][]byte) ([]byte, error) {
+	sum, err := parseInt64Operand(existing)
+	if err != nil {
+		return nil, err
+	}
+	for _, operand := range operands {
+		n, err := parseInt64Operand(operand)
+		if err != nil {
+			return nil, err
+		}
+		sum += n
+	}
+	return []byte(strconv.FormatInt(sum, 10)), nil
+}
+
+// StringAppendOperator operands are appended to the value, joined by Separator
+type StringAppendOperator struct {
+	Separator []byte
+}
+
+func (op StringAppendOperator) Merge(key []byte, existing []byte, operands [][]byte) ([]byte, error) {
+	parts := operands
+	if existing != nil {
+		parts = append([][]byte{existing}, operands...)
+	}
+	return bytes.Join(parts, op.Separator), nil
+}
+
+// Int64MaxOperator values and operands are decimal int64, the value is the max of them
+type Int64MaxOperator struct{}
+
+func (Int64MaxOperator) Merge(key []byte, existing []byte, operands [][]byte) ([]byte, error) {
+	values := operands
+	if existing != nil {
+		values = append([][]byte{existing}, operands...)
+	}
+	var max int64
+	for i, value := range values {
+		n, err := parseInt64Operand(value)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 || n > max {
+			max = n
+		}
+	}
+	return []byte(strconv.FormatInt(max, 10)), nil
+}
+
+// nil is 0, the value of a missing key
+func parseInt64Operand(buf []byte) (int64, error) {
+	if buf == nil {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(string(buf), 10, 64)
+	if err != nil {
+		return 0, ErrorInvalidOperand
+	}
+	return n, nil
+}
+
+// operandChain the records of a key written since its last Put,
+// the index points to the last operand
+type operandChain struct {
+	base     *data.LogRecordPos // nil if the key had no value
+	operands []*data.LogRecordPos
+}
+
+// MergeValue append an operand to key without reading it, it is folded onto
+// the value by Configs.MergeOperator when the key is read
+func (db *DB) MergeValue(key []byte, operand []byte) error {
+	if len(key) == 0 {
+		return ErrorKeyEmpty
+	}
+	if isNamespaceKey(key) {
+		return ErrorKeyReserved
+	}
+	// B+ tree index is not loaded from data files, operands would be lost
+	if db.config.IndexerType == index.BPTree {
+		return ErrorMergeOperatorUnsupported
+	}
+	logRecord := data.LogRecord{
+		Key:   logRecordKeyWithSeqNo(key, NonTxnSeqNo),
+		Value: operand,
+		Type:  data.MERGE_OPERAND,
+	}
+	if err := db.waitWrite(context.Background(), int64(len(key)+len(operand))); err != nil {
+		return err
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	pos, err := db.appendLogRecord(&logRecord)
+	if err != nil {
+		return err
+	}
+	db.applyOperand(key, pos)
+	if err := db.addToBloomFilter(key); err != nil {
+		return err
+	}
+	db.foldLongChain(key)
+	return nil
+}
+
+// write the folded value of a chain reaching MaxOperandChain as a Put, which
+// makes the chain reclaimable. The operand is already written, if folding
+// fails the chain is kept and the error comes back from reads or writes
+// need a mutex before reaching this func
+func (db *DB) foldLongChain(key []byte) {
+	chain := db.operands[string(key)]
+	if db.config.MaxOperandChain <= 0 || len(chain.operands) < db.config.MaxOperandChain {
+		return
+	}
+	value, err := db.foldOperands(key, chain.base, chain.operands)
+	if err != nil {
+		return
+	}
+	_ = db.put(key, value)
+}
+
+// need a mutex before reaching this func
+func (db *DB) applyOperand(key []byte, pos *data.LogRecordPos) {
+	oldPos := db.index.Put(key, pos)
+	chain, ok := db.operands[string(key)]
+	if !ok {
+		chain = &operandChain{base: oldPos}
+		db.operands[string(key)] = chain
+	}
+	chain.operands = append(chain.operands, pos)
+}
+
+// dropOperands is called when the key is overwritten, the whole chain is reclaimable,
+// return false if the key has no operands
+// need a mutex before reaching this func
+func (db *DB) dropOperands(key []byte) bool {
+	chain, ok := db.operands[string(key)]
+	if !ok {
+		return false
+	}
+	delete(db.operands, string(key))
+	if chain.base != nil {
+		db.reclaimSize += int64(chain.base.Size)
+	}
+	for _, pos := range chain.operands {
+		db.reclaimSize += int64(pos.Size)
+	}
+	return true
+}
+
+// getValue get the value of key at pos, operands of the key are folded
+// need a mutex before reaching this func
+func (db *DB) getValue(key []byte, pos *data.LogRecordPos) ([]byte, error) {
+	chain, ok := db.operands[string(key)]
+	if !ok {
+		return db.getValueByPosition(pos)
+	}
+	return db.foldOperands(key, chain.base, chain.operands)
+}
+
+func (db *DB) foldOperands(key []byte, base *data.LogRecordPos, positions []*data.LogRecordPos) ([]byte, error) {
+	if db.config.MergeOperator == nil {
+		return nil, ErrorNoMergeOperator
+	}
+	var existing []byte
+	if base != nil {
+		value, err := db.getValueByPosition(base)
+		if err != nil {
+			return nil, err
+		}
+		existing = value
+	}
+	operands := make([][]byte, len(positions))
+	for i, pos := range positions {
+		operand, err := db.getValueByPosition(pos)
+		if err != nil {
+			return nil, err
+		}
+		operands[i] = operand
+	}
+	return db.config.MergeOperator.Merge(key, existing, operands)
+}
+
+// whether the record is the base of an operand chain, merge must keep it
+// even though the index points to an operand
+func (db *DB) isOperandBase(key []byte, pos *data.LogRecordPos) bool {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	chain, ok := db.operands[string(key)]
+	return ok && chain.base != nil &&
+		chain.base.Fid == pos.Fid && chain.base.Offset == pos.Offset
+}
+
+// copy of operand chains at the start of merge
+// need a mutex before reaching this func
+func (db *DB) operandsSnapshot() map[string]*operandChain {
+	chains := make(map[string]*operandChain, len(db.operands))
+	for key, chain := range db.operands {
+		chains[key] = &operandChain{
+			base:     chain.base,
+			operands: append([]*data.LogRecordPos(nil), chain.operands...),
+		}
+	}
+	return chains
+}
+
+// uvarint(has base) [base] uvarint(count) operands..., a position is
+// uvarint(fid) varint(offset) uvarint(size)
+func encodeOperandChain(chain *operandChain) []byte {
+	buf := make([]byte, 0, (len(chain.operands)+1)*(binary.MaxVarintLen32*2+binary.MaxVarintLen64)+2)
+	putPos := func(pos *data.LogRecordPos) {
+		buf = binary.AppendUvarint(buf, uint64(pos.Fid))
+		buf = binary.AppendVarint(buf, pos.Offset)
+		buf = binary.AppendUvarint(buf, uint64(pos.Size))
+	}
+	if chain.base != nil {
+		buf = binary.AppendUvarint(buf, 1)
+		putPos(chain.base)
+	} else {
+		buf = binary.AppendUvarint(buf, 0)
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(chain.operands)))
+	for _, pos := range chain.operands {
+		putPos(pos)
+	}
+	return buf
+}
+func decodeOperandChain(buf []byte) (*operandChain, bool) {
+	var index int
+	next := func() (uint64, bool) {
+		v, n := binary.Uvarint(buf[index:])
+		if n <= 0 {
+			return 0, false
+		}
+		index += n
+		return v, true
+	}
+	getPos := func() (*data.LogRecordPos, bool) {
+		fid, ok := next()
+		if !ok {
+			return nil, false
+		}
+		offset, n := binary.Varint(buf[index:])
+		if n <= 0 {
+			return nil, false
+		}
+		index += n
+		size, ok := next()
+		return &data.LogRecordPos{Fid: uint32(fid), Offset: offset, Size: uint32(size)}, ok
+	}
+	chain := &operandChain{}
+	hasBase, ok := next()
+	if !ok {
+		return nil, false
+	}
+	if hasBase == 1 {
+		if chain.base, ok = getPos(); !ok {
+			return nil, false
+		}
+	}
+	count, ok := next()
+	if !ok {
+		return nil, false
+	}
+	for i := uint64(0); i < count; i++ {
+		pos, ok := getPos()
+		if !ok {
+			return nil, false
+		}
+		chain.operands = append(chain.operands, pos)
+	}
+	return chain, true
+}
@@ -0,0 +1,158 @@
+package KVstore
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestDB_MergeValue(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-value")
+	opts.DirPath = dir
+	opts.DataFileMergeRatio = 0.01
+	opts.MergeOperator = Int64AddOperator{}
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.MergeValue([]byte("counter"), []byte("1")))
+	}
+	assert.Nil(t, db.Put([]byte("base"), []byte("100")))
+	assert.Nil(t, db.MergeValue([]byte("base"), []byte("-1")))
+	val, err := db.Get([]byte("counter"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("10"), val)
+	val, err = db.Get([]byte("base"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("99"), val)
+	assert.Equal(t, 2, len(db.ListKeys()))
+
+	// a Put overwrites the operands
+	assert.Nil(t, db.MergeValue([]byte("reset"), []byte("5")))
+	assert.Nil(t, db.Put([]byte("reset"), []byte("0")))
+	val, err = db.Get([]byte("reset"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("0"), val)
+
+	// operands are kept in the index snapshot
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	val, err = db.Get([]byte("counter"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("10"), val)
+
+	// merge collapses the chains, later operands are folded onto them
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.MergeValue([]byte("counter"), []byte("5")))
+	assert.Nil(t, db.Close())
+	opts.IndexSnapshot = false
+	db, err = Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	val, err = db.Get([]byte("counter"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("15"), val)
+	val, err = db.Get([]byte("base"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("99"), val)
+	assert.Equal(t, 1, len(db.operands))
+}
+
+func TestDB_MergeValueWithoutOperator(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-value-none")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.MergeValue([]byte("key"), []byte("1")))
+	_, err = db.Get([]byte("key"))
+	assert.Equal(t, ErrorNoMergeOperator, err)
+}
+
+func TestMergeOperators(t *testing.T) {
+	operands := [][]byte{[]byte("3"), []byte("-7"), []byte("12")}
+	val, err := Int64AddOperator{}.Merge(nil, []byte("1"), operands)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("9"), val)
+	_, err = Int64AddOperator{}.Merge(nil, nil, [][]byte{[]byte("x")})
+	assert.Equal(t, ErrorInvalidOperand, err)
+
+	val, err = Int64MaxOperator{}.Merge(nil, nil, operands)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("12"), val)
+	val, err = Int64MaxOperator{}.Merge(nil, []byte(strconv.Itoa(20)), operands)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("20"), val)
+
+	appendOp := StringAppendOperator{Separator: []byte(",")}
+	val, err = appendOp.Merge(nil, nil, [][]byte{[]byte("a"), []byte("b")})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("a,b"), val)
+	val, err = appendOp.Merge(nil, []byte("a,b"), [][]byte{[]byte("c")})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("a,b,c"), val)
+}
+
+func TestDB_MergeValueReclaim(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-value-reclaim")
+	opts.DirPath = dir
+	opts.MergeOperator = Int64AddOperator{}
+	opts.MaxOperandChain = 10
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	chainSize := func(key string) int64 {
+		chain := db.operands[key]
+		var size int64
+		if chain.base != nil {
+			size += int64(chain.base.Size)
+		}
+		for _, pos := range chain.operands {
+			size += int64(pos.Size)
+		}
+		return size
+	}
+	// the base and operands superseded by a Put or Delete are reclaimable
+	assert.Nil(t, db.Put([]byte("put"), []byte("1")))
+	assert.Nil(t, db.Put([]byte("delete"), []byte("1")))
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, db.MergeValue([]byte("put"), []byte("1")))
+		assert.Nil(t, db.MergeValue([]byte("delete"), []byte("1")))
+	}
+	reclaimable, size := db.reclaimSize, chainSize("put")
+	assert.Nil(t, db.Put([]byte("put"), []byte("0")))
+	assert.Equal(t, reclaimable+size, db.reclaimSize)
+	reclaimable, size = db.reclaimSize, chainSize("delete")
+	assert.Nil(t, db.Delete([]byte("delete")))
+	assert.Greater(t, db.reclaimSize, reclaimable+size)
+	assert.Equal(t, 0, len(db.operands))
+
+	// a chain reaching MaxOperandChain is folded into a Put
+	for i := 1; i <= 25; i++ {
+		assert.Nil(t, db.MergeValue([]byte("counter"), []byte("1")))
+		chain, ok := db.operands["counter"]
+		assert.Equal(t, i%10 != 0, ok)
+		if ok {
+			assert.Equal(t, i%10, len(chain.operands))
+		}
+	}
+	val, err := db.Get([]byte("counter"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("25"), val)
+
+	assert.Nil(t, db.Close())
+	opts.IndexSnapshot = false
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	val, err = db.Get([]byte("counter"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("25"), val)
+	assert.Equal(t, 5, len(db.operands["counter"].operands))
+}
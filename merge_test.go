@@ -0,0 +1,177 @@
+package KVstore
+
+import (
+	"KVstore/data"
+	"KVstore/index"
+	"KVstore/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// put keys three times and delete some of them, so there is enough to reclaim
+func prepareMergeData(t *testing.T, db *DB) map[string][]byte {
+	values := make(map[string][]byte)
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 1000; i++ {
+			val := utils.RandomValue(128)
+			err := db.Put(utils.GetTestKey(i), val)
+			assert.Nil(t, err)
+			values[string(utils.GetTestKey(i))] = val
+		}
+	}
+	for i := 0; i < 100; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		delete(values, string(utils.GetTestKey(i)))
+	}
+	return values
+}
+
+func checkMergeData(t *testing.T, db *DB, values map[string][]byte) {
+	for i := 0; i < 1000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		if expected, ok := values[string(utils.GetTestKey(i))]; ok {
+			assert.Nil(t, err)
+			assert.Equal(t, expected, val)
+		} else {
+			assert.Equal(t, ErrorKeyNotFound, err)
+		}
+	}
+}
+
+func TestDB_Merge(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge")
+	opts.DirPath = dir + "/"
+	opts.DataFileSize = 64 * 1024
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	values := prepareMergeData(t, db)
+	err = db.Merge()
+	assert.Nil(t, err)
+	// write after merge
+	val := utils.RandomValue(128)
+	err = db.Put(utils.GetTestKey(1), val)
+	assert.Nil(t, err)
+	values[string(utils.GetTestKey(1))] = val
+
+	// merged files are installed when restarting
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	checkMergeData(t, db2, values)
+	assert.Equal(t, len(values), len(db2.ListKeys()))
+}
+
+func TestDB_Merge_BPTree(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-bptree")
+	opts.DirPath = dir + "/"
+	opts.IndexerDirPath = dir + "/"
+	opts.IndexerType = index.BPTree
+	opts.DataFileSize = 64 * 1024
+	opts.DataFileMergeRatio = 0.3
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	values := prepareMergeData(t, db)
+	err = db.Merge()
+	assert.Nil(t, err)
+	// write after merge, the B+ tree must keep the new positions
+	wb := db.NewWriteBatch(DefaultWriteBatchConfigs)
+	val := utils.RandomValue(128)
+	err = wb.Put(utils.GetTestKey(1), val)
+	assert.Nil(t, err)
+	err = wb.Delete(utils.GetTestKey(500))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+	values[string(utils.GetTestKey(1))] = val
+	delete(values, string(utils.GetTestKey(500)))
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	checkMergeData(t, db2, values)
+	assert.Equal(t, len(values), db2.index.Size())
+	// old data files are removed
+	assert.Less(t, len(db2.olderFiles), len(db.olderFiles))
+}
+
+func TestDB_Merge_FingerprintConcurrent(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-fingerprint")
+	opts.DirPath = dir + "/"
+	opts.IndexerType = index.Fingerprint
+	opts.DataFileSize = 16 * 1024
+	opts.DataFileMergeRatio = 0.01
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	values := prepareMergeData(t, db)
+	// keys are read back from data files while puts rotate them
+	stop, done := make(chan struct{}), make(chan struct{})
+	written := 0
+	go func() {
+		defer close(done)
+		for ; ; written++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			assert.Nil(t, db.Put(utils.GetTestKey(1000+written), utils.RandomValue(128)))
+		}
+	}()
+	assert.Nil(t, db.Merge())
+	close(stop)
+	<-done
+
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	checkMergeData(t, db2, values)
+	assert.Equal(t, len(values)+written, len(db2.ListKeys()))
+}
+
+func TestDB_BPTree_RecoverSeqNo(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-bptree-seq")
+	opts.DirPath = dir + "/"
+	opts.IndexerDirPath = dir + "/"
+	opts.IndexerType = index.BPTree
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 3; i++ {
+		wb := db.NewWriteBatch(DefaultWriteBatchConfigs)
+		err = wb.Put(utils.GetTestKey(i), utils.RandomValue(10))
+		assert.Nil(t, err)
+		err = wb.Commit()
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+	// lose the SeqNo file as if the db crashed
+	err = os.Remove(filepath.Join(opts.DirPath, data.SeqNoFileName))
+	assert.Nil(t, err)
+
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), db2.seqNo)
+	wb := db2.NewWriteBatch(DefaultWriteBatchConfigs)
+	err = wb.Put(utils.GetTestKey(10), utils.RandomValue(10))
+	assert.Nil(t, err)
+	assert.Nil(t, wb.Commit())
+}
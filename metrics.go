@@ -0,0 +1,219 @@
+package KVstore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+type opType int
+
+const (
+	opPut opType = iota
+	opGet
+	opDelete
+	opCommit
+	opCount
+)
+
+var opNames = [opCount]string{"put", "get", "delete", "commit"}
+
+// upper bounds of histogram buckets in seconds
+var (
+	latencyBuckets = []float64{0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+	mergeBuckets   = []float64{0.01, 0.1, 1, 10, 60, 600, 3600}
+)
+
+// metrics are counted on every call, all fields are changed atomically
+type metrics struct {
+	ops        [opCount]uint64
+	opErrors   [opCount]uint64
+	opLatency  [opCount]*histogram
+	written    uint64 // bytes appended to data files
+	synced     uint64 // bytes made durable by fsync
+	unsynced   uint64 // bytes written since the last fsync
+	fsync      *histogram
+	fsyncFails uint64
+	merges     uint64
+	mergeFails uint64
+	merge      *histogram
+	reclaimed  uint64 // size of merged files minus size of their merge output
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		fsync: newHistogram(latencyBuckets),
+		merge: newHistogram(mergeBuckets),
+	}
+	for i := range m.opLatency {
+		m.opLatency[i] = newHistogram(latencyBuckets)
+	}
+	return m
+}
+
+// observe is deferred with the start time of op, key not found is not an error
+func (m *metrics) observe(op opType, start time.Time, err *error) {
+	atomic.AddUint64(&m.ops[op], 1)
+	if *err != nil && *err != ErrorKeyNotFound {
+		atomic.AddUint64(&m.opErrors[op], 1)
+	}
+	m.opLatency[op].observe(time.Since(start))
+}
+
+func (m *metrics) write(n int64) {
+	atomic.AddUint64(&m.written, uint64(n))
+	atomic.AddUint64(&m.unsynced, uint64(n))
+}
+
+func (m *metrics) merged(d time.Duration, reclaimed int64) {
+	atomic.AddUint64(&m.merges, 1)
+	m.merge.observe(d)
+	atomic.AddUint64(&m.reclaimed, uint64(reclaimed))
+}
+
+func (m *metrics) mergeFailed() {
+	atomic.AddUint64(&m.mergeFails, 1)
+}
+
+// fsync the active file, timed for metrics
+// need a mutex before reaching this func
+func (db *DB) fsync() error {
+	start := time.Now()
+	if err := db.activeFile.Sync(); err != nil {
+		atomic.AddUint64(&db.metrics.fsyncFails, 1)
+		return err
+	}
+	db.metrics.fsync.observe(time.Since(start))
+	atomic.AddUint64(&db.metrics.synced, atomic.SwapUint64(&db.metrics.unsynced, 0))
+	return nil
+}
+
+type histogram struct {
+	bounds []float64
+	counts []uint64 // per bucket, the last one is +Inf
+	count  uint64
+	sum    uint64 // in nanoseconds
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := sort.SearchFloat64s(h.bounds, d.Seconds())
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.sum, uint64(d))
+}
+
+// WriteMetrics write the metrics of the db in Prometheus text exposition format
+func (db *DB) WriteMetrics(w io.Writer) error {
+	stat := db.Stat()
+	db.mutex.RLock()
+	degraded := db.bgError != nil
+	db.mutex.RUnlock()
+	m := db.metrics
+
+	bw := bufio.NewWriter(w)
+	p := &promWriter{w: bw}
+	p.header("kvstore_ops_total", "counter", "Number of operations.")
+	for op, name := range opNames {
+		p.sample("kvstore_ops_total", `op="`+name+`"`, float64(atomic.LoadUint64(&m.ops[op])))
+	}
+	p.header("kvstore_op_errors_total", "counter", "Number of failed operations, key not found is not counted.")
+	for op, name := range opNames {
+		p.sample("kvstore_op_errors_total", `op="`+name+`"`, float64(atomic.LoadUint64(&m.opErrors[op])))
+	}
+	p.header("kvstore_op_duration_seconds", "histogram", "Latency of operations.")
+	for op, name := range opNames {
+		p.histogram("kvstore_op_duration_seconds", `op="`+name+`"`, m.opLatency[op])
+	}
+	p.counter("kvstore_written_bytes_total", "Bytes appended to data files.", atomic.LoadUint64(&m.written))
+	p.counter("kvstore_synced_bytes_total", "Bytes made durable by fsync.", atomic.LoadUint64(&m.synced))
+	p.header("kvstore_fsync_duration_seconds", "histogram", "Latency of fsync of data files.")
+	p.histogram("kvstore_fsync_duration_seconds", "", m.fsync)
+	p.counter("kvstore_fsync_errors_total", "Number of failed fsync of data files.", atomic.LoadUint64(&m.fsyncFails))
+	p.counter("kvstore_merges_total", "Number of merges.", atomic.LoadUint64(&m.merges))
+	p.counter("kvstore_merge_errors_total", "Number of failed merges.", atomic.LoadUint64(&m.mergeFails))
+	p.header("kvstore_merge_duration_seconds", "histogram", "Duration of successful merges.")
+	p.histogram("kvstore_merge_duration_seconds", "", m.merge)
+	p.counter("kvstore_merge_reclaimed_bytes_total", "Bytes reclaimed by merges once the merged files are installed.",
+		atomic.LoadUint64(&m.reclaimed))
+	p.gauge("kvstore_keys", "Number of keys in the default namespace.", float64(stat.KeyNum))
+	p.gauge("kvstore_index_memory_bytes", "Estimated memory used by the index.", float64(stat.IndexMemory))
+	p.gauge("kvstore_data_files", "Number of data files.", float64(stat.DataFileNUm))
+	p.gauge("kvstore_disk_size_bytes", "Size of files in the db dir.", float64(stat.DiskSize))
+	p.gauge("kvstore_reclaimable_bytes", "Bytes reclaimable by merge.", float64(stat.ReclaimableSize))
+	p.gauge("kvstore_write_stall", "Write stall, 0 none, 1 slowdown, 2 stop.", float64(stat.WriteStall))
+	var degradedValue float64
+	if degraded {
+		degradedValue = 1
+	}
+	p.gauge("kvstore_degraded", "1 if the db is read only after a failed write.", degradedValue)
+	if p.err != nil {
+		return p.err
+	}
+	return bw.Flush()
+}
+
+// MetricsHandler serve WriteMetrics, e.g. on /metrics
+func (db *DB) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = db.WriteMetrics(writer)
+	})
+}
+
+// promWriter keeps the first error, the rest of writes are skipped
+type promWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (p *promWriter) printf(format string, args ...interface{}) {
+	if p.err != nil {
+		return
+	}
+	_, p.err = fmt.Fprintf(p.w, format, args...)
+}
+
+func (p *promWriter) header(name string, typ string, help string) {
+	p.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (p *promWriter) sample(name string, labels string, value float64) {
+	if labels != "" {
+		name += "{" + labels + "}"
+	}
+	p.printf("%s %v\n", name, value)
+}
+
+func (p *promWriter) counter(name string, help string, value uint64) {
+	p.header(name, "counter", help)
+	p.sample(name, "", float64(value))
+}
+
+func (p *promWriter) gauge(name string, help string, value float64) {
+	p.header(name, "gauge", help)
+	p.sample(name, "", value)
+}
+
+func (p *promWriter) histogram(name string, labels string, h *histogram) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		p.sample(name+"_bucket", fmt.Sprintf(`%s%sle="%v"`, labels, sep, bound), float64(cumulative))
+	}
+	cumulative += atomic.LoadUint64(&h.counts[len(h.bounds)])
+	p.sample(name+"_bucket", labels+sep+`le="+Inf"`, float64(cumulative))
+	p.sample(name+"_sum", labels, time.Duration(atomic.LoadUint64(&h.sum)).Seconds())
+	p.sample(name+"_count", labels, float64(atomic.LoadUint64(&h.count)))
+}
@@ -0,0 +1,67 @@
+package KVstore
+
+import (
+	"KVstore/utils"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+func metricValue(t *testing.T, text string, name string) float64 {
+	match := regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(name) + ` (\S+)$`).FindStringSubmatch(text)
+	if !assert.NotNil(t, match, name) {
+		return 0
+	}
+	value, err := strconv.ParseFloat(match[1], 64)
+	assert.Nil(t, err)
+	return value
+}
+
+func TestDB_Metrics(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-metrics")
+	opts.DirPath = dir
+	opts.DataFileMergeRatio = 0.01
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// overwritten values are reclaimed by merge
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i%10), utils.RandomValue(128)))
+	}
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	_, err = db.Get([]byte("missing"))
+	assert.Equal(t, ErrorKeyNotFound, err)
+	_, err = db.Get(nil)
+	assert.Equal(t, ErrorInvalidKey, err)
+	assert.Nil(t, db.Delete(utils.GetTestKey(0)))
+	wb := db.NewWriteBatch(DefaultWriteBatchConfigs)
+	assert.Nil(t, wb.Put([]byte("batch"), []byte("value")))
+	assert.Nil(t, wb.Commit())
+	assert.Nil(t, db.Sync())
+	assert.Nil(t, db.Merge())
+
+	recorder := httptest.NewRecorder()
+	db.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(t, recorder.Header().Get("Content-Type"), "text/plain")
+	text := recorder.Body.String()
+	assert.Equal(t, float64(100), metricValue(t, text, `kvstore_ops_total{op="put"}`))
+	assert.Equal(t, float64(3), metricValue(t, text, `kvstore_ops_total{op="get"}`))
+	assert.Equal(t, float64(1), metricValue(t, text, `kvstore_op_errors_total{op="get"}`))
+	assert.Equal(t, float64(1), metricValue(t, text, `kvstore_ops_total{op="commit"}`))
+	assert.Equal(t, float64(1), metricValue(t, text, `kvstore_op_duration_seconds_count{op="delete"}`))
+	assert.Equal(t, float64(100), metricValue(t, text, `kvstore_op_duration_seconds_bucket{op="put",le="+Inf"}`))
+	written := metricValue(t, text, "kvstore_written_bytes_total")
+	assert.Greater(t, written, float64(0))
+	assert.Equal(t, written, metricValue(t, text, "kvstore_synced_bytes_total"))
+	assert.GreaterOrEqual(t, metricValue(t, text, "kvstore_fsync_duration_seconds_count"), float64(2))
+	assert.Equal(t, float64(1), metricValue(t, text, "kvstore_merges_total"))
+	assert.Greater(t, metricValue(t, text, "kvstore_merge_reclaimed_bytes_total"), float64(0))
+	assert.Equal(t, float64(10), metricValue(t, text, "kvstore_keys"))
+	assert.Equal(t, float64(0), metricValue(t, text, "kvstore_degraded"))
+}
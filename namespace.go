@@ -0,0 +1,493 @@
+package KVstore
+
+import (
+	"KVstore/data"
+	"KVstore/index"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"sort"
+	"time"
+)
+
+// records of namespaces are in the same data files as the default namespace,
+// their keys are namespaceKeyPrefix || uvarint(namespace id) || key
+var namespaceKeyPrefix = []byte{0, 'n', 's', 0}
+
+// the namespace holding the registry, key is the namespace name,
+// value is uvarint(id) || varint(TTL) || sync writes
+const metaNamespaceId uint32 = 0
+
+// Namespace a named set of keys with its own index and options,
+// sharing data files and WriteBatch commits with the whole db.
+// Merge is not scoped to a namespace, the data files are shared so DB.Merge
+// rewrites all of them, Stat tells how much of the reclaimable size is the namespace's.
+type Namespace struct {
+	db          *DB
+	name        string
+	id          uint32
+	options     NamespaceOptions
+	index       index.Indexer
+	reclaimSize int64
+	liveSize    int64 // size of the records in the index, reclaimable once dropped
+	dropped     bool
+}
+
+// CreateNamespace create a namespace, options can't be changed later.
+// B+ tree index is not supported, namespace indexes are loaded from data files.
+func (db *DB) CreateNamespace(name string, options NamespaceOptions) (*Namespace, error) {
+	if len(name) == 0 {
+		return nil, ErrorNamespaceNameEmpty
+	}
+	if db.config.IndexerType == index.BPTree {
+		return nil, ErrorNamespaceUnsupported
+	}
+	if err := db.waitWrite(context.Background(), int64(len(name))); err != nil {
+		return nil, err
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if _, ok := db.namespaces[name]; ok {
+		return nil, ErrorNamespaceExists
+	}
+	key := namespaceKey(metaNamespaceId, []byte(name))
+	value := encodeNamespaceMeta(db.nextNamespaceId, options)
+	pos, err := db.appendLogRecord(&data.LogRecord{
+		Key:   logRecordKeyWithSeqNo(key, NonTxnSeqNo),
+		Value: value,
+		Type:  data.PUT,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := db.updateIndex(key, data.PUT, pos); err != nil {
+		return nil, err
+	}
+	return db.namespaces[name], nil
+}
+
+// Namespace get a created namespace by name
+func (db *DB) Namespace(name string) (*Namespace, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	ns, ok := db.namespaces[name]
+	if !ok {
+		return nil, ErrorNamespaceNotFound
+	}
+	return ns, nil
+}
+
+// DropNamespace remove the namespace with all its keys by one record,
+// the space of the keys is reclaimed by the next merge
+func (db *DB) DropNamespace(name string) error {
+	if err := db.waitWrite(context.Background(), int64(len(name))); err != nil {
+		return err
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if _, ok := db.namespaces[name]; !ok {
+		return ErrorNamespaceNotFound
+	}
+	key := namespaceKey(metaNamespaceId, []byte(name))
+	pos, err := db.appendLogRecord(&data.LogRecord{
+		Key:  logRecordKeyWithSeqNo(key, NonTxnSeqNo),
+		Type: data.DELETE,
+	})
+	if err != nil {
+		return err
+	}
+	return db.updateIndex(key, data.DELETE, pos)
+}
+
+// ListNamespaces names of all namespaces in order
+func (db *DB) ListNamespaces() []string {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	names := make([]string, 0, len(db.namespaces))
+	for name := range db.namespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (ns *Namespace) Name() string {
+	return ns.name
+}
+
+func (ns *Namespace) Put(key []byte, value []byte) error {
+	if len(key) == 0 {
+		return ErrorKeyEmpty
+	}
+	nsKey := namespaceKey(ns.id, key)
+	logRecord := data.LogRecord{
+		Key:   logRecordKeyWithSeqNo(nsKey, NonTxnSeqNo),
+		Value: ns.encodeValue(value),
+		Type:  data.PUT,
+	}
+	db := ns.db
+	if err := db.waitWrite(context.Background(), int64(len(logRecord.Key)+len(logRecord.Value))); err != nil {
+		return err
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if ns.dropped {
+		return ErrorNamespaceNotFound
+	}
+	pos, err := db.appendLogRecord(&logRecord)
+	if err != nil {
+		return err
+	}
+	if err := ns.sync(pos); err != nil {
+		return err
+	}
+	return db.updateIndex(nsKey, data.PUT, pos)
+}
+
+// Get the value of key, expired keys are not found
+func (ns *Namespace) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrorInvalidKey
+	}
+	db := ns.db
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	if ns.dropped {
+		return nil, ErrorNamespaceNotFound
+	}
+	pos := ns.index.Get(key)
+	if pos == nil {
+		return nil, ErrorKeyNotFound
+	}
+	return ns.getValueByPosition(pos)
+}
+
+func (ns *Namespace) Delete(key []byte) error {
+	if len(key) == 0 {
+		return ErrorKeyEmpty
+	}
+	db := ns.db
+	if err := db.waitWrite(context.Background(), int64(len(key))); err != nil {
+		return err
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if ns.dropped {
+		return ErrorNamespaceNotFound
+	}
+	if ns.index.Get(key) == nil {
+		return nil
+	}
+	nsKey := namespaceKey(ns.id, key)
+	pos, err := db.appendLogRecord(&data.LogRecord{
+		Key:  logRecordKeyWithSeqNo(nsKey, NonTxnSeqNo),
+		Type: data.DELETE,
+	})
+	if err != nil {
+		return err
+	}
+	if err := ns.sync(pos); err != nil {
+		return err
+	}
+	return db.updateIndex(nsKey, data.DELETE, pos)
+}
+
+// ListKeys keys of the namespace in order, expired keys are skipped
+func (ns *Namespace) ListKeys() [][]byte {
+	iterConfigs := DefaultIteratorConfigs
+	iterConfigs.KeyOnly = true
+	iter := ns.NewIterator(iterConfigs)
+	defer iter.Close()
+	var keys [][]byte
+	for ; iter.Valid(); iter.Next() {
+		keys = append(keys, iter.Key())
+	}
+	return keys
+}
+
+// Fold get all keys and values of the namespace, when fn returns false stop
+func (ns *Namespace) Fold(fn func(key []byte, value []byte) bool) error {
+	iter := ns.NewIterator(DefaultIteratorConfigs)
+	defer iter.Close()
+	for ; iter.Valid(); iter.Next() {
+		val, err := iter.Value()
+		if err == ErrorKeyNotFound {
+			// expired after it was checked
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !fn(iter.Key(), val) {
+			break
+		}
+	}
+	return nil
+}
+
+func (ns *Namespace) NewIterator(config IteratorConfigs) *Iterator {
+	return ns.db.newIterator(ns.index, ns, config)
+}
+
+// Stat counters of the namespace, data files are shared so the file
+// counters are left zero, see DB.Stat for them
+func (ns *Namespace) Stat() *Stat {
+	ns.db.mutex.RLock()
+	defer ns.db.mutex.RUnlock()
+	stat := &Stat{
+		KeyNum:          uint(ns.index.Size()),
+		ReclaimableSize: ns.reclaimSize,
+		IndexMemory:     ns.index.MemorySize(),
+	}
+	if stat.KeyNum > 0 {
+		stat.IndexMemoryPerKey = float64(stat.IndexMemory) / float64(stat.KeyNum)
+	}
+	return stat
+}
+
+// sync the active file if the namespace wants it and the db doesn't already do it,
+// if it fails the record at pos is dropped like any other failed write
+// need a mutex before reaching this func
+func (ns *Namespace) sync(pos *data.LogRecordPos) error {
+	db := ns.db
+	if !ns.options.SyncWrites || db.config.SyncWrites {
+		return nil
+	}
+	if err := db.fsync(); err != nil {
+		db.syncFailed(err)
+		db.diskSize -= int64(pos.Size)
+		return db.failWrite(err, pos.Offset)
+	}
+	return nil
+}
+
+// varint(expire time in unix nano, 0 means never) || value
+func (ns *Namespace) encodeValue(value []byte) []byte {
+	var expireAt int64
+	if ns.options.TTL > 0 {
+		expireAt = time.Now().Add(ns.options.TTL).UnixNano()
+	}
+	buf := make([]byte, binary.MaxVarintLen64+len(value))
+	n := binary.PutVarint(buf, expireAt)
+	n += copy(buf[n:], value)
+	return buf[:n]
+}
+
+// decode the stored value, ErrorKeyNotFound if it is expired
+func (ns *Namespace) decodeValue(buf []byte) ([]byte, error) {
+	expireAt, n := binary.Varint(buf)
+	if n <= 0 {
+		return nil, ErrorNamespaceCorrupted
+	}
+	if expireAt > 0 && expireAt <= time.Now().UnixNano() {
+		return nil, ErrorKeyNotFound
+	}
+	return buf[n:], nil
+}
+
+// need a mutex before reaching this func
+func (ns *Namespace) getValueByPosition(pos *data.LogRecordPos) ([]byte, error) {
+	buf, err := ns.db.getValueByPosition(pos)
+	if err != nil {
+		return nil, err
+	}
+	return ns.decodeValue(buf)
+}
+
+// whether the value at pos is expired, only namespaces with TTL have to check it
+func (ns *Namespace) expiredAt(pos *data.LogRecordPos) bool {
+	if ns.options.TTL <= 0 {
+		return false
+	}
+	ns.db.mutex.RLock()
+	defer ns.db.mutex.RUnlock()
+	_, err := ns.getValueByPosition(pos)
+	return err == ErrorKeyNotFound
+}
+
+// whether a stored value is expired, used by merge to drop it
+func (ns *Namespace) expired(buf []byte) bool {
+	if ns.options.TTL <= 0 {
+		return false
+	}
+	_, err := ns.decodeValue(buf)
+	return err == ErrorKeyNotFound
+}
+
+// WriteBatch
+
+// PutIn put the key into the namespace when the batch commits
+func (wb *WriteBatch) PutIn(ns *Namespace, key []byte, value []byte) error {
+	if len(key) == 0 {
+		return ErrorKeyEmpty
+	}
+	wb.mutex.Lock()
+	defer wb.mutex.Unlock()
+	nsKey := namespaceKey(ns.id, key)
+	wb.pendingWrites[string(nsKey)] = &data.LogRecord{
+		Key:   nsKey,
+		Value: ns.encodeValue(value),
+		Type:  data.PUT,
+	}
+	return nil
+}
+
+// DeleteIn delete the key from the namespace when the batch commits
+func (wb *WriteBatch) DeleteIn(ns *Namespace, key []byte) error {
+	if len(key) == 0 {
+		return ErrorKeyEmpty
+	}
+	// the same lock order as WriteBatch.Delete
+	ns.db.mutex.RLock()
+	pos := ns.index.Get(key)
+	ns.db.mutex.RUnlock()
+	wb.mutex.Lock()
+	defer wb.mutex.Unlock()
+	nsKey := namespaceKey(ns.id, key)
+	if pos == nil {
+		delete(wb.pendingWrites, string(nsKey))
+		return nil
+	}
+	wb.pendingWrites[string(nsKey)] = &data.LogRecord{
+		Key:  nsKey,
+		Type: data.DELETE,
+	}
+	return nil
+}
+
+// namespaces of the pending writes, ErrorNamespaceNotFound if one is dropped
+// need a mutex before reaching this func
+func (wb *WriteBatch) namespaces() ([]*Namespace, error) {
+	var namespaces []*Namespace
+	for _, record := range wb.pendingWrites {
+		id, _, ok := parseNamespaceKey(record.Key)
+		if !ok {
+			continue
+		}
+		ns, ok := wb.db.namespaceIds[id]
+		if !ok {
+			return nil, ErrorNamespaceNotFound
+		}
+		namespaces = append(namespaces, ns)
+	}
+	return namespaces, nil
+}
+
+/*
+routing records to indexes
+*/
+
+func namespaceKey(id uint32, key []byte) []byte {
+	buf := make([]byte, len(namespaceKeyPrefix)+binary.MaxVarintLen32+len(key))
+	n := copy(buf, namespaceKeyPrefix)
+	n += binary.PutUvarint(buf[n:], uint64(id))
+	n += copy(buf[n:], key)
+	return buf[:n]
+}
+func parseNamespaceKey(key []byte) (uint32, []byte, bool) {
+	if !isNamespaceKey(key) {
+		return 0, nil, false
+	}
+	id, n := binary.Uvarint(key[len(namespaceKeyPrefix):])
+	if n <= 0 {
+		return 0, nil, false
+	}
+	return uint32(id), key[len(namespaceKeyPrefix)+n:], true
+}
+func isNamespaceKey(key []byte) bool {
+	return bytes.HasPrefix(key, namespaceKeyPrefix)
+}
+
+// indexOf get the index of a record key and the key in that index,
+// the index is nil if the namespace is dropped
+func (db *DB) indexOf(key []byte) (index.Indexer, []byte, *Namespace) {
+	id, nsKey, ok := parseNamespaceKey(key)
+	if !ok {
+		return db.index, key, nil
+	}
+	if id == metaNamespaceId {
+		return db.namespaceMeta, nsKey, nil
+	}
+	db.nsMutex.RLock()
+	defer db.nsMutex.RUnlock()
+	ns, ok := db.namespaceIds[id]
+	if !ok {
+		return nil, nil, nil
+	}
+	return ns.index, nsKey, ns
+}
+
+// apply a change of the registry to the namespaces
+// need a mutex before reaching this func
+func (db *DB) updateNamespaceMeta(name []byte, typ data.RecordType, pos *data.LogRecordPos) error {
+	if typ == data.DELETE {
+		db.removeNamespace(string(name))
+		return nil
+	}
+	buf, err := db.getValueByPosition(pos)
+	if err != nil {
+		return err
+	}
+	id, options, err := decodeNamespaceMeta(buf)
+	if err != nil {
+		return err
+	}
+	db.removeNamespace(string(name))
+	indexType := index.Btree
+	if db.config.IndexerType == index.ART {
+		indexType = index.ART
+	}
+	nsIndex, err := index.NewIndexr(indexType, "", false, nil)
+	if err != nil {
+		return err
+	}
+	ns := &Namespace{db: db, name: string(name), id: id, options: options, index: nsIndex}
+	db.nsMutex.Lock()
+	db.namespaces[ns.name] = ns
+	db.namespaceIds[id] = ns
+	db.nsMutex.Unlock()
+	if id >= db.nextNamespaceId {
+		db.nextNamespaceId = id + 1
+	}
+	return nil
+}
+
+// the keys of a removed namespace become reclaimable
+// need a mutex before reaching this func
+func (db *DB) removeNamespace(name string) {
+	ns, ok := db.namespaces[name]
+	if !ok {
+		return
+	}
+	db.nsMutex.Lock()
+	delete(db.namespaces, name)
+	delete(db.namespaceIds, ns.id)
+	db.nsMutex.Unlock()
+	ns.dropped = true
+	db.reclaimSize += ns.liveSize
+	_ = ns.index.Close()
+}
+
+func encodeNamespaceMeta(id uint32, options NamespaceOptions) []byte {
+	buf := make([]byte, binary.MaxVarintLen32+binary.MaxVarintLen64+1)
+	n := binary.PutUvarint(buf, uint64(id))
+	n += binary.PutVarint(buf[n:], int64(options.TTL))
+	if options.SyncWrites {
+		buf[n] = 1
+	}
+	return buf[:n+1]
+}
+func decodeNamespaceMeta(buf []byte) (uint32, NamespaceOptions, error) {
+	var options NamespaceOptions
+	id, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return 0, options, ErrorNamespaceCorrupted
+	}
+	ttl, m := binary.Varint(buf[n:])
+	if m <= 0 || n+m >= len(buf) {
+		return 0, options, ErrorNamespaceCorrupted
+	}
+	options.TTL = time.Duration(ttl)
+	options.SyncWrites = buf[n+m] == 1
+	return uint32(id), options, nil
+}
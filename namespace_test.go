@@ -0,0 +1,238 @@
+package KVstore
+
+import (
+	"KVstore/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDB_Namespace(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-namespace")
+	opts.DirPath = dir
+	opts.DataFileMergeRatio = 0.01
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	users, err := db.CreateNamespace("users", NamespaceOptions{})
+	assert.Nil(t, err)
+	_, err = db.CreateNamespace("users", NamespaceOptions{})
+	assert.Equal(t, ErrorNamespaceExists, err)
+	orders, err := db.CreateNamespace("orders", NamespaceOptions{SyncWrites: true})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"orders", "users"}, db.ListNamespaces())
+
+	// the same key in different namespaces
+	assert.Nil(t, db.Put([]byte("key"), []byte("default")))
+	assert.Nil(t, users.Put([]byte("key"), []byte("user")))
+	assert.Nil(t, orders.Put([]byte("key"), []byte("order")))
+	val, err := users.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("user"), val)
+	val, err = db.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("default"), val)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, users.Put(utils.GetTestKey(i), utils.RandomValue(16)))
+	}
+	assert.Nil(t, users.Delete(utils.GetTestKey(0)))
+	assert.Equal(t, 10, len(users.ListKeys()))
+	assert.Equal(t, uint(10), users.Stat().KeyNum)
+	assert.Equal(t, 1, len(db.ListKeys()))
+	assert.Equal(t, ErrorKeyReserved, db.Put(namespaceKey(users.id, []byte("key")), []byte("x")))
+
+	// a batch spans namespaces
+	wb := db.NewWriteBatch(DefaultWriteBatchConfigs)
+	assert.Nil(t, wb.PutIn(users, []byte("batch"), []byte("a")))
+	assert.Nil(t, wb.DeleteIn(orders, []byte("key")))
+	assert.Nil(t, wb.Put([]byte("batch"), []byte("b")))
+	assert.Nil(t, wb.Commit())
+	_, err = orders.Get([]byte("key"))
+	assert.Equal(t, ErrorKeyNotFound, err)
+	var folded int
+	assert.Nil(t, users.Fold(func(key []byte, value []byte) bool {
+		folded++
+		return true
+	}))
+	assert.Equal(t, 11, folded)
+
+	// namespaces and their keys are loaded on open
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	users, err = db.Namespace("users")
+	assert.Nil(t, err)
+	assert.Equal(t, 11, len(users.ListKeys()))
+	val, err = users.Get([]byte("batch"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("a"), val)
+
+	// dropped namespace is gone and its keys are reclaimable
+	reclaimable := db.Stat().ReclaimableSize
+	assert.Nil(t, db.DropNamespace("users"))
+	assert.Greater(t, db.Stat().ReclaimableSize, reclaimable)
+	_, err = db.Namespace("users")
+	assert.Equal(t, ErrorNamespaceNotFound, err)
+	assert.Equal(t, ErrorNamespaceNotFound, users.Put([]byte("key"), []byte("x")))
+	users, err = db.CreateNamespace("users", NamespaceOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(users.ListKeys()))
+
+	// records of the dropped namespace are removed by merge
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"orders", "users"}, db.ListNamespaces())
+	users, _ = db.Namespace("users")
+	assert.Equal(t, 0, len(users.ListKeys()))
+	val, err = db.Get([]byte("batch"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("b"), val)
+}
+
+func TestNamespace_TTL(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-namespace-ttl")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	sessions, err := db.CreateNamespace("sessions", NamespaceOptions{TTL: 50 * time.Millisecond})
+	assert.Nil(t, err)
+	assert.Nil(t, sessions.Put([]byte("a"), []byte("1")))
+	val, err := sessions.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("1"), val)
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, sessions.Put([]byte("b"), []byte("2")))
+	_, err = sessions.Get([]byte("a"))
+	assert.Equal(t, ErrorKeyNotFound, err)
+	assert.Equal(t, [][]byte{[]byte("b")}, sessions.ListKeys())
+}
+
+func TestNamespace_Merge(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-namespace-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 4 * 1024
+	opts.DataFileMergeRatio = 0.01
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	dropped, err := db.CreateNamespace("dropped", NamespaceOptions{})
+	assert.Nil(t, err)
+	kept, err := db.CreateNamespace("kept", NamespaceOptions{})
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, dropped.Put(utils.GetTestKey(i), utils.RandomValue(32)))
+		assert.Nil(t, kept.Put(utils.GetTestKey(i), []byte("kept")))
+		assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("default")))
+	}
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, kept.Put(utils.GetTestKey(i), []byte("overwritten")))
+	}
+
+	// the size of the dropped namespace is reclaimable at once
+	reclaimable := db.Stat().ReclaimableSize
+	assert.Nil(t, db.DropNamespace("dropped"))
+	assert.Greater(t, db.Stat().ReclaimableSize-reclaimable, int64(100*32))
+	assert.Nil(t, db.Merge())
+
+	check := func(db *DB) {
+		kept, err := db.Namespace("kept")
+		assert.Nil(t, err)
+		assert.Equal(t, 100, len(kept.ListKeys()))
+		for i := 0; i < 100; i++ {
+			expected := []byte("kept")
+			if i < 50 {
+				expected = []byte("overwritten")
+			}
+			val, err := kept.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, expected, val)
+			val, err = db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("default"), val)
+		}
+		assert.Equal(t, []string{"kept"}, db.ListNamespaces())
+	}
+	check(db)
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	check(db)
+	assert.Equal(t, 100, len(db.ListKeys()))
+}
+
+func TestNamespace_IndexSnapshot(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-namespace-snapshot")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	users, err := db.CreateNamespace("users", NamespaceOptions{})
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, users.Put(utils.GetTestKey(i), utils.RandomValue(32)))
+	}
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, users.Put(utils.GetTestKey(i), utils.RandomValue(32)))
+	}
+	stat, liveSize := users.Stat(), users.liveSize
+	assert.Greater(t, stat.ReclaimableSize, int64(0))
+
+	// the counters are the same when the index is loaded from the snapshot written by Close
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db.snapshotPos)
+	users, err = db.Namespace("users")
+	assert.Nil(t, err)
+	assert.Equal(t, stat, users.Stat())
+	assert.Equal(t, liveSize, users.liveSize)
+
+	reclaimable := db.Stat().ReclaimableSize
+	assert.Nil(t, db.DropNamespace("users"))
+	assert.GreaterOrEqual(t, db.Stat().ReclaimableSize-reclaimable, liveSize)
+}
+
+func TestNamespace_SyncFailed(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-namespace-sync")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	orders, err := db.CreateNamespace("orders", NamespaceOptions{SyncWrites: true})
+	assert.Nil(t, err)
+	assert.Nil(t, orders.Put([]byte("a"), []byte("1")))
+
+	// the record is dropped and the db is read only like any other failed write
+	io := &failingIO{IOManager: db.activeFile.IOManager, failSync: true}
+	db.activeFile.IOManager = io
+	diskSize := db.diskSize
+	assert.Equal(t, syscall.EIO, orders.Put([]byte("b"), []byte("2")))
+	assert.Equal(t, syscall.EIO, db.BackgroundError())
+	assert.Equal(t, diskSize, db.diskSize)
+	size, err := io.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, db.activeFile.WriteOffset, size)
+	_, err = orders.Get([]byte("b"))
+	assert.Equal(t, ErrorKeyNotFound, err)
+	assert.Equal(t, ErrorDegraded, orders.Delete([]byte("a")))
+
+	io.failSync = false
+	assert.Nil(t, db.Resume())
+	assert.Nil(t, orders.Delete([]byte("a")))
+	assert.Equal(t, 0, len(orders.ListKeys()))
+}
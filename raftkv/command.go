@@ -0,0 +1,74 @@
+package raftkv
+
+import (
+	"encoding/binary"
+)
+
+type OpType = byte
+
+const (
+	OpPut OpType = iota
+	OpDelete
+)
+
+// Op a write in a command, all ops of a command are applied atomically
+type Op struct {
+	Type  OpType
+	Key   []byte
+	Value []byte
+}
+
+// n || (type keySize key valueSize value) * n
+func encodeCommand(ops []Op) []byte {
+	size := binary.MaxVarintLen64
+	for _, op := range ops {
+		size += 1 + binary.MaxVarintLen64*2 + len(op.Key) + len(op.Value)
+	}
+	buf := make([]byte, size)
+	var index = 0
+	index += binary.PutUvarint(buf[index:], uint64(len(ops)))
+	for _, op := range ops {
+		buf[index] = op.Type
+		index++
+		index += binary.PutUvarint(buf[index:], uint64(len(op.Key)))
+		index += copy(buf[index:], op.Key)
+		index += binary.PutUvarint(buf[index:], uint64(len(op.Value)))
+		index += copy(buf[index:], op.Value)
+	}
+	return buf[:index]
+}
+
+func decodeCommand(buf []byte) ([]Op, error) {
+	count, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, ErrorCorruptedCommand
+	}
+	var index = n
+	readBytes := func() ([]byte, error) {
+		size, n := binary.Uvarint(buf[index:])
+		if n <= 0 || uint64(len(buf)-index-n) < size {
+			return nil, ErrorCorruptedCommand
+		}
+		index += n
+		b := buf[index : index+int(size)]
+		index += int(size)
+		return b, nil
+	}
+	ops := make([]Op, 0, count)
+	for i := uint64(0); i < count; i++ {
+		if index >= len(buf) {
+			return nil, ErrorCorruptedCommand
+		}
+		op := Op{Type: buf[index]}
+		index++
+		var err error
+		if op.Key, err = readBytes(); err != nil {
+			return nil, err
+		}
+		if op.Value, err = readBytes(); err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
@@ -0,0 +1,18 @@
+package raftkv
+
+import "errors"
+
+var (
+	ErrorNotLeader             = errors.New("node is not the leader")
+	ErrorLeadershipLost        = errors.New("leadership lost, the command may or may not be applied")
+	ErrorApplyTimeout          = errors.New("timeout waiting for the command to be applied")
+	ErrorNodeClosed            = errors.New("node is closed")
+	ErrorNoOps                 = errors.New("command has no ops")
+	ErrorCorruptedCommand      = errors.New("raft command is corrupted")
+	ErrorCorruptedLog          = errors.New("raft log is corrupted")
+	ErrorUnreachable           = errors.New("node is unreachable")
+	ErrorInstallingSnapshot    = errors.New("node is installing another snapshot")
+	ConfigErrorID              = errors.New("node id is not in peers")
+	ConfigErrorTransport       = errors.New("transport is nil")
+	ConfigErrorElectionTimeout = errors.New("election timeout must be longer than heartbeat interval")
+)
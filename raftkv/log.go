@@ -0,0 +1,248 @@
+package raftkv
+
+import (
+	"KVstore"
+	"context"
+	"encoding/binary"
+	"math"
+)
+
+// keys in the log db
+var (
+	entryKeyPrefix = []byte("e")
+	hardStateKey   = []byte("m-hard-state")
+	appliedKey     = []byte("m-applied")
+	snapshotKey    = []byte("m-snapshot")
+)
+
+// the suffix removed by append may be long, never limit the batch size
+var logBatchConfigs = KVstore.WriteBatchConfigs{
+	MaxBatchNum: math.MaxUint32,
+	SyncWrites:  true,
+}
+
+// Entry a command in the raft log, an entry without command is a no-op
+// written by a new leader to commit entries of earlier terms
+type Entry struct {
+	Index   uint64
+	Term    uint64
+	Command []byte
+}
+
+// logStore keeps the raft log and the persistent state of raft in a db,
+// entries before snapIndex are dropped, they are in the state machine already
+type logStore struct {
+	db        *KVstore.DB
+	lastIndex uint64
+	snapIndex uint64 // the last index compacted
+	snapTerm  uint64
+	compacted bool // entries are dropped since the last merge
+}
+
+func openLogStore(configs KVstore.Configs) (*logStore, error) {
+	db, err := KVstore.Open(configs)
+	if err != nil {
+		return nil, err
+	}
+	ls := &logStore{db: db}
+	if buf, err := db.Get(snapshotKey); err == nil {
+		if len(buf) != 16 {
+			return nil, ErrorCorruptedLog
+		}
+		ls.snapIndex = binary.BigEndian.Uint64(buf[:8])
+		ls.snapTerm = binary.BigEndian.Uint64(buf[8:])
+	} else if err != KVstore.ErrorKeyNotFound {
+		return nil, err
+	}
+	ls.lastIndex = ls.snapIndex
+	iterConfigs := KVstore.DefaultIteratorConfigs
+	iterConfigs.Prefix = entryKeyPrefix
+	iterConfigs.Reverse = true
+	iterConfigs.KeyOnly = true
+	iter := db.NewIterator(iterConfigs)
+	if iter.Valid() {
+		ls.lastIndex = decodeEntryKey(iter.Key())
+	}
+	iter.Close()
+	return ls, nil
+}
+
+func (ls *logStore) close() error {
+	return ls.db.Close()
+}
+
+func (ls *logStore) firstIndex() uint64 {
+	return ls.snapIndex + 1
+}
+
+func (ls *logStore) entry(index uint64) (*Entry, error) {
+	buf, err := ls.db.Get(entryKey(index))
+	if err != nil {
+		return nil, err
+	}
+	term, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, ErrorCorruptedLog
+	}
+	return &Entry{Index: index, Term: term, Command: buf[n:]}, nil
+}
+
+// entries in [from, to]
+func (ls *logStore) entries(from, to uint64) ([]*Entry, error) {
+	var entries []*Entry
+	for index := from; index <= to; index++ {
+		entry, err := ls.entry(index)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// term of the entry at index, 0 for index 0
+func (ls *logStore) term(index uint64) (uint64, error) {
+	if index == ls.snapIndex {
+		return ls.snapTerm, nil
+	}
+	entry, err := ls.entry(index)
+	if err != nil {
+		return 0, err
+	}
+	return entry.Term, nil
+}
+
+func (ls *logStore) lastTerm() (uint64, error) {
+	return ls.term(ls.lastIndex)
+}
+
+// append entries, entries from the first of them to the end are removed before,
+// all done in one batch
+func (ls *logStore) append(entries []*Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	wb := ls.db.NewWriteBatch(logBatchConfigs)
+	for index := entries[0].Index; index <= ls.lastIndex; index++ {
+		if err := wb.Delete(entryKey(index)); err != nil {
+			return err
+		}
+	}
+	for _, entry := range entries {
+		buf := make([]byte, binary.MaxVarintLen64+len(entry.Command))
+		n := binary.PutUvarint(buf, entry.Term)
+		n += copy(buf[n:], entry.Command)
+		if err := wb.Put(entryKey(entry.Index), buf[:n]); err != nil {
+			return err
+		}
+	}
+	if err := wb.Commit(); err != nil {
+		return err
+	}
+	ls.lastIndex = entries[len(entries)-1].Index
+	return nil
+}
+
+// compact drop entries up to index, they are applied to the state machine
+func (ls *logStore) compact(index, term uint64) error {
+	return ls.dropEntries(index, index, term)
+}
+
+// drop entries up to last and record the snapshot at index, by one range delete
+// in one batch so that it costs a single sync however many entries are dropped
+func (ls *logStore) dropEntries(last, index, term uint64) error {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf[:8], index)
+	binary.BigEndian.PutUint64(buf[8:], term)
+	wb := ls.db.NewWriteBatch(logBatchConfigs)
+	if err := wb.Put(snapshotKey, buf); err != nil {
+		return err
+	}
+	if first := ls.snapIndex + 1; first <= last {
+		if err := wb.DeleteRange(entryKey(first), entryKey(last+1)); err != nil {
+			return err
+		}
+	}
+	if err := wb.Commit(); err != nil {
+		return err
+	}
+	ls.snapIndex, ls.snapTerm = index, term
+	if last >= ls.lastIndex {
+		ls.lastIndex = index
+	}
+	ls.compacted = true
+	return nil
+}
+
+// merge reclaim the space of dropped entries, installed on the next open.
+// It is done without the mutex of the node, the db is safe to write meanwhile.
+func (ls *logStore) merge(ctx context.Context) error {
+	if err := ls.db.MergeContext(ctx); err != nil &&
+		err != KVstore.ErrorMergeRationUnReached && err != KVstore.ErrorIsMerging {
+		return err
+	}
+	return nil
+}
+
+// reset drop all entries, the state machine is replaced by a snapshot at index
+func (ls *logStore) reset(index, term uint64) error {
+	last := ls.lastIndex
+	if last < index {
+		last = index
+	}
+	return ls.dropEntries(last, index, term)
+}
+
+// term || votedFor
+func (ls *logStore) hardState() (uint64, string, error) {
+	buf, err := ls.db.Get(hardStateKey)
+	if err == KVstore.ErrorKeyNotFound {
+		return 0, "", nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	if len(buf) < 8 {
+		return 0, "", ErrorCorruptedLog
+	}
+	return binary.BigEndian.Uint64(buf[:8]), string(buf[8:]), nil
+}
+
+func (ls *logStore) setHardState(term uint64, votedFor string) error {
+	buf := make([]byte, 8+len(votedFor))
+	binary.BigEndian.PutUint64(buf[:8], term)
+	copy(buf[8:], votedFor)
+	return ls.db.Put(hardStateKey, buf)
+}
+
+func (ls *logStore) applied() (uint64, error) {
+	buf, err := ls.db.Get(appliedKey)
+	if err == KVstore.ErrorKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(buf) != 8 {
+		return 0, ErrorCorruptedLog
+	}
+	return binary.BigEndian.Uint64(buf), nil
+}
+
+func (ls *logStore) setApplied(index uint64) error {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, index)
+	return ls.db.Put(appliedKey, buf)
+}
+
+// prefix || big endian index, so that entries are sorted by index
+func entryKey(index uint64) []byte {
+	key := make([]byte, len(entryKeyPrefix)+8)
+	copy(key, entryKeyPrefix)
+	binary.BigEndian.PutUint64(key[len(entryKeyPrefix):], index)
+	return key
+}
+
+func decodeEntryKey(key []byte) uint64 {
+	return binary.BigEndian.Uint64(key[len(entryKeyPrefix):])
+}
@@ -0,0 +1,873 @@
+package raftkv
+
+import (
+	"KVstore"
+	"context"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	dataDirName = "data"
+	logDirName  = "raft"
+	// max entries sent in one AppendEntries
+	maxAppendEntries = 256
+)
+
+type Config struct {
+	ID      string
+	Peers   []string // ids of all nodes in the cluster, including ID
+	DirPath string
+	// nil is not allowed, use InmemTransport for nodes in one process
+	Transport Transport
+	// a follower starts an election if it hears nothing from the leader for
+	// a random time between ElectionTimeout and 2 * ElectionTimeout
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	// the log is compacted when it has more applied entries than this,
+	// followers which need compacted entries get the whole state machine instead
+	SnapshotThreshold uint64
+	// how long to wait for a command to be applied
+	ApplyTimeout time.Duration
+	// configs of the state machine db, DirPath is set by the node
+	DBConfigs KVstore.Configs
+}
+
+var DefaultConfig = Config{
+	ElectionTimeout:   300 * time.Millisecond,
+	HeartbeatInterval: 50 * time.Millisecond,
+	SnapshotThreshold: 10000,
+	ApplyTimeout:      5 * time.Second,
+	DBConfigs:         KVstore.DefaultConfigs,
+}
+
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+// Node a member of a raft cluster, writes are replicated to a majority
+// of the cluster before they are applied to the state machine db
+type Node struct {
+	config Config
+	mutex  *sync.Mutex
+	db     *KVstore.DB // the state machine
+	log    *logStore
+
+	role        role
+	currentTerm uint64
+	votedFor    string
+	leaderId    string
+	commitIndex uint64
+	lastApplied uint64
+	// the leader only, next entry to send and the last entry known to be replicated
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	inflight    map[string]bool // one rpc in flight for each peer
+	nextBeat    time.Time
+	electionDue time.Time
+	// proposals waiting for their entries to be applied
+	waiters map[uint64]*waiter
+	// a snapshot from the leader is being received without the mutex
+	installing bool
+
+	applyCh chan struct{} // wake up the apply loop
+	done    chan struct{}
+	wg      *sync.WaitGroup
+	closed  bool
+}
+
+type waiter struct {
+	term uint64
+	ch   chan error
+}
+
+// Open start a node, the state in DirPath is recovered
+func Open(config Config) (*Node, error) {
+	if err := checkConfig(&config); err != nil {
+		return nil, err
+	}
+	logConfigs := KVstore.DefaultConfigs
+	logConfigs.DirPath = filepath.Join(config.DirPath, logDirName)
+	// raft state must be durable before answering rpcs
+	logConfigs.SyncWrites = true
+	log, err := openLogStore(logConfigs)
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{
+		config:     config,
+		mutex:      new(sync.Mutex),
+		log:        log,
+		nextIndex:  make(map[string]uint64),
+		matchIndex: make(map[string]uint64),
+		inflight:   make(map[string]bool),
+		waiters:    make(map[uint64]*waiter),
+		applyCh:    make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		wg:         new(sync.WaitGroup),
+	}
+	if n.currentTerm, n.votedFor, err = log.hardState(); err != nil {
+		_ = log.close()
+		return nil, err
+	}
+	if n.lastApplied, err = log.applied(); err != nil {
+		_ = log.close()
+		return nil, err
+	}
+	if n.lastApplied < log.snapIndex {
+		n.lastApplied = log.snapIndex
+	}
+	n.commitIndex = n.lastApplied
+	if n.db, err = n.openDB(); err != nil {
+		_ = log.close()
+		return nil, err
+	}
+	n.resetElectionTimer()
+	config.Transport.Register(config.ID, n)
+
+	n.wg.Add(2)
+	go n.runTicker()
+	go n.runApply()
+	return n, nil
+}
+
+func checkConfig(config *Config) error {
+	if config.Transport == nil {
+		return ConfigErrorTransport
+	}
+	found := false
+	for _, peer := range config.Peers {
+		if peer == config.ID {
+			found = true
+		}
+	}
+	if !found {
+		return ConfigErrorID
+	}
+	if config.ElectionTimeout <= config.HeartbeatInterval {
+		return ConfigErrorElectionTimeout
+	}
+	return nil
+}
+
+func (n *Node) openDB() (*KVstore.DB, error) {
+	dbConfigs := n.config.DBConfigs
+	dbConfigs.DirPath = filepath.Join(n.config.DirPath, dataDirName)
+	return KVstore.Open(dbConfigs)
+}
+
+// Close stop the node, it can be opened again from DirPath
+func (n *Node) Close() error {
+	n.mutex.Lock()
+	if n.closed {
+		n.mutex.Unlock()
+		return nil
+	}
+	n.closed = true
+	close(n.done)
+	n.failWaiters(ErrorNodeClosed)
+	n.mutex.Unlock()
+	n.wg.Wait()
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if err := n.db.Close(); err != nil {
+		_ = n.log.close()
+		return err
+	}
+	return n.log.close()
+}
+
+// Put replicate a put, only the leader accepts writes
+func (n *Node) Put(key, value []byte) error {
+	return n.Apply([]Op{{Type: OpPut, Key: key, Value: value}})
+}
+
+func (n *Node) Delete(key []byte) error {
+	return n.Apply([]Op{{Type: OpDelete, Key: key}})
+}
+
+// Apply replicate ops as one command, they are applied atomically by a WriteBatch,
+// it returns after the command is applied to the state machine of the leader
+func (n *Node) Apply(ops []Op) error {
+	if len(ops) == 0 {
+		return ErrorNoOps
+	}
+	for _, op := range ops {
+		if len(op.Key) == 0 {
+			return KVstore.ErrorKeyEmpty
+		}
+	}
+	n.mutex.Lock()
+	if n.closed {
+		n.mutex.Unlock()
+		return ErrorNodeClosed
+	}
+	if n.role != leader {
+		n.mutex.Unlock()
+		return ErrorNotLeader
+	}
+	entry := &Entry{Index: n.log.lastIndex + 1, Term: n.currentTerm, Command: encodeCommand(ops)}
+	if err := n.log.append([]*Entry{entry}); err != nil {
+		n.mutex.Unlock()
+		return err
+	}
+	w := &waiter{term: entry.Term, ch: make(chan error, 1)}
+	n.waiters[entry.Index] = w
+	n.advanceCommitIndex()
+	n.broadcast()
+	n.mutex.Unlock()
+
+	select {
+	case err := <-w.ch:
+		return err
+	case <-time.After(n.config.ApplyTimeout):
+		n.mutex.Lock()
+		delete(n.waiters, entry.Index)
+		n.mutex.Unlock()
+		return ErrorApplyTimeout
+	}
+}
+
+// Get read the local state machine, it may be stale on followers
+// and on a leader which is partitioned away
+func (n *Node) Get(key []byte) ([]byte, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.closed {
+		return nil, ErrorNodeClosed
+	}
+	return n.db.Get(key)
+}
+
+// ListKeys keys in the local state machine
+func (n *Node) ListKeys() [][]byte {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.db.ListKeys()
+}
+
+// State return the current term and whether the node is the leader
+func (n *Node) State() (uint64, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.currentTerm, n.role == leader
+}
+
+// Leader id of the leader known by the node, empty if unknown
+func (n *Node) Leader() string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.leaderId
+}
+
+// AppliedIndex index of the last entry applied to the state machine
+func (n *Node) AppliedIndex() uint64 {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.lastApplied
+}
+
+func (n *Node) runTicker() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.config.HeartbeatInterval / 5)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+			n.tick()
+		}
+	}
+}
+
+func (n *Node) tick() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	now := time.Now()
+	if n.role == leader {
+		if now.After(n.nextBeat) {
+			n.broadcast()
+		}
+		return
+	}
+	// the leader sends no heartbeats while sending a snapshot
+	if n.installing {
+		n.resetElectionTimer()
+		return
+	}
+	if now.After(n.electionDue) {
+		n.startElection()
+	}
+}
+
+// need a mutex before reaching this func
+func (n *Node) resetElectionTimer() {
+	timeout := n.config.ElectionTimeout + time.Duration(rand.Int63n(int64(n.config.ElectionTimeout)))
+	n.electionDue = time.Now().Add(timeout)
+}
+
+// need a mutex before reaching this func
+func (n *Node) setHardState(term uint64, votedFor string) error {
+	if err := n.log.setHardState(term, votedFor); err != nil {
+		return err
+	}
+	n.currentTerm, n.votedFor = term, votedFor
+	return nil
+}
+
+// need a mutex before reaching this func
+func (n *Node) becomeFollower(term uint64) error {
+	if term > n.currentTerm {
+		if err := n.setHardState(term, ""); err != nil {
+			return err
+		}
+	}
+	if n.role == leader {
+		n.failWaiters(ErrorLeadershipLost)
+	}
+	n.role = follower
+	return nil
+}
+
+// need a mutex before reaching this func
+func (n *Node) failWaiters(err error) {
+	for index, w := range n.waiters {
+		w.ch <- err
+		delete(n.waiters, index)
+	}
+}
+
+// need a mutex before reaching this func
+func (n *Node) startElection() {
+	if err := n.setHardState(n.currentTerm+1, n.config.ID); err != nil {
+		return
+	}
+	n.role = candidate
+	n.leaderId = ""
+	n.resetElectionTimer()
+	lastTerm, err := n.log.lastTerm()
+	if err != nil {
+		return
+	}
+	req := &RequestVoteRequest{
+		Term:         n.currentTerm,
+		CandidateId:  n.config.ID,
+		LastLogIndex: n.log.lastIndex,
+		LastLogTerm:  lastTerm,
+	}
+	votes := 1
+	if votes > len(n.config.Peers)/2 {
+		n.becomeLeader()
+		return
+	}
+	for _, peer := range n.config.Peers {
+		if peer == n.config.ID {
+			continue
+		}
+		go func(peer string) {
+			resp, err := n.config.Transport.RequestVote(peer, req)
+			if err != nil {
+				return
+			}
+			n.mutex.Lock()
+			defer n.mutex.Unlock()
+			if n.closed {
+				return
+			}
+			if resp.Term > n.currentTerm {
+				_ = n.becomeFollower(resp.Term)
+				return
+			}
+			if n.role != candidate || n.currentTerm != req.Term || !resp.VoteGranted {
+				return
+			}
+			votes++
+			if votes > len(n.config.Peers)/2 {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// need a mutex before reaching this func
+func (n *Node) becomeLeader() {
+	n.role = leader
+	n.leaderId = n.config.ID
+	for _, peer := range n.config.Peers {
+		n.nextIndex[peer] = n.log.lastIndex + 1
+		n.matchIndex[peer] = 0
+	}
+	// entries of earlier terms are committed with an entry of this term
+	noop := &Entry{Index: n.log.lastIndex + 1, Term: n.currentTerm}
+	if err := n.log.append([]*Entry{noop}); err != nil {
+		_ = n.becomeFollower(n.currentTerm)
+		return
+	}
+	n.advanceCommitIndex()
+	n.broadcast()
+}
+
+// send entries or heartbeats to all followers
+// need a mutex before reaching this func
+func (n *Node) broadcast() {
+	n.nextBeat = time.Now().Add(n.config.HeartbeatInterval)
+	for _, peer := range n.config.Peers {
+		if peer == n.config.ID || n.inflight[peer] {
+			continue
+		}
+		n.inflight[peer] = true
+		go n.replicateTo(peer)
+	}
+}
+
+func (n *Node) replicateTo(peer string) {
+	n.mutex.Lock()
+	defer func() {
+		n.inflight[peer] = false
+		n.mutex.Unlock()
+	}()
+	for !n.closed && n.role == leader {
+		term := n.currentTerm
+		var err error
+		var more bool
+		if n.nextIndex[peer] <= n.log.snapIndex {
+			more, err = n.sendSnapshot(peer, term)
+		} else {
+			more, err = n.sendEntries(peer, term)
+		}
+		// more entries to send, otherwise wait for the next broadcast
+		if err != nil || !more {
+			return
+		}
+	}
+}
+
+// need a mutex before reaching this func, it is released when sending
+func (n *Node) sendEntries(peer string, term uint64) (bool, error) {
+	prevIndex := n.nextIndex[peer] - 1
+	prevTerm, err := n.log.term(prevIndex)
+	if err != nil {
+		return false, err
+	}
+	lastIndex := n.log.lastIndex
+	if lastIndex-prevIndex > maxAppendEntries {
+		lastIndex = prevIndex + maxAppendEntries
+	}
+	entries, err := n.log.entries(prevIndex+1, lastIndex)
+	if err != nil {
+		return false, err
+	}
+	req := &AppendEntriesRequest{
+		Term:         term,
+		LeaderId:     n.config.ID,
+		PrevLogIndex: prevIndex,
+		PrevLogTerm:  prevTerm,
+		Entries:      entries,
+		LeaderCommit: n.commitIndex,
+	}
+	n.mutex.Unlock()
+	resp, err := n.config.Transport.AppendEntries(peer, req)
+	n.mutex.Lock()
+	if err != nil {
+		return false, err
+	}
+	if n.closed {
+		return false, ErrorNodeClosed
+	}
+	if resp.Term > n.currentTerm {
+		return false, n.becomeFollower(resp.Term)
+	}
+	if n.role != leader || n.currentTerm != term {
+		return false, nil
+	}
+	if !resp.Success {
+		n.nextIndex[peer] = resp.ConflictIndex
+		if n.nextIndex[peer] < 1 {
+			n.nextIndex[peer] = 1
+		}
+		return true, nil
+	}
+	if match := prevIndex + uint64(len(entries)); match > n.matchIndex[peer] {
+		n.matchIndex[peer] = match
+	}
+	n.nextIndex[peer] = n.matchIndex[peer] + 1
+	n.advanceCommitIndex()
+	return n.nextIndex[peer] <= n.log.lastIndex, nil
+}
+
+// send the whole state machine to a follower which needs compacted entries
+// need a mutex before reaching this func, it is released when sending
+func (n *Node) sendSnapshot(peer string, term uint64) (bool, error) {
+	// applying is blocked by the mutex, the files are taken at lastApplied
+	// and streamed to the follower after releasing it
+	lastIndex := n.lastApplied
+	lastTerm, err := n.log.term(lastIndex)
+	if err != nil {
+		return false, err
+	}
+	snapshot, err := n.db.NewBackupSnapshot(context.Background())
+	if err != nil {
+		return false, err
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		err := snapshot.Stream(context.Background(), writer)
+		snapshot.Close()
+		_ = writer.CloseWithError(err)
+	}()
+	req := &InstallSnapshotRequest{
+		Term:      term,
+		LeaderId:  n.config.ID,
+		LastIndex: lastIndex,
+		LastTerm:  lastTerm,
+		Data:      reader,
+	}
+	n.mutex.Unlock()
+	resp, err := n.config.Transport.InstallSnapshot(peer, req)
+	// stop streaming if the follower didn't read all of it
+	_ = reader.Close()
+	n.mutex.Lock()
+	if err != nil {
+		return false, err
+	}
+	if n.closed {
+		return false, ErrorNodeClosed
+	}
+	if resp.Term > n.currentTerm {
+		return false, n.becomeFollower(resp.Term)
+	}
+	if n.role != leader || n.currentTerm != term {
+		return false, nil
+	}
+	if lastIndex > n.matchIndex[peer] {
+		n.matchIndex[peer] = lastIndex
+	}
+	n.nextIndex[peer] = n.matchIndex[peer] + 1
+	n.advanceCommitIndex()
+	return n.nextIndex[peer] <= n.log.lastIndex, nil
+}
+
+// commit the last entry of this term replicated to a majority
+// need a mutex before reaching this func
+func (n *Node) advanceCommitIndex() {
+	for index := n.log.lastIndex; index > n.commitIndex; index-- {
+		term, err := n.log.term(index)
+		if err != nil || term < n.currentTerm {
+			return
+		}
+		if term > n.currentTerm {
+			continue
+		}
+		count := 1
+		for _, peer := range n.config.Peers {
+			if peer != n.config.ID && n.matchIndex[peer] >= index {
+				count++
+			}
+		}
+		if count > len(n.config.Peers)/2 {
+			n.commitIndex = index
+			n.notifyApply()
+			return
+		}
+	}
+}
+
+func (n *Node) notifyApply() {
+	select {
+	case n.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+func (n *Node) runApply() {
+	defer n.wg.Done()
+	// a merge is stopped by Close
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-n.done
+		cancel()
+	}()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-n.applyCh:
+			n.mutex.Lock()
+			_ = n.applyCommitted()
+			compacted := n.log.compacted
+			n.log.compacted = false
+			n.mutex.Unlock()
+			// merge of the log db is slow, don't block heartbeats and elections
+			if compacted {
+				_ = n.log.merge(ctx)
+			}
+		}
+	}
+}
+
+// apply committed entries to the state machine
+// need a mutex before reaching this func
+func (n *Node) applyCommitted() error {
+	applied := n.lastApplied
+	for n.lastApplied < n.commitIndex && !n.closed {
+		entry, err := n.log.entry(n.lastApplied + 1)
+		if err != nil {
+			return err
+		}
+		applyErr := n.applyEntry(entry)
+		n.lastApplied = entry.Index
+		if w, ok := n.waiters[entry.Index]; ok {
+			if w.term != entry.Term {
+				applyErr = ErrorLeadershipLost
+			}
+			w.ch <- applyErr
+			delete(n.waiters, entry.Index)
+		}
+	}
+	if n.lastApplied == applied {
+		return nil
+	}
+	// the log db syncs every write, the state machine must be durable before
+	// the applied index and compaction, or a crash loses entries dropped from the log.
+	// Entries applied again after a crash only write the same values.
+	if err := n.db.Sync(); err != nil {
+		return err
+	}
+	if err := n.log.setApplied(n.lastApplied); err != nil {
+		return err
+	}
+	if n.lastApplied-n.log.snapIndex > n.config.SnapshotThreshold {
+		term, err := n.log.term(n.lastApplied)
+		if err != nil {
+			return err
+		}
+		return n.log.compact(n.lastApplied, term)
+	}
+	return nil
+}
+
+func (n *Node) applyEntry(entry *Entry) error {
+	if len(entry.Command) == 0 {
+		return nil
+	}
+	ops, err := decodeCommand(entry.Command)
+	if err != nil {
+		return err
+	}
+	if len(ops) == 1 {
+		return applyOp(n.db, ops[0])
+	}
+	wb := n.db.NewWriteBatch(KVstore.WriteBatchConfigs{
+		MaxBatchNum: uint(len(ops)),
+		SyncWrites:  n.config.DBConfigs.SyncWrites,
+	})
+	for _, op := range ops {
+		if err := applyOp(wb, op); err != nil {
+			return err
+		}
+	}
+	return wb.Commit()
+}
+
+// writer is DB or WriteBatch
+type writer interface {
+	Put(key, value []byte) error
+	Delete(key []byte) error
+}
+
+func applyOp(w writer, op Op) error {
+	if op.Type == OpDelete {
+		return w.Delete(op.Key)
+	}
+	return w.Put(op.Key, op.Value)
+}
+
+func (n *Node) HandleRequestVote(req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.closed {
+		return nil, ErrorNodeClosed
+	}
+	if req.Term > n.currentTerm {
+		if err := n.becomeFollower(req.Term); err != nil {
+			return nil, err
+		}
+	}
+	resp := &RequestVoteResponse{Term: n.currentTerm}
+	if req.Term < n.currentTerm || (n.votedFor != "" && n.votedFor != req.CandidateId) {
+		return resp, nil
+	}
+	// the candidate must have all entries we have
+	lastTerm, err := n.log.lastTerm()
+	if err != nil {
+		return nil, err
+	}
+	if req.LastLogTerm < lastTerm || (req.LastLogTerm == lastTerm && req.LastLogIndex < n.log.lastIndex) {
+		return resp, nil
+	}
+	if err := n.setHardState(n.currentTerm, req.CandidateId); err != nil {
+		return nil, err
+	}
+	n.resetElectionTimer()
+	resp.VoteGranted = true
+	return resp, nil
+}
+
+func (n *Node) HandleAppendEntries(req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.closed {
+		return nil, ErrorNodeClosed
+	}
+	resp := &AppendEntriesResponse{Term: n.currentTerm}
+	if req.Term < n.currentTerm {
+		return resp, nil
+	}
+	if req.Term > n.currentTerm || n.role != follower {
+		if err := n.becomeFollower(req.Term); err != nil {
+			return nil, err
+		}
+	}
+	resp.Term = n.currentTerm
+	n.leaderId = req.LeaderId
+	n.resetElectionTimer()
+
+	if req.PrevLogIndex > n.log.lastIndex {
+		resp.ConflictIndex = n.log.lastIndex + 1
+		return resp, nil
+	}
+	entries := req.Entries
+	// entries before the snapshot are committed, they must match
+	if req.PrevLogIndex < n.log.snapIndex {
+		skip := n.log.snapIndex - req.PrevLogIndex
+		if skip > uint64(len(entries)) {
+			skip = uint64(len(entries))
+		}
+		entries = entries[skip:]
+	} else {
+		prevTerm, err := n.log.term(req.PrevLogIndex)
+		if err != nil {
+			return nil, err
+		}
+		if prevTerm != req.PrevLogTerm {
+			resp.ConflictIndex = req.PrevLogIndex
+			return resp, nil
+		}
+	}
+	// skip entries we already have, the log is only truncated on conflict
+	for len(entries) > 0 && entries[0].Index <= n.log.lastIndex {
+		term, err := n.log.term(entries[0].Index)
+		if err != nil {
+			return nil, err
+		}
+		if term != entries[0].Term {
+			break
+		}
+		entries = entries[1:]
+	}
+	if len(entries) > 0 {
+		if entries[0].Index <= n.commitIndex {
+			return nil, ErrorCorruptedLog
+		}
+		if err := n.log.append(entries); err != nil {
+			return nil, err
+		}
+	}
+	lastNew := req.PrevLogIndex + uint64(len(req.Entries))
+	if req.LeaderCommit > n.commitIndex {
+		n.commitIndex = req.LeaderCommit
+		if lastNew < n.commitIndex {
+			n.commitIndex = lastNew
+		}
+		n.notifyApply()
+	}
+	resp.Success = true
+	return resp, nil
+}
+
+func (n *Node) HandleInstallSnapshot(req *InstallSnapshotRequest) (*InstallSnapshotResponse, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.closed {
+		return nil, ErrorNodeClosed
+	}
+	resp := &InstallSnapshotResponse{Term: n.currentTerm}
+	if req.Term < n.currentTerm {
+		return resp, nil
+	}
+	if req.Term > n.currentTerm || n.role != follower {
+		if err := n.becomeFollower(req.Term); err != nil {
+			return nil, err
+		}
+	}
+	resp.Term = n.currentTerm
+	n.leaderId = req.LeaderId
+	n.resetElectionTimer()
+	if req.LastIndex <= n.lastApplied {
+		return resp, nil
+	}
+	if n.installing {
+		return nil, ErrorInstallingSnapshot
+	}
+
+	// restore to a temp dir without the mutex, the archive is streamed by the leader
+	dataDir := filepath.Join(n.config.DirPath, dataDirName)
+	tempDir := dataDir + ".snapshot"
+	n.installing = true
+	n.mutex.Unlock()
+	_ = os.RemoveAll(tempDir)
+	err := KVstore.RestoreFrom(req.Data, tempDir)
+	n.mutex.Lock()
+	n.installing = false
+	if err != nil {
+		return nil, err
+	}
+	// the term may have changed meanwhile, then the snapshot is dropped
+	if n.closed || req.Term != n.currentTerm || req.LastIndex <= n.lastApplied {
+		_ = os.RemoveAll(tempDir)
+		resp.Term = n.currentTerm
+		if n.closed {
+			return nil, ErrorNodeClosed
+		}
+		return resp, nil
+	}
+	n.resetElectionTimer()
+	// replace the state machine
+	if err := n.db.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.RemoveAll(dataDir); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tempDir, dataDir); err != nil {
+		return nil, err
+	}
+	db, err := n.openDB()
+	if err != nil {
+		return nil, err
+	}
+	n.db = db
+
+	if err := n.log.reset(req.LastIndex, req.LastTerm); err != nil {
+		return nil, err
+	}
+	if err := n.log.setApplied(req.LastIndex); err != nil {
+		return nil, err
+	}
+	n.lastApplied = req.LastIndex
+	if n.commitIndex < req.LastIndex {
+		n.commitIndex = req.LastIndex
+	}
+	return resp, nil
+}
@@ -0,0 +1,200 @@
+package raftkv
+
+import (
+	"KVstore"
+	"KVstore/utils"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var testPeers = []string{"node1", "node2", "node3"}
+
+func openTestNode(t *testing.T, dir, id string, transport *InmemTransport) *Node {
+	config := DefaultConfig
+	config.ID = id
+	config.Peers = testPeers
+	config.DirPath = filepath.Join(dir, id)
+	config.Transport = transport
+	config.ElectionTimeout = 150 * time.Millisecond
+	config.HeartbeatInterval = 30 * time.Millisecond
+	config.SnapshotThreshold = 50
+	node, err := Open(config)
+	assert.Nil(t, err)
+	return node
+}
+
+// wait until one of the connected nodes is the leader
+func waitForLeader(t *testing.T, nodes map[string]*Node, transport *InmemTransport) *Node {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for id, node := range nodes {
+			if _, err := transport.handler(id, id); err != nil {
+				continue
+			}
+			if _, isLeader := node.State(); isLeader {
+				return node
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no leader is elected")
+	return nil
+}
+
+func waitForApplied(t *testing.T, node *Node, index uint64) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if node.AppliedIndex() >= index {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("entries are not applied")
+}
+
+func TestCluster_Failover(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "raftkv-cluster")
+	defer os.RemoveAll(dir)
+	transport := NewInmemTransport()
+	nodes := make(map[string]*Node)
+	for _, id := range testPeers {
+		nodes[id] = openTestNode(t, dir, id, transport)
+	}
+	defer func() {
+		for _, node := range nodes {
+			_ = node.Close()
+		}
+	}()
+
+	leader := waitForLeader(t, nodes, transport)
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, leader.Put(utils.GetTestKey(i), []byte(fmt.Sprint(i))))
+	}
+	err := leader.Apply([]Op{
+		{Type: OpPut, Key: []byte("batch-1"), Value: []byte("a")},
+		{Type: OpPut, Key: []byte("batch-2"), Value: []byte("b")},
+		{Type: OpDelete, Key: utils.GetTestKey(0)},
+	})
+	assert.Nil(t, err)
+	for _, node := range nodes {
+		if node != leader {
+			assert.Equal(t, ErrorNotLeader, node.Put([]byte("key"), []byte("value")))
+		}
+	}
+	for _, node := range nodes {
+		waitForApplied(t, node, leader.AppliedIndex())
+		assert.Equal(t, 21, len(node.ListKeys()))
+	}
+
+	// the leader is partitioned away, the others elect a new one
+	oldLeader := leader
+	transport.Disconnect(oldLeader.config.ID)
+	leader = waitForLeader(t, nodes, transport)
+	assert.NotEqual(t, oldLeader, leader)
+	for i := 20; i < 100; i++ {
+		assert.Nil(t, leader.Put(utils.GetTestKey(i), []byte(fmt.Sprint(i))))
+	}
+	// writes to the old leader can't be committed
+	oldLeader.config.ApplyTimeout = 200 * time.Millisecond
+	err = oldLeader.Put([]byte("lost"), []byte("lost"))
+	assert.NotNil(t, err)
+
+	// the old leader catches up after the partition heals, by a snapshot
+	// since the log is compacted
+	transport.Connect(oldLeader.config.ID)
+	waitForApplied(t, oldLeader, leader.AppliedIndex())
+	_, isLeader := oldLeader.State()
+	assert.False(t, isLeader)
+	val, err := oldLeader.Get(utils.GetTestKey(99))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("99"), val)
+	_, err = oldLeader.Get([]byte("lost"))
+	assert.NotNil(t, err)
+	assert.Equal(t, 101, len(oldLeader.ListKeys()))
+}
+
+func TestCluster_Restart(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "raftkv-restart")
+	defer os.RemoveAll(dir)
+	transport := NewInmemTransport()
+	nodes := make(map[string]*Node)
+	for _, id := range testPeers {
+		nodes[id] = openTestNode(t, dir, id, transport)
+	}
+	leader := waitForLeader(t, nodes, transport)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, leader.Put(utils.GetTestKey(i), utils.RandomValue(16)))
+	}
+	applied := leader.AppliedIndex()
+	for _, node := range nodes {
+		waitForApplied(t, node, applied)
+	}
+	for _, node := range nodes {
+		assert.Nil(t, node.Close())
+	}
+
+	// state and log are recovered from disk
+	for _, id := range testPeers {
+		nodes[id] = openTestNode(t, dir, id, transport)
+		assert.Equal(t, 10, len(nodes[id].ListKeys()))
+	}
+	defer func() {
+		for _, node := range nodes {
+			_ = node.Close()
+		}
+	}()
+	leader = waitForLeader(t, nodes, transport)
+	assert.Nil(t, leader.Put([]byte("after-restart"), []byte("ok")))
+	val, err := leader.Get([]byte("after-restart"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("ok"), val)
+}
+
+func TestLogStore_Compact(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "raftkv-log")
+	defer os.RemoveAll(dir)
+	configs := KVstore.DefaultConfigs
+	configs.DirPath = dir
+	configs.SyncWrites = true
+	ls, err := openLogStore(configs)
+	assert.Nil(t, err)
+
+	var entries []*Entry
+	for i := uint64(1); i <= 100; i++ {
+		entries = append(entries, &Entry{Index: i, Term: 1, Command: []byte(fmt.Sprint(i))})
+	}
+	assert.Nil(t, ls.append(entries))
+	assert.Nil(t, ls.compact(60, 1))
+	assert.Equal(t, uint64(61), ls.firstIndex())
+	_, err = ls.entry(60)
+	assert.Equal(t, KVstore.ErrorKeyNotFound, err)
+	entry, err := ls.entry(61)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("61"), entry.Command)
+	assert.Nil(t, ls.close())
+
+	ls, err = openLogStore(configs)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(60), ls.snapIndex)
+	assert.Equal(t, uint64(100), ls.lastIndex)
+
+	// a snapshot past the end of the log drops all entries
+	assert.Nil(t, ls.reset(200, 2))
+	assert.Equal(t, uint64(200), ls.lastIndex)
+	_, err = ls.entry(100)
+	assert.Equal(t, KVstore.ErrorKeyNotFound, err)
+	assert.Nil(t, ls.close())
+
+	ls, err = openLogStore(configs)
+	defer ls.close()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(200), ls.snapIndex)
+	assert.Equal(t, uint64(200), ls.lastIndex)
+	term, err := ls.lastTerm()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), term)
+}
@@ -0,0 +1,129 @@
+package raftkv
+
+import (
+	"io"
+	"sync"
+)
+
+type RequestVoteRequest struct {
+	Term         uint64
+	CandidateId  string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+type RequestVoteResponse struct {
+	Term        uint64
+	VoteGranted bool
+}
+type AppendEntriesRequest struct {
+	Term         uint64
+	LeaderId     string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []*Entry
+	LeaderCommit uint64
+}
+type AppendEntriesResponse struct {
+	Term    uint64
+	Success bool
+	// where the leader should retry from if not success
+	ConflictIndex uint64
+}
+
+// InstallSnapshotRequest carries the whole state machine as a BackupTo archive,
+// it is streamed, the handler reads Data before it returns
+type InstallSnapshotRequest struct {
+	Term      uint64
+	LeaderId  string
+	LastIndex uint64 // the snapshot contains entries up to here
+	LastTerm  uint64
+	Data      io.Reader
+}
+type InstallSnapshotResponse struct {
+	Term uint64
+}
+
+// Handler handles rpcs received by the transport, implemented by Node
+type Handler interface {
+	HandleRequestVote(req *RequestVoteRequest) (*RequestVoteResponse, error)
+	HandleAppendEntries(req *AppendEntriesRequest) (*AppendEntriesResponse, error)
+	HandleInstallSnapshot(req *InstallSnapshotRequest) (*InstallSnapshotResponse, error)
+}
+
+// Transport sends rpcs to other nodes by their id
+type Transport interface {
+	// Register the handler of the local node id
+	Register(id string, handler Handler)
+	RequestVote(target string, req *RequestVoteRequest) (*RequestVoteResponse, error)
+	AppendEntries(target string, req *AppendEntriesRequest) (*AppendEntriesResponse, error)
+	InstallSnapshot(target string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error)
+}
+
+// InmemTransport connects nodes in the same process, rpcs are direct calls.
+// A node can be disconnected to simulate a network partition.
+type InmemTransport struct {
+	mutex        *sync.RWMutex
+	handlers     map[string]Handler
+	disconnected map[string]bool
+}
+
+func NewInmemTransport() *InmemTransport {
+	return &InmemTransport{
+		mutex:        new(sync.RWMutex),
+		handlers:     make(map[string]Handler),
+		disconnected: make(map[string]bool),
+	}
+}
+
+func (t *InmemTransport) Register(id string, handler Handler) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.handlers[id] = handler
+}
+
+// Disconnect drop all rpcs from and to the node
+func (t *InmemTransport) Disconnect(id string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.disconnected[id] = true
+}
+
+func (t *InmemTransport) Connect(id string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.disconnected, id)
+}
+
+func (t *InmemTransport) RequestVote(target string, req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	handler, err := t.handler(req.CandidateId, target)
+	if err != nil {
+		return nil, err
+	}
+	return handler.HandleRequestVote(req)
+}
+
+func (t *InmemTransport) AppendEntries(target string, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	handler, err := t.handler(req.LeaderId, target)
+	if err != nil {
+		return nil, err
+	}
+	return handler.HandleAppendEntries(req)
+}
+
+func (t *InmemTransport) InstallSnapshot(target string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error) {
+	handler, err := t.handler(req.LeaderId, target)
+	if err != nil {
+		return nil, err
+	}
+	return handler.HandleInstallSnapshot(req)
+}
+
+func (t *InmemTransport) handler(from, to string) (Handler, error) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	handler, ok := t.handlers[to]
+	if !ok || t.disconnected[from] || t.disconnected[to] {
+		return nil, ErrorUnreachable
+	}
+	return handler, nil
+}
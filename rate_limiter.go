@@ -0,0 +1,90 @@
+package KVstore
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter token bucket of bytes shared by merge, backup and, if
+// Configs.RateLimitWrites, foreground writes. A nil limiter never waits.
+type rateLimiter struct {
+	mutex  sync.Mutex
+	rate   int64 // bytes per second, 0 means no limit
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+func (l *rateLimiter) setRate(rate int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.refill()
+	l.rate = rate
+	if l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+}
+
+// at most one second of tokens are saved up
+// need a mutex before reaching this func
+func (l *rateLimiter) refill() {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+}
+
+// wait until n bytes may be done, n larger than the bucket is taken as a debt
+// which later callers wait for. Return ctx.Err() if ctx is done first.
+func (l *rateLimiter) wait(ctx context.Context, n int64) error {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	if l.rate <= 0 {
+		l.mutex.Unlock()
+		return nil
+	}
+	l.refill()
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	}
+	l.mutex.Unlock()
+	if delay == 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// waitWrite is called before taking the db mutex for a write of about size bytes,
+// waiting for write stall and the rate limit there doesn't hold back the others
+func (db *DB) waitWrite(ctx context.Context, size int64) error {
+	if err := db.waitWriteStall(ctx); err != nil {
+		return err
+	}
+	if !db.config.RateLimitWrites {
+		return nil
+	}
+	return db.limiter.wait(ctx, size)
+}
+
+// SetRateLimit change Configs.RateLimit at runtime, in bytes per second,
+// 0 means no limit. Waiting merge and backup see it on their next write.
+func (db *DB) SetRateLimit(bytesPerSecond int64) {
+	db.limiter.setRate(bytesPerSecond)
+}
@@ -0,0 +1,92 @@
+package KVstore
+
+import (
+	"KVstore/utils"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var nilLimiter *rateLimiter
+	assert.Nil(t, nilLimiter.wait(context.Background(), 1<<30))
+
+	limiter := newRateLimiter(10000)
+	start := time.Now()
+	// the bucket starts full
+	assert.Nil(t, limiter.wait(context.Background(), 10000))
+	assert.Less(t, time.Since(start), 50*time.Millisecond)
+	assert.Nil(t, limiter.wait(context.Background(), 2000))
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, limiter.wait(ctx, 1<<20))
+
+	limiter.setRate(0)
+	start = time.Now()
+	assert.Nil(t, limiter.wait(context.Background(), 1<<30))
+	assert.Less(t, time.Since(start), 50*time.Millisecond)
+}
+
+func TestDB_RateLimit(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-rate-limit")
+	opts.DirPath = dir
+	opts.RateLimit = 100 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	// foreground writes are not limited
+	start := time.Now()
+	for i := 0; i < 150; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(1024)))
+	}
+	assert.Less(t, time.Since(start), 300*time.Millisecond)
+
+	start = time.Now()
+	assert.Nil(t, db.BackupTo(io.Discard))
+	assert.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+
+	db.SetRateLimit(0)
+	start = time.Now()
+	assert.Nil(t, db.BackupTo(io.Discard))
+	assert.Less(t, time.Since(start), 300*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	db.SetRateLimit(1024)
+	assert.Equal(t, context.DeadlineExceeded, db.BackupToContext(ctx, io.Discard))
+}
+
+func TestDB_RateLimitWrites(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-rate-limit-writes")
+	opts.DirPath = dir
+	opts.RateLimit = 1024
+	opts.RateLimitWrites = true
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	// the bucket is full on open
+	assert.Nil(t, db.Put(utils.GetTestKey(0), utils.RandomValue(1000)))
+
+	// the writer waits for the limit before taking the db mutex
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- db.PutContext(ctx, utils.GetTestKey(1), utils.RandomValue(1000))
+	}()
+	time.Sleep(20 * time.Millisecond)
+	start := time.Now()
+	_, err = db.Get(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+	assert.Equal(t, context.DeadlineExceeded, <-done)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrorKeyNotFound, err)
+}
@@ -0,0 +1,266 @@
+package KVstore
+
+import (
+	"KVstore/data"
+	"KVstore/fio"
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+Replication protocol, the follower keeps the same file/offset layout as the leader,
+so a position in the log is (fid, offset) on both sides.
+follower -> leader: fid(4) offset(8)
+leader -> follower: status(1), then frames until the connection is closed
+frame: fid(4) offset(8) remaining(8) length(4) || raw bytes of the data file
+a frame without bytes is a heartbeat
+*/
+const (
+	replicationHandshakeSize   = 12
+	replicationFrameHeaderSize = 24
+	// max raw bytes in a frame
+	replicationChunkSize = 64 * 1024
+	// the leader sends a heartbeat if there is nothing to send for this long
+	replicationHeartbeatInterval = 500 * time.Millisecond
+	// the follower reconnects if nothing is received for this long
+	replicationTimeout = 3 * replicationHeartbeatInterval
+)
+
+const (
+	replicationStatusOK byte = iota
+	replicationStatusCompacted
+)
+
+type replicationFrame struct {
+	fid       uint32
+	offset    int64
+	remaining int64 // bytes of the leader log after this frame
+	data      []byte
+}
+
+// ServeReplication accept followers on l and stream data files to them,
+// it blocks until l is closed. Followers are disconnected when the db is closed.
+func (db *DB) ServeReplication(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go db.serveFollower(conn)
+	}
+}
+
+func (db *DB) serveFollower(conn net.Conn) {
+	defer conn.Close()
+	var handshake [replicationHandshakeSize]byte
+	if _, err := io.ReadFull(conn, handshake[:]); err != nil {
+		return
+	}
+	fid := binary.BigEndian.Uint32(handshake[0:4])
+	offset := int64(binary.BigEndian.Uint64(handshake[4:12]))
+	// files before the position are replaced by merge, the follower must be rebuilt
+	status := replicationStatusOK
+	if fid != 0 || offset != 0 {
+		if _, err := os.Stat(filepath.Join(db.config.DirPath, data.MergeFinishedFileName)); err == nil {
+			nonMergeFileId, err := getNonMergeFileID(db.config.DirPath)
+			if err != nil || fid < nonMergeFileId {
+				status = replicationStatusCompacted
+			}
+		}
+	}
+	if _, err := conn.Write([]byte{status}); err != nil || status != replicationStatusOK {
+		return
+	}
+	// the follower never sends anything after the handshake, EOF means it is gone
+	gone := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(io.Discard, conn)
+		close(gone)
+	}()
+
+	sender := &replicationSender{
+		db:     db,
+		w:      bufio.NewWriter(conn),
+		fid:    fid,
+		offset: offset,
+		files:  make(map[uint32]*data.File),
+		sizes:  make(map[uint32]int64),
+	}
+	defer sender.close()
+	for {
+		state := db.getChangeState()
+		if err := sender.sendUntil(state); err != nil {
+			return
+		}
+		if state.closed {
+			return
+		}
+		select {
+		case <-state.changed:
+		case <-gone:
+			return
+		case <-time.After(replicationHeartbeatInterval):
+			if err := sender.heartbeat(state); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// replicationSender reads data files by its own fd and sends them to a follower
+type replicationSender struct {
+	db     *DB
+	w      *bufio.Writer
+	fid    uint32 // where to send next
+	offset int64
+	files  map[uint32]*data.File
+	sizes  map[uint32]int64 // sizes of sealed files
+}
+
+// send the log from the current position to the end of the active file in state
+func (rs *replicationSender) sendUntil(state *changeState) error {
+	ends, err := rs.fileEnds(state)
+	if err != nil {
+		return err
+	}
+	remaining := rs.remaining(state, ends)
+	buf := make([]byte, replicationChunkSize)
+	for _, fid := range state.fileIds {
+		if fid < rs.fid {
+			continue
+		}
+		if fid > rs.fid {
+			rs.fid, rs.offset = fid, 0
+		}
+		file := rs.files[fid]
+		for rs.offset < ends[fid] {
+			n := ends[fid] - rs.offset
+			if n > replicationChunkSize {
+				n = replicationChunkSize
+			}
+			if _, err := file.IOManager.Read(buf[:n], rs.offset); err != nil {
+				return err
+			}
+			remaining -= n
+			if err := writeReplicationFrame(rs.w, &replicationFrame{
+				fid:       fid,
+				offset:    rs.offset,
+				remaining: remaining,
+				data:      buf[:n],
+			}); err != nil {
+				return err
+			}
+			rs.offset += n
+		}
+		// sealed files never change
+		if fid != state.activeFid {
+			_ = file.Close()
+			delete(rs.files, fid)
+		}
+	}
+	return rs.w.Flush()
+}
+
+func (rs *replicationSender) heartbeat(state *changeState) error {
+	ends, err := rs.fileEnds(state)
+	if err != nil {
+		return err
+	}
+	if err := writeReplicationFrame(rs.w, &replicationFrame{
+		fid:       rs.fid,
+		offset:    rs.offset,
+		remaining: rs.remaining(state, ends),
+	}); err != nil {
+		return err
+	}
+	return rs.w.Flush()
+}
+
+// open files from the current position and get where they end
+func (rs *replicationSender) fileEnds(state *changeState) (map[uint32]int64, error) {
+	ends := make(map[uint32]int64)
+	for _, fid := range state.fileIds {
+		if fid < rs.fid {
+			continue
+		}
+		if _, ok := rs.files[fid]; !ok {
+			file, err := data.OpenReadOnlyFile(rs.db.config.DirPath, fid, fio.StandardIO)
+			if err != nil {
+				return nil, err
+			}
+			rs.files[fid] = file
+		}
+		if fid == state.activeFid {
+			ends[fid] = state.activeOffset
+			continue
+		}
+		if _, ok := rs.sizes[fid]; !ok {
+			size, err := rs.files[fid].IOManager.Size()
+			if err != nil {
+				return nil, err
+			}
+			rs.sizes[fid] = size
+		}
+		ends[fid] = rs.sizes[fid]
+	}
+	return ends, nil
+}
+
+// bytes of the log after the current position
+func (rs *replicationSender) remaining(state *changeState, ends map[uint32]int64) int64 {
+	var remaining int64 = 0
+	for _, fid := range state.fileIds {
+		if fid >= rs.fid {
+			remaining += ends[fid]
+		}
+	}
+	if _, ok := ends[rs.fid]; ok {
+		remaining -= rs.offset
+	}
+	return remaining
+}
+
+func (rs *replicationSender) close() {
+	for _, file := range rs.files {
+		_ = file.Close()
+	}
+}
+
+func writeReplicationFrame(w io.Writer, frame *replicationFrame) error {
+	var header [replicationFrameHeaderSize]byte
+	binary.BigEndian.PutUint32(header[0:4], frame.fid)
+	binary.BigEndian.PutUint64(header[4:12], uint64(frame.offset))
+	binary.BigEndian.PutUint64(header[12:20], uint64(frame.remaining))
+	binary.BigEndian.PutUint32(header[20:24], uint32(len(frame.data)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(frame.data)
+	return err
+}
+
+func readReplicationFrame(r io.Reader) (*replicationFrame, error) {
+	var header [replicationFrameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	frame := &replicationFrame{
+		fid:       binary.BigEndian.Uint32(header[0:4]),
+		offset:    int64(binary.BigEndian.Uint64(header[4:12])),
+		remaining: int64(binary.BigEndian.Uint64(header[12:20])),
+	}
+	length := binary.BigEndian.Uint32(header[20:24])
+	if length > replicationChunkSize {
+		return nil, ErrorReplicationProtocol
+	}
+	frame.data = make([]byte, length)
+	if _, err := io.ReadFull(r, frame.data); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
@@ -0,0 +1,104 @@
+package KVstore
+
+import (
+	"KVstore/data"
+	"KVstore/utils"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// wait until the follower applied the whole log of the leader
+func waitForSync(t *testing.T, leader *DB, follower *Follower) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		fid, offset := follower.appliedPosition()
+		leader.mutex.RLock()
+		synced := leader.activeFile.FileId == fid && leader.activeFile.WriteOffset == offset
+		leader.mutex.RUnlock()
+		if synced && follower.Stat().LagBytes == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("follower is not synced")
+}
+
+func TestDB_Replication(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-leader")
+	opts.DirPath = dir + "/"
+	opts.DataFileSize = 32 * 1024
+	leader, err := Open(opts)
+	defer destroyDB(leader)
+	assert.Nil(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	go leader.ServeReplication(listener)
+
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, leader.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+	}
+	followerOpts := DefaultConfigs
+	followerDir, _ := os.MkdirTemp("", "bitcask-go-follower")
+	followerOpts.DirPath = followerDir + "/"
+	followerOpts.DataFileSize = opts.DataFileSize
+	follower, err := OpenFollower(followerOpts, listener.Addr().String())
+	assert.Nil(t, err)
+	waitForSync(t, leader, follower)
+	assert.True(t, follower.Stat().Connected)
+
+	// live writes, batches and deletes
+	wb := leader.NewWriteBatch(DefaultWriteBatchConfigs)
+	for i := 500; i < 600; i++ {
+		assert.Nil(t, wb.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+	}
+	assert.Nil(t, wb.Commit())
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, leader.Delete(utils.GetTestKey(i)))
+	}
+	waitForSync(t, leader, follower)
+	assert.Equal(t, 500, len(follower.ListKeys()))
+	val, err := follower.Get(utils.GetTestKey(550))
+	assert.Nil(t, err)
+	expected, _ := leader.Get(utils.GetTestKey(550))
+	assert.Equal(t, expected, val)
+	_, err = follower.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrorKeyNotFound, err)
+	iter := follower.NewIterator(DefaultIteratorConfigs)
+	assert.Equal(t, utils.GetTestKey(100), iter.Key())
+	iter.Close()
+
+	// data files have the same layout
+	for fid := range leader.olderFiles {
+		leaderInfo, err := os.Stat(data.GetDataFileName(opts.DirPath, fid))
+		assert.Nil(t, err)
+		followerInfo, err := os.Stat(data.GetDataFileName(followerOpts.DirPath, fid))
+		assert.Nil(t, err)
+		assert.Equal(t, leaderInfo.Size(), followerInfo.Size())
+	}
+
+	// restart the follower, it resumes from its own log
+	assert.Nil(t, follower.Close())
+	for i := 600; i < 700; i++ {
+		assert.Nil(t, leader.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+	}
+	follower, err = OpenFollower(followerOpts, listener.Addr().String())
+	assert.Nil(t, err)
+	waitForSync(t, leader, follower)
+	assert.Equal(t, 600, len(follower.ListKeys()))
+
+	// promote the follower, it accepts writes then
+	promoted, err := follower.Promote()
+	assert.Nil(t, err)
+	defer destroyDB(promoted)
+	assert.Nil(t, promoted.Put(utils.GetTestKey(1000), []byte("promoted")))
+	val, err = promoted.Get(utils.GetTestKey(1000))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("promoted"), val)
+	_, err = leader.Get(utils.GetTestKey(1000))
+	assert.Equal(t, ErrorKeyNotFound, err)
+}
@@ -0,0 +1,277 @@
+package KVstore
+
+import (
+	"KVstore/data"
+	"KVstore/fio"
+	"KVstore/index"
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Restore copy the backup in backupDir to targetDir, all files are checked
+// against the backup manifest. targetDir must be empty or not exist.
+// With configs, the restored db ends at an earlier point of the log.
+// A backup of B+ tree index has the index file in it, open the restored db
+// with IndexerDirPath set to targetDir. It can't be restored to an earlier point.
+func Restore(backupDir, targetDir string, configs RestoreConfigs) error {
+	manifest, err := ReadBackupManifest(backupDir)
+	if err != nil {
+		return err
+	}
+	// every record of the backup is written before it is created
+	toRestorePoint := configs.SeqNo != NonTxnSeqNo ||
+		!configs.Timestamp.IsZero() && configs.Timestamp.Before(manifest.CreatedAt)
+	for _, file := range manifest.Files {
+		// positions in the index may be after the restore point
+		if toRestorePoint && file.Name == index.BPTreeIndexFileName {
+			return ErrorRestorePointUnsupported
+		}
+	}
+	if entries, err := os.ReadDir(targetDir); err == nil && len(entries) > 0 {
+		return ErrorRestoreDirNotEmpty
+	}
+	if err := os.MkdirAll(targetDir, os.ModePerm); err != nil {
+		return err
+	}
+	if err := restoreFiles(backupDir, targetDir, manifest); err != nil {
+		_ = os.RemoveAll(targetDir)
+		return err
+	}
+	if !toRestorePoint {
+		return nil
+	}
+	if err := truncateToRestorePoint(targetDir, configs); err != nil {
+		_ = os.RemoveAll(targetDir)
+		return err
+	}
+	return nil
+}
+
+// RestoreFrom restore the tar archive written by BackupTo to dir,
+// dir must be empty or not exist. Files are checked against the manifest
+// in the archive, and the manifest is kept in dir so that it is also a backup dir.
+func RestoreFrom(r io.Reader, dir string) error {
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return ErrorRestoreDirNotEmpty
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	if err := restoreTarFiles(r, dir); err != nil {
+		_ = os.RemoveAll(dir)
+		return err
+	}
+	return nil
+}
+
+func restoreTarFiles(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	files := make(map[string]BackupFile)
+	var manifest *BackupManifest
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		// only plain file names, never write out of dir
+		if header.Typeflag != tar.TypeReg || filepath.Base(header.Name) != header.Name {
+			return ErrorBackupCorrupted
+		}
+		if header.Name == BackupManifestFileName {
+			buf, err := io.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			manifest = new(BackupManifest)
+			if err := json.Unmarshal(buf, manifest); err != nil {
+				return ErrorBackupCorrupted
+			}
+			continue
+		}
+		file, err := os.OpenFile(filepath.Join(dir, header.Name), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		hash := crc32.NewIEEE()
+		size, err := io.Copy(io.MultiWriter(file, hash), tr)
+		if err == nil {
+			err = file.Sync()
+		}
+		_ = file.Close()
+		if err != nil {
+			return err
+		}
+		files[header.Name] = BackupFile{Name: header.Name, Size: size, CRC: hash.Sum32()}
+	}
+
+	if manifest == nil || len(manifest.Files) != len(files) {
+		return ErrorBackupCorrupted
+	}
+	for _, expected := range manifest.Files {
+		file, ok := files[expected.Name]
+		if !ok || file.Size != expected.Size || file.CRC != expected.CRC {
+			return ErrorBackupCorrupted
+		}
+	}
+	return writeBackupManifest(dir, manifest)
+}
+
+// copy files in the manifest, and check their size and crc
+func restoreFiles(backupDir, targetDir string, manifest *BackupManifest) error {
+	for _, file := range manifest.Files {
+		info, err := os.Stat(filepath.Join(backupDir, file.Name))
+		if err != nil {
+			return err
+		}
+		if info.Size() != file.Size {
+			return ErrorBackupCorrupted
+		}
+		copied, err := copyBackupFile(context.Background(), nil, backupDir, targetDir,
+			backupSource{name: file.Name, size: file.Size}, BackupFile{})
+		if err != nil {
+			return err
+		}
+		if copied.CRC != file.CRC {
+			return ErrorBackupCorrupted
+		}
+	}
+	return nil
+}
+
+// truncateToRestorePoint find the WriteBatch commit to restore to,
+// then drop all records after it. Merged files lost the order of records,
+// so the restore point can only be in files written after the last merge.
+func truncateToRestorePoint(dir string, configs RestoreConfigs) error {
+	fileIds, err := getDataFileIds(dir)
+	if err != nil {
+		return err
+	}
+	var nonMergeFileId uint32 = 0
+	if _, err := os.Stat(filepath.Join(dir, data.MergeFinishedFileName)); err == nil {
+		if nonMergeFileId, err = getNonMergeFileID(dir); err != nil {
+			return err
+		}
+	}
+
+	found := false
+	var cutFileId uint32
+	var cutOffset int64
+	// writes out of batches since the last commit
+	plainWrites := false
+	for _, id := range fileIds {
+		if id < nonMergeFileId {
+			continue
+		}
+		file, err := data.OpenFile(dir, id, fio.StandardIO)
+		if err != nil {
+			return err
+		}
+		stop, err := findRestorePoint(file, configs, &plainWrites, func(offset int64) {
+			found, cutFileId, cutOffset = true, id, offset
+		})
+		_ = file.Close()
+		if err != nil {
+			return err
+		}
+		if stop {
+			break
+		}
+	}
+	// the writes after the last commit may be before the restore time or not
+	if configs.SeqNo == NonTxnSeqNo && plainWrites {
+		return ErrorRestorePointAmbiguous
+	}
+	if !found {
+		return ErrorRestorePointNotFound
+	}
+
+	if err := os.Truncate(data.GetDataFileName(dir, cutFileId), cutOffset); err != nil {
+		return err
+	}
+	for _, id := range fileIds {
+		if id > cutFileId {
+			if err := os.Remove(data.GetDataFileName(dir, id)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// findRestorePoint call setCut with the end of every commit that can be restored to,
+// plainWrites is set by writes out of batches and cleared by commits before the time,
+// return true if the scan can stop
+func findRestorePoint(file *data.File, configs RestoreConfigs, plainWrites *bool, setCut func(offset int64)) (bool, error) {
+	var offset int64 = 0
+	for {
+		logRecord, size, err := file.Read(offset)
+		if err != nil {
+			if err == io.EOF {
+				return false, nil
+			}
+			return false, err
+		}
+		offset += size
+		_, seqNo := parseKeyWithSeqNo(logRecord.Key)
+		if logRecord.Type != data.COMMIT {
+			if seqNo == NonTxnSeqNo {
+				*plainWrites = true
+			}
+			continue
+		}
+		if configs.SeqNo != NonTxnSeqNo {
+			if seqNo == configs.SeqNo {
+				setCut(offset)
+				return true, nil
+			}
+			continue
+		}
+		// commits written by older versions have no time, skip them
+		commitTime, err := strconv.ParseInt(string(logRecord.Value), 10, 64)
+		if err != nil {
+			continue
+		}
+		if time.Unix(0, commitTime).After(configs.Timestamp) {
+			if *plainWrites {
+				return true, ErrorRestorePointAmbiguous
+			}
+			return true, nil
+		}
+		setCut(offset)
+		*plainWrites = false
+	}
+}
+
+// get sorted ids of data files in dir
+func getDataFileIds(dir string) ([]uint32, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var fileIds []uint32
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), data.FileSuffix) {
+			fileId, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), data.FileSuffix))
+			if err != nil {
+				return nil, ErrorParse
+			}
+			fileIds = append(fileIds, uint32(fileId))
+		}
+	}
+	sort.Slice(fileIds, func(i, j int) bool {
+		return fileIds[i] < fileIds[j]
+	})
+	return fileIds, nil
+}
@@ -0,0 +1,157 @@
+package KVstore
+
+import (
+	"KVstore/index"
+	"KVstore/utils"
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRestore(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-restore")
+	opts.DirPath = dir + "/"
+	opts.DataFileSize = 4 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// three batches, each followed by a plain Put
+	var commitTimes []time.Time
+	for i := 0; i < 3; i++ {
+		wb := db.NewWriteBatch(DefaultWriteBatchConfigs)
+		for j := 0; j < 20; j++ {
+			err := wb.Put(utils.GetTestKey(i*100+j), utils.RandomValue(64))
+			assert.Nil(t, err)
+		}
+		err = wb.Commit()
+		assert.Nil(t, err)
+		commitTimes = append(commitTimes, time.Now())
+		err = db.Put(utils.GetTestKey(i*100+50), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	// two more batches without a plain Put between them
+	for i := 3; i < 5; i++ {
+		wb := db.NewWriteBatch(DefaultWriteBatchConfigs)
+		for j := 0; j < 20; j++ {
+			assert.Nil(t, wb.Put(utils.GetTestKey(i*100+j), utils.RandomValue(64)))
+		}
+		assert.Nil(t, wb.Commit())
+		commitTimes = append(commitTimes, time.Now())
+	}
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-restore-backup")
+	defer os.RemoveAll(backupDir)
+	err = db.Backup(backupDir)
+	assert.Nil(t, err)
+
+	restoreAndCount := func(configs RestoreConfigs) (int, error) {
+		target := filepath.Join(os.TempDir(), "bitcask-go-restore-target")
+		defer os.RemoveAll(target)
+		if err := Restore(backupDir, target, configs); err != nil {
+			return 0, err
+		}
+		restoreOpts := DefaultConfigs
+		restoreOpts.DirPath = target
+		db, err := Open(restoreOpts)
+		if err != nil {
+			return 0, err
+		}
+		defer db.Close()
+		return len(db.ListKeys()), nil
+	}
+
+	// 1.restore all
+	n, err := restoreAndCount(DefaultRestoreConfigs)
+	assert.Nil(t, err)
+	assert.Equal(t, 103, n)
+
+	// 2.restore to the commit of the second batch
+	n, err = restoreAndCount(RestoreConfigs{SeqNo: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, 41, n)
+
+	// 3.restore to a time between the last two batches
+	n, err = restoreAndCount(RestoreConfigs{Timestamp: commitTimes[3]})
+	assert.Nil(t, err)
+	assert.Equal(t, 83, n)
+	n, err = restoreAndCount(RestoreConfigs{Timestamp: time.Now()})
+	assert.Nil(t, err)
+	assert.Equal(t, 103, n)
+
+	// a plain Put after the first batch has no time, it may be before the restore time
+	_, err = restoreAndCount(RestoreConfigs{Timestamp: commitTimes[0]})
+	assert.Equal(t, ErrorRestorePointAmbiguous, err)
+
+	// 4.no such point
+	_, err = restoreAndCount(RestoreConfigs{SeqNo: 10})
+	assert.Equal(t, ErrorRestorePointNotFound, err)
+
+	// 5.broken backup
+	manifest, err := ReadBackupManifest(backupDir)
+	assert.Nil(t, err)
+	buf, err := os.ReadFile(filepath.Join(backupDir, manifest.Files[0].Name))
+	assert.Nil(t, err)
+	buf[0]++
+	err = os.WriteFile(filepath.Join(backupDir, manifest.Files[0].Name), buf, 0644)
+	assert.Nil(t, err)
+	_, err = restoreAndCount(DefaultRestoreConfigs)
+	assert.Equal(t, ErrorBackupCorrupted, err)
+}
+
+func TestRestore_BPTree(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-restore-bptree")
+	opts.DirPath = dir + "/"
+	opts.IndexerDirPath = dir + "/"
+	opts.IndexerType = index.BPTree
+	opts.DataFileSize = 16 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 300; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.Nil(t, db.Delete(utils.GetTestKey(0)))
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-restore-bptree-backup")
+	defer os.RemoveAll(backupDir)
+	assert.Nil(t, db.Backup(backupDir))
+	var buf bytes.Buffer
+	assert.Nil(t, db.BackupTo(&buf))
+	checkpointDir := filepath.Join(os.TempDir(), "bitcask-go-restore-bptree-checkpoint")
+	defer os.RemoveAll(checkpointDir)
+	assert.Nil(t, db.Checkpoint(checkpointDir))
+	// not in the backups
+	assert.Nil(t, db.Put(utils.GetTestKey(1000), []byte("after")))
+
+	openRestored := func(target string) {
+		restoreOpts := opts
+		restoreOpts.DirPath = target
+		restoreOpts.IndexerDirPath = target
+		db2, err := Open(restoreOpts)
+		assert.Nil(t, err)
+		defer db2.Close()
+		assert.Equal(t, 299, len(db2.ListKeys()))
+		_, err = db2.Get(utils.GetTestKey(1000))
+		assert.Equal(t, ErrorKeyNotFound, err)
+		_, err = db2.Get(utils.GetTestKey(299))
+		assert.Nil(t, err)
+	}
+	target := filepath.Join(os.TempDir(), "bitcask-go-restore-bptree-target")
+	defer os.RemoveAll(target)
+	assert.Nil(t, Restore(backupDir, target, DefaultRestoreConfigs))
+	openRestored(target)
+	streamTarget := filepath.Join(os.TempDir(), "bitcask-go-restore-bptree-stream")
+	defer os.RemoveAll(streamTarget)
+	assert.Nil(t, RestoreFrom(bytes.NewReader(buf.Bytes()), streamTarget))
+	openRestored(streamTarget)
+	openRestored(checkpointDir)
+
+	// positions in the index may be after the restore point
+	pointTarget := filepath.Join(os.TempDir(), "bitcask-go-restore-bptree-point")
+	defer os.RemoveAll(pointTarget)
+	assert.Equal(t, ErrorRestorePointUnsupported, Restore(backupDir, pointTarget, RestoreConfigs{SeqNo: 1}))
+}
@@ -0,0 +1,86 @@
+package KVstore
+
+import (
+	"KVstore/data"
+	"KVstore/fio"
+	"os"
+	"time"
+)
+
+// TryCatchUp read records appended by the writer since the last catch up,
+// only in secondary mode. A record the writer is still writing is read next time.
+func (db *DB) TryCatchUp() error {
+	if !db.config.Secondary {
+		return ErrorNotSecondary
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.isClosed {
+		return nil
+	}
+	if db.pendingTxns == nil {
+		db.pendingTxns = make(map[uint64][]*data.TxnRecord)
+	}
+	for {
+		if err := db.catchUpFile(db.activeFile); err != nil {
+			return err
+		}
+		var nextFileId uint32 = 0
+		if db.activeFile != nil {
+			nextFileId = db.activeFile.FileId + 1
+		}
+		_, err := os.Stat(data.GetDataFileName(db.config.DirPath, nextFileId))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// the writer starts a new file after the last one is full and synced,
+		// read the records appended to it since the last read
+		if db.activeFile != nil {
+			if err := db.catchUpFile(db.activeFile); err != nil {
+				return err
+			}
+			db.olderFiles[db.activeFile.FileId] = db.activeFile
+		}
+		dataFile, err := data.OpenReadOnlyFile(db.config.DirPath, nextFileId, fio.StandardIO)
+		if err != nil {
+			return err
+		}
+		db.activeFile = dataFile
+	}
+}
+
+// read file from the last offset read, the WriteOffset of a secondary
+// need a mutex before reaching this func
+func (db *DB) catchUpFile(file *data.File) error {
+	if file == nil {
+		return nil
+	}
+	offset, err := db.replayFile(file, file.WriteOffset, db.pendingTxns)
+	if offset > file.WriteOffset {
+		file.WriteOffset = offset
+		db.notifyChange()
+	}
+	// a record not fully written fails the crc check
+	if err != nil && err != data.ErrorCRC {
+		return err
+	}
+	return nil
+}
+
+func (db *DB) catchUpLoop(interval time.Duration) {
+	defer close(db.catchUpDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.catchUpStop:
+			return
+		case <-ticker.C:
+			// a failed catch up is tried again on the next tick
+			_ = db.TryCatchUp()
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package KVstore
+
+import (
+	"KVstore/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func dirEntries(t *testing.T, dir string) map[string]int64 {
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	sizes := make(map[string]int64)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		assert.Nil(t, err)
+		sizes[entry.Name()] = info.Size()
+	}
+	return sizes
+}
+
+func TestDB_ReadOnly(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-read-only")
+	opts.DirPath = dir
+	opts.DataFileMergeRatio = 0.01
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Delete(utils.GetTestKey(0)))
+	assert.Nil(t, db.Close())
+	before := dirEntries(t, dir)
+
+	readOpts := opts
+	readOpts.ReadOnly = true
+	reader1, err := Open(readOpts)
+	assert.Nil(t, err)
+	reader2, err := Open(readOpts)
+	assert.Nil(t, err)
+	_, err = Open(opts)
+	assert.Equal(t, ErrorDataBaseIsInUse, err)
+
+	val, err := reader2.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(1), val)
+	assert.Equal(t, 99, len(reader1.ListKeys()))
+	assert.Equal(t, ErrorReadOnly, reader1.Put([]byte("key"), []byte("value")))
+	assert.Equal(t, ErrorReadOnly, reader1.Delete(utils.GetTestKey(1)))
+	assert.Equal(t, ErrorReadOnly, reader1.Merge())
+	assert.Equal(t, ErrorReadOnly, reader1.CheckpointIndex())
+	wb := reader1.NewWriteBatch(DefaultWriteBatchConfigs)
+	assert.Nil(t, wb.Put([]byte("key"), []byte("value")))
+	assert.Equal(t, ErrorReadOnly, wb.Commit())
+	assert.Equal(t, ErrorNotSecondary, reader1.TryCatchUp())
+	assert.Nil(t, reader1.Close())
+	assert.Nil(t, reader2.Close())
+	assert.Equal(t, before, dirEntries(t, dir))
+
+	// the writer can open it again
+	db, err = Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	readOpts.DirPath = dir + "-missing"
+	_, err = Open(readOpts)
+	assert.True(t, os.IsNotExist(err))
+}
+
+// a read only dir is opened without creating or writing any file
+func TestDB_ReadOnlyDir(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-read-only-dir")
+	opts.DirPath = dir
+	opts.BloomFilter = true
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Close())
+	assert.Nil(t, os.Remove(filepath.Join(dir, fileLockName)))
+	assert.Nil(t, os.Chmod(dir, 0555))
+	defer func() {
+		_ = os.Chmod(dir, 0755)
+		_ = os.RemoveAll(dir)
+	}()
+	before := dirEntries(t, dir)
+
+	readOpts := opts
+	readOpts.ReadOnly = true
+	readOpts.MMapLoad = true
+	reader, err := Open(readOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, len(reader.ListKeys()))
+	assert.Nil(t, reader.Close())
+
+	secondaryOpts := opts
+	secondaryOpts.Secondary = true
+	secondary, err := Open(secondaryOpts)
+	assert.Nil(t, err)
+	assert.Nil(t, secondary.TryCatchUp())
+	val, err := secondary.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(1), val)
+	assert.Nil(t, secondary.Close())
+	assert.Equal(t, before, dirEntries(t, dir))
+}
+
+func TestDB_Secondary(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-secondary")
+	opts.DirPath = dir
+	opts.DataFileSize = 4 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+
+	secondaryOpts := opts
+	secondaryOpts.Secondary = true
+	secondary, err := Open(secondaryOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, len(secondary.ListKeys()))
+	assert.Equal(t, ErrorReadOnly, secondary.Put([]byte("key"), []byte("value")))
+
+	// records written after open are read by TryCatchUp, across data files
+	for i := 10; i < 200; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.Nil(t, db.Delete(utils.GetTestKey(0)))
+	wb := db.NewWriteBatch(DefaultWriteBatchConfigs)
+	assert.Nil(t, wb.Put([]byte("batch"), []byte("value")))
+	assert.Nil(t, wb.Commit())
+	assert.Equal(t, 10, len(secondary.ListKeys()))
+	assert.Nil(t, secondary.TryCatchUp())
+	assert.Equal(t, 200, len(secondary.ListKeys()))
+	_, err = secondary.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrorKeyNotFound, err)
+	val, err := secondary.Get([]byte("batch"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+	assert.Nil(t, secondary.Close())
+
+	// catch up in the background
+	secondaryOpts.CatchUpInterval = 10 * time.Millisecond
+	secondary, err = Open(secondaryOpts)
+	assert.Nil(t, err)
+	defer secondary.Close()
+	assert.Nil(t, db.Put([]byte("later"), []byte("value")))
+	assert.Eventually(t, func() bool {
+		_, err := secondary.Get([]byte("later"))
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,384 @@
+package KVstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// ShardManifestFileName records the sharding in every shard dir
+const ShardManifestFileName = "SHARD_MANIFEST"
+
+type ShardingType = int8
+
+const (
+	// HashSharding spread keys evenly by the hash of the key
+	HashSharding ShardingType = iota
+	// RangeSharding keep ranges of keys in one shard, split by RangeBoundaries
+	RangeSharding
+)
+
+type ShardedConfigs struct {
+	// one shard for each dir, dirs can be on different disks
+	DirPaths []string
+	// configs of every shard, DirPath and IndexerDirPath are set to the shard dir
+	Configs  Configs
+	Sharding ShardingType
+	// sorted keys splitting the shards for RangeSharding, len(DirPaths)-1 of them,
+	// shard i holds keys in [RangeBoundaries[i-1], RangeBoundaries[i])
+	RangeBoundaries [][]byte
+}
+
+// ShardedDB partitions keys across several DBs, each with its own files and lock,
+// so writes to different shards don't block each other.
+// The number of shards and the sharding can't change once the shards are created,
+// they are checked against the manifest in every shard dir on open.
+type ShardedDB struct {
+	configs ShardedConfigs
+	shards  []*DB
+}
+
+func OpenSharded(configs ShardedConfigs) (*ShardedDB, error) {
+	if err := checkShardedConfigs(&configs); err != nil {
+		return nil, err
+	}
+	sdb := &ShardedDB{configs: configs}
+	for _, dir := range configs.DirPaths {
+		shardConfigs := configs.Configs
+		shardConfigs.DirPath = dir
+		shardConfigs.IndexerDirPath = dir
+		db, err := Open(shardConfigs)
+		if err != nil {
+			_ = sdb.Close()
+			return nil, err
+		}
+		sdb.shards = append(sdb.shards, db)
+	}
+	// checked with the locks of shards held, all of them are checked before
+	// writing any, so that a refused open leaves no manifest behind
+	var missing []int
+	for i, dir := range configs.DirPaths {
+		found, err := checkShardManifest(dir, newShardManifest(&configs, i))
+		if err != nil {
+			_ = sdb.Close()
+			return nil, err
+		}
+		if !found {
+			missing = append(missing, i)
+		}
+	}
+	if configs.Configs.ReadOnly || configs.Configs.Secondary {
+		return sdb, nil
+	}
+	for _, i := range missing {
+		if err := writeShardManifest(configs.DirPaths[i], newShardManifest(&configs, i)); err != nil {
+			_ = sdb.Close()
+			return nil, err
+		}
+	}
+	return sdb, nil
+}
+
+// the sharding of a shard dir, keys are misrouted if it changes
+type shardManifest struct {
+	Shards          int          `json:"shards"`
+	Shard           int          `json:"shard"`
+	Sharding        ShardingType `json:"sharding"`
+	RangeBoundaries [][]byte     `json:"range_boundaries,omitempty"`
+}
+
+func newShardManifest(configs *ShardedConfigs, shard int) *shardManifest {
+	manifest := &shardManifest{Shards: len(configs.DirPaths), Shard: shard, Sharding: configs.Sharding}
+	if configs.Sharding == RangeSharding {
+		manifest.RangeBoundaries = configs.RangeBoundaries
+	}
+	return manifest
+}
+
+func (m *shardManifest) equal(other *shardManifest) bool {
+	if m.Shards != other.Shards || m.Shard != other.Shard || m.Sharding != other.Sharding ||
+		len(m.RangeBoundaries) != len(other.RangeBoundaries) {
+		return false
+	}
+	for i := range m.RangeBoundaries {
+		if !bytes.Equal(m.RangeBoundaries[i], other.RangeBoundaries[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// refuse a shard dir of another sharding, return false if it has no manifest yet
+func checkShardManifest(dir string, expected *shardManifest) (bool, error) {
+	buf, err := os.ReadFile(filepath.Join(dir, ShardManifestFileName))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var manifest shardManifest
+	if err := json.Unmarshal(buf, &manifest); err != nil {
+		return false, ErrorShardManifestCorrupted
+	}
+	if !manifest.equal(expected) {
+		return false, ErrorShardManifestMismatch
+	}
+	return true, nil
+}
+
+// written on the first open of the shard
+func writeShardManifest(dir string, manifest *shardManifest) error {
+	buf, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	fileName := filepath.Join(dir, ShardManifestFileName)
+	// write to a temp file then rename, a crash never leaves a partial manifest
+	tempName := fileName + ".tmp"
+	if err := os.WriteFile(tempName, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tempName, fileName)
+}
+
+func checkShardedConfigs(configs *ShardedConfigs) error {
+	if len(configs.DirPaths) == 0 {
+		return ConfigErrorShards
+	}
+	if configs.Sharding == RangeSharding {
+		if len(configs.RangeBoundaries) != len(configs.DirPaths)-1 {
+			return ConfigErrorShardBoundaries
+		}
+		for i := 1; i < len(configs.RangeBoundaries); i++ {
+			if bytes.Compare(configs.RangeBoundaries[i-1], configs.RangeBoundaries[i]) >= 0 {
+				return ConfigErrorShardBoundaries
+			}
+		}
+	}
+	return nil
+}
+
+// shard index of the key
+func (sdb *ShardedDB) shardOf(key []byte) int {
+	if sdb.configs.Sharding == RangeSharding {
+		boundaries := sdb.configs.RangeBoundaries
+		return sort.Search(len(boundaries), func(i int) bool {
+			return bytes.Compare(key, boundaries[i]) < 0
+		})
+	}
+	h := fnv.New32a()
+	_, _ = h.Write(key)
+	return int(h.Sum32() % uint32(len(sdb.shards)))
+}
+
+func (sdb *ShardedDB) Put(key []byte, value []byte) error {
+	return sdb.shards[sdb.shardOf(key)].Put(key, value)
+}
+func (sdb *ShardedDB) Get(key []byte) ([]byte, error) {
+	return sdb.shards[sdb.shardOf(key)].Get(key)
+}
+func (sdb *ShardedDB) Delete(key []byte) error {
+	return sdb.shards[sdb.shardOf(key)].Delete(key)
+}
+
+// ListKeys keys of all shards in order
+func (sdb *ShardedDB) ListKeys() [][]byte {
+	iterConfigs := DefaultIteratorConfigs
+	iterConfigs.KeyOnly = true
+	iter := sdb.NewIterator(iterConfigs)
+	defer iter.Close()
+	var keys [][]byte
+	for ; iter.Valid(); iter.Next() {
+		keys = append(keys, iter.Key())
+	}
+	return keys
+}
+
+// Stat sum of all shards
+func (sdb *ShardedDB) Stat() *Stat {
+	total := &Stat{}
+	for _, db := range sdb.shards {
+		stat := db.Stat()
+		total.KeyNum += stat.KeyNum
+		total.DataFileNUm += stat.DataFileNUm
+		total.ReclaimableSize += stat.ReclaimableSize
+		total.DiskSize += stat.DiskSize
+		total.IndexMemory += stat.IndexMemory
+		total.BloomLookups += stat.BloomLookups
+		total.BloomNegatives += stat.BloomNegatives
+		total.BloomFalsePositives += stat.BloomFalsePositives
+		// the most stalled shard
+		if stat.WriteStall > total.WriteStall {
+			total.WriteStall = stat.WriteStall
+		}
+	}
+	if total.KeyNum > 0 {
+		total.IndexMemoryPerKey = float64(total.IndexMemory) / float64(total.KeyNum)
+	}
+	return total
+}
+
+func (sdb *ShardedDB) Sync() error {
+	for _, db := range sdb.shards {
+		if err := db.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close all shards, return the first error
+func (sdb *ShardedDB) Close() error {
+	var firstErr error
+	for _, db := range sdb.shards {
+		if err := db.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// ShardedWriteBatch is atomic as a WriteBatch of one shard,
+// all keys of it must be in the same shard
+type ShardedWriteBatch struct {
+	sdb     *ShardedDB
+	configs WriteBatchConfigs
+	shard   int
+	batch   *WriteBatch // created by the first key
+}
+
+func (sdb *ShardedDB) NewWriteBatch(configs WriteBatchConfigs) *ShardedWriteBatch {
+	return &ShardedWriteBatch{sdb: sdb, configs: configs, shard: -1}
+}
+
+func (swb *ShardedWriteBatch) Put(key []byte, value []byte) error {
+	if err := swb.useShard(key); err != nil {
+		return err
+	}
+	return swb.batch.Put(key, value)
+}
+func (swb *ShardedWriteBatch) Delete(key []byte) error {
+	if err := swb.useShard(key); err != nil {
+		return err
+	}
+	return swb.batch.Delete(key)
+}
+func (swb *ShardedWriteBatch) Commit() error {
+	if swb.batch == nil {
+		return nil
+	}
+	return swb.batch.Commit()
+}
+
+func (swb *ShardedWriteBatch) useShard(key []byte) error {
+	if len(key) == 0 {
+		return ErrorKeyEmpty
+	}
+	shard := swb.sdb.shardOf(key)
+	if swb.batch == nil {
+		swb.shard = shard
+		swb.batch = swb.sdb.shards[shard].NewWriteBatch(swb.configs)
+	}
+	if shard != swb.shard {
+		return ErrorCrossShardBatch
+	}
+	return nil
+}
+
+// ShardedIterator merges iterators of all shards in key order,
+// a key is only in one shard so there are no duplicates
+type ShardedIterator struct {
+	iters   []*Iterator
+	reverse bool
+	cur     int // the iterator with the current key, -1 if none
+}
+
+func (sdb *ShardedDB) NewIterator(config IteratorConfigs) *ShardedIterator {
+	it := &ShardedIterator{reverse: config.Reverse}
+	for _, db := range sdb.shards {
+		it.iters = append(it.iters, db.NewIterator(config))
+	}
+	it.pick()
+	return it
+}
+
+func (it *ShardedIterator) Rewind() {
+	for _, iter := range it.iters {
+		iter.Rewind()
+	}
+	it.pick()
+}
+
+// Seek Find the first key that is greater (or less when reverse) than or equal to key
+func (it *ShardedIterator) Seek(key []byte) {
+	for _, iter := range it.iters {
+		iter.Seek(key)
+	}
+	it.pick()
+}
+
+// SeekForPrev Find the last key that is less (or greater when reverse) than or equal to key
+func (it *ShardedIterator) SeekForPrev(key []byte) {
+	// the closest key to key wins, opposite to the iterating order
+	it.cur = -1
+	for i, iter := range it.iters {
+		iter.SeekForPrev(key)
+		if iter.Valid() && (it.cur < 0 || it.before(it.iters[it.cur].Key(), iter.Key())) {
+			it.cur = i
+		}
+	}
+	if it.cur < 0 {
+		return
+	}
+	// other shards continue after the found key
+	found := it.iters[it.cur].Key()
+	for i, iter := range it.iters {
+		if i != it.cur {
+			iter.Seek(found)
+		}
+	}
+}
+
+func (it *ShardedIterator) Next() {
+	if it.cur < 0 {
+		return
+	}
+	it.iters[it.cur].Next()
+	it.pick()
+}
+func (it *ShardedIterator) Valid() bool {
+	return it.cur >= 0
+}
+func (it *ShardedIterator) Key() []byte {
+	return it.iters[it.cur].Key()
+}
+func (it *ShardedIterator) Value() ([]byte, error) {
+	return it.iters[it.cur].Value()
+}
+func (it *ShardedIterator) Close() {
+	for _, iter := range it.iters {
+		iter.Close()
+	}
+}
+
+// choose the iterator with the smallest (largest when reverse) key
+func (it *ShardedIterator) pick() {
+	it.cur = -1
+	for i, iter := range it.iters {
+		if iter.Valid() && (it.cur < 0 || it.before(iter.Key(), it.iters[it.cur].Key())) {
+			it.cur = i
+		}
+	}
+}
+
+// whether a comes before b in the iterating order
+func (it *ShardedIterator) before(a, b []byte) bool {
+	if it.reverse {
+		return bytes.Compare(a, b) > 0
+	}
+	return bytes.Compare(a, b) < 0
+}
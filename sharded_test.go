@@ -0,0 +1,137 @@
+package KVstore
+
+import (
+	"KVstore/utils"
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openTestShardedDB(t *testing.T, sharding ShardingType) (*ShardedDB, string) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-sharded")
+	configs := ShardedConfigs{
+		Configs:  DefaultConfigs,
+		Sharding: sharding,
+	}
+	for _, name := range []string{"shard-0", "shard-1", "shard-2"} {
+		configs.DirPaths = append(configs.DirPaths, filepath.Join(dir, name))
+	}
+	if sharding == RangeSharding {
+		configs.RangeBoundaries = [][]byte{utils.GetTestKey(300), utils.GetTestKey(600)}
+	}
+	sdb, err := OpenSharded(configs)
+	assert.Nil(t, err)
+	return sdb, dir
+}
+
+func TestShardedDB(t *testing.T) {
+	for _, sharding := range []ShardingType{HashSharding, RangeSharding} {
+		sdb, dir := openTestShardedDB(t, sharding)
+
+		for i := 0; i < 1000; i++ {
+			assert.Nil(t, sdb.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+		}
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, sdb.Delete(utils.GetTestKey(i)))
+		}
+		val, err := sdb.Get(utils.GetTestKey(500))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(500), val)
+		_, err = sdb.Get(utils.GetTestKey(1))
+		assert.Equal(t, ErrorKeyNotFound, err)
+		assert.Equal(t, uint(900), sdb.Stat().KeyNum)
+		for _, db := range sdb.shards {
+			assert.True(t, db.Stat().KeyNum > 0)
+		}
+
+		// keys of all shards in order
+		keys := sdb.ListKeys()
+		assert.Equal(t, 900, len(keys))
+		for i := 1; i < len(keys); i++ {
+			assert.True(t, bytes.Compare(keys[i-1], keys[i]) < 0)
+		}
+		iterConfigs := DefaultIteratorConfigs
+		iterConfigs.Reverse = true
+		iter := sdb.NewIterator(iterConfigs)
+		assert.Equal(t, utils.GetTestKey(999), iter.Key())
+		iter.Seek(utils.GetTestKey(500))
+		assert.Equal(t, utils.GetTestKey(500), iter.Key())
+		iter.Next()
+		assert.Equal(t, utils.GetTestKey(499), iter.Key())
+		iter.Close()
+		iter = sdb.NewIterator(DefaultIteratorConfigs)
+		iter.SeekForPrev(utils.GetTestKey(50))
+		assert.False(t, iter.Valid())
+		iter.SeekForPrev(append(utils.GetTestKey(500), '0'))
+		assert.Equal(t, utils.GetTestKey(500), iter.Key())
+		iter.Next()
+		assert.Equal(t, utils.GetTestKey(501), iter.Key())
+		value, err := iter.Value()
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(501), value)
+		iter.Close()
+
+		assert.Nil(t, sdb.Close())
+		assert.Nil(t, os.RemoveAll(dir))
+	}
+}
+
+func TestShardedDB_WriteBatch(t *testing.T) {
+	sdb, dir := openTestShardedDB(t, RangeSharding)
+	defer os.RemoveAll(dir)
+	defer sdb.Close()
+
+	wb := sdb.NewWriteBatch(DefaultWriteBatchConfigs)
+	assert.Nil(t, wb.Put(utils.GetTestKey(1), []byte("a")))
+	assert.Nil(t, wb.Put(utils.GetTestKey(2), []byte("b")))
+	assert.Equal(t, ErrorCrossShardBatch, wb.Put(utils.GetTestKey(700), []byte("c")))
+	_, err := sdb.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrorKeyNotFound, err)
+	assert.Nil(t, wb.Commit())
+	val, err := sdb.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("b"), val)
+	_, err = sdb.Get(utils.GetTestKey(700))
+	assert.Equal(t, ErrorKeyNotFound, err)
+}
+
+func TestShardedDB_Manifest(t *testing.T) {
+	sdb, dir := openTestShardedDB(t, RangeSharding)
+	defer os.RemoveAll(dir)
+	configs := sdb.configs
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, sdb.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	assert.Equal(t, WriteStallNone, sdb.Stat().WriteStall)
+	assert.Nil(t, sdb.Close())
+
+	// another sharding of the same dirs would misroute keys
+	changed := configs
+	changed.RangeBoundaries = [][]byte{utils.GetTestKey(200), utils.GetTestKey(600)}
+	_, err := OpenSharded(changed)
+	assert.Equal(t, ErrorShardManifestMismatch, err)
+	changed = configs
+	changed.Sharding = HashSharding
+	changed.RangeBoundaries = nil
+	_, err = OpenSharded(changed)
+	assert.Equal(t, ErrorShardManifestMismatch, err)
+	changed = configs
+	changed.DirPaths = []string{configs.DirPaths[1], configs.DirPaths[0], configs.DirPaths[2]}
+	_, err = OpenSharded(changed)
+	assert.Equal(t, ErrorShardManifestMismatch, err)
+	changed = configs
+	changed.DirPaths = append(append([]string{}, configs.DirPaths...), filepath.Join(dir, "shard-3"))
+	changed.RangeBoundaries = append(append([][]byte{}, configs.RangeBoundaries...), utils.GetTestKey(900))
+	_, err = OpenSharded(changed)
+	assert.Equal(t, ErrorShardManifestMismatch, err)
+	// a refused open writes no manifest
+	_, err = os.Stat(filepath.Join(dir, "shard-3", ShardManifestFileName))
+	assert.True(t, os.IsNotExist(err))
+
+	sdb, err = OpenSharded(configs)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, len(sdb.ListKeys()))
+	assert.Nil(t, sdb.Close())
+}
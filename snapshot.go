@@ -0,0 +1,290 @@
+package KVstore
+
+import (
+	"KVstore/data"
+	"KVstore/fio"
+	"KVstore/index"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+)
+
+const (
+	indexSnapshotFinKey = "index-snapshot-fin"
+	// flush the snapshot buffer to file when it's bigger than this
+	snapshotBufferSize = 4 * 1024 * 1024
+)
+
+// the footer of index snapshot, records before (Fid, Offset) are in the snapshot
+type indexSnapshotFooter struct {
+	Fid         uint32
+	Offset      int64
+	SeqNo       uint64
+	ReclaimSize int64
+	Count       uint64
+	CRC         uint32 // crc of all entries
+}
+
+// an index written to the snapshot, keys of namespaces are stored as record keys
+type snapshotSource struct {
+	index       index.Indexer
+	inNamespace bool
+	id          uint32
+}
+
+// CheckpointIndex write the in-memory index to the snapshot file,
+// so that Open only replays records written after it.
+// B+ tree index is already persistent, nothing to do.
+func (db *DB) CheckpointIndex() error {
+	if db.config.ReadOnly {
+		return ErrorReadOnly
+	}
+	if db.config.IndexerType == index.BPTree {
+		return nil
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	return db.checkpointIndex()
+}
+
+// need a mutex before reaching this func
+func (db *DB) checkpointIndex() error {
+	footer := indexSnapshotFooter{
+		SeqNo:       db.seqNo,
+		ReclaimSize: db.reclaimSize,
+	}
+	if db.activeFile != nil {
+		// the snapshot must not cover records which may be lost
+		if err := db.syncActiveFile(); err != nil {
+			return err
+		}
+		footer.Fid = db.activeFile.FileId
+		footer.Offset = db.activeFile.WriteOffset
+	}
+
+	// write to a temp file then rename, never leave a half snapshot
+	tempName := filepath.Join(db.config.DirPath, data.IndexSnapshotFileName+".tmp")
+	_ = os.Remove(tempName)
+	snapshotFile, err := data.NewDataFile(tempName, 0, fio.StandardIO)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	crc := crc32.NewIEEE()
+	// the namespace registry goes before namespaces, they are created first on load
+	sources := []snapshotSource{{index: db.index}, {index: db.namespaceMeta, inNamespace: true, id: metaNamespaceId}}
+	for _, ns := range db.namespaceIds {
+		sources = append(sources, snapshotSource{index: ns.index, inNamespace: true, id: ns.id})
+	}
+	writeEntry := func(record *data.LogRecord) error {
+		encRecord, _ := data.EncodeLogRecord(record)
+		_, _ = crc.Write(encRecord)
+		buf.Write(encRecord)
+		footer.Count++
+		if buf.Len() >= snapshotBufferSize {
+			if err := snapshotFile.Write(buf.Bytes()); err != nil {
+				return err
+			}
+			buf.Reset()
+		}
+		return nil
+	}
+	for _, source := range sources {
+		iter := source.index.Iterator(false)
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			key := iter.Key()
+			if source.inNamespace {
+				key = namespaceKey(source.id, key)
+			}
+			err := writeEntry(&data.LogRecord{
+				Key:   key,
+				Value: data.EncodeLogRecordPos(iter.Value()),
+			})
+			if err != nil {
+				iter.Close()
+				_ = snapshotFile.Close()
+				return err
+			}
+		}
+		iter.Close()
+	}
+	// the reclaimable size of each namespace, its key is the namespace key of an empty key
+	for _, ns := range db.namespaceIds {
+		buf := make([]byte, binary.MaxVarintLen64)
+		n := binary.PutVarint(buf, ns.reclaimSize)
+		if err := writeEntry(&data.LogRecord{Key: namespaceKey(ns.id, nil), Value: buf[:n]}); err != nil {
+			_ = snapshotFile.Close()
+			return err
+		}
+	}
+	// operand chains go after the index, loading the index would drop them
+	for key, chain := range db.operands {
+		err := writeEntry(&data.LogRecord{
+			Key:   []byte(key),
+			Value: encodeOperandChain(chain),
+			Type:  data.MERGE_OPERAND,
+		})
+		if err != nil {
+			_ = snapshotFile.Close()
+			return err
+		}
+	}
+	footer.CRC = crc.Sum32()
+	encRecord, _ := data.EncodeLogRecord(&data.LogRecord{
+		Key:   []byte(indexSnapshotFinKey),
+		Value: encodeSnapshotFooter(&footer),
+	})
+	buf.Write(encRecord)
+	if err := snapshotFile.Write(buf.Bytes()); err != nil {
+		_ = snapshotFile.Close()
+		return err
+	}
+	if err := snapshotFile.Sync(); err != nil {
+		_ = snapshotFile.Close()
+		return err
+	}
+	if err := snapshotFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempName, filepath.Join(db.config.DirPath, data.IndexSnapshotFileName))
+}
+
+// loadIndexSnapshot load the index from the snapshot file,
+// return false if there is no valid snapshot, then the index must be loaded from files
+func (db *DB) loadIndexSnapshot() (bool, error) {
+	fileName := filepath.Join(db.config.DirPath, data.IndexSnapshotFileName)
+	buf, err := os.ReadFile(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	// decode all entries before touching the index, a broken snapshot is just ignored
+	type entry struct {
+		key     []byte
+		pos     *data.LogRecordPos
+		chain   *operandChain // set for operand chains instead of pos
+		reclaim int64         // set for the reclaimable size of a namespace instead of pos
+	}
+	var entries []entry
+	var footer *indexSnapshotFooter
+	crc := crc32.NewIEEE()
+	var offset int64 = 0
+	for offset < int64(len(buf)) {
+		logRecord, size, err := data.DecodeLogRecord(buf[offset:])
+		if err != nil {
+			return false, nil
+		}
+		if string(logRecord.Key) == indexSnapshotFinKey {
+			footer = decodeSnapshotFooter(logRecord.Value)
+			break
+		}
+		_, _ = crc.Write(buf[offset : offset+size])
+		e := entry{key: logRecord.Key}
+		if logRecord.Type == data.MERGE_OPERAND {
+			var ok bool
+			if e.chain, ok = decodeOperandChain(logRecord.Value); !ok {
+				return false, nil
+			}
+		} else if _, nsKey, ok := parseNamespaceKey(logRecord.Key); ok && len(nsKey) == 0 {
+			var n int
+			if e.reclaim, n = binary.Varint(logRecord.Value); n <= 0 {
+				return false, nil
+			}
+		} else {
+			e.pos = data.DecodeLogRecordPos(logRecord.Value)
+		}
+		entries = append(entries, e)
+		offset += size
+	}
+	if footer == nil || footer.CRC != crc.Sum32() || footer.Count != uint64(len(entries)) {
+		return false, nil
+	}
+	// the data files covered by the snapshot must be still there
+	if len(db.fileIds) == 0 {
+		if footer.Count != 0 {
+			return false, nil
+		}
+	} else {
+		file := db.olderFiles[footer.Fid]
+		if db.activeFile.FileId == footer.Fid {
+			file = db.activeFile
+		}
+		if file == nil {
+			return false, nil
+		}
+		size, err := file.IOManager.Size()
+		if err != nil {
+			return false, err
+		}
+		if footer.Offset > size {
+			return false, nil
+		}
+	}
+
+	for _, e := range entries {
+		if e.chain != nil {
+			db.operands[string(e.key)] = e.chain
+			continue
+		}
+		if e.pos == nil {
+			id, _, _ := parseNamespaceKey(e.key)
+			if ns, ok := db.namespaceIds[id]; ok {
+				ns.reclaimSize = e.reclaim
+			}
+			continue
+		}
+		if err := db.updateIndex(e.key, data.PUT, e.pos); err != nil {
+			return false, err
+		}
+	}
+	db.seqNo = footer.SeqNo
+	db.reclaimSize = footer.ReclaimSize
+	db.snapshotPos = &data.LogRecordPos{Fid: footer.Fid, Offset: footer.Offset}
+	return true, nil
+}
+
+// removeIndexSnapshot is called when data files are replaced by merge
+func (db *DB) removeIndexSnapshot() error {
+	fileName := filepath.Join(db.config.DirPath, data.IndexSnapshotFileName)
+	if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Fid Offset SeqNo ReclaimSize Count || CRC
+func encodeSnapshotFooter(footer *indexSnapshotFooter) []byte {
+	buf := make([]byte, binary.MaxVarintLen32+binary.MaxVarintLen64*4+crc32.Size)
+	var index = 0
+	index += binary.PutUvarint(buf[index:], uint64(footer.Fid))
+	index += binary.PutVarint(buf[index:], footer.Offset)
+	index += binary.PutUvarint(buf[index:], footer.SeqNo)
+	index += binary.PutVarint(buf[index:], footer.ReclaimSize)
+	index += binary.PutUvarint(buf[index:], footer.Count)
+	binary.LittleEndian.PutUint32(buf[index:], footer.CRC)
+	return buf[:index+crc32.Size]
+}
+func decodeSnapshotFooter(buf []byte) *indexSnapshotFooter {
+	var footer indexSnapshotFooter
+	var index = 0
+	fid, n := binary.Uvarint(buf[index:])
+	footer.Fid = uint32(fid)
+	index += n
+	footer.Offset, n = binary.Varint(buf[index:])
+	index += n
+	footer.SeqNo, n = binary.Uvarint(buf[index:])
+	index += n
+	footer.ReclaimSize, n = binary.Varint(buf[index:])
+	index += n
+	footer.Count, n = binary.Uvarint(buf[index:])
+	index += n
+	if index+crc32.Size != len(buf) {
+		return nil
+	}
+	footer.CRC = binary.LittleEndian.Uint32(buf[index:])
+	return &footer
+}
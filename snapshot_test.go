@@ -0,0 +1,88 @@
+package KVstore
+
+import (
+	"KVstore/data"
+	"KVstore/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// close files without Close, as if the process crashed
+func crashDB(db *DB) {
+	_ = db.activeFile.Close()
+	for _, file := range db.olderFiles {
+		_ = file.Close()
+	}
+	_ = db.index.Close()
+	_ = db.fileLock.Unlock()
+}
+
+func TestDB_IndexSnapshot(t *testing.T) {
+	opts := DefaultConfigs
+	dir, _ := os.MkdirTemp("", "bitcask-go-snapshot")
+	opts.DirPath = dir + "/"
+	opts.DataFileSize = 64 * 1024
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.snapshotPos)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Delete(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// loaded from the snapshot written by Close
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.NotNil(t, db2.snapshotPos)
+	assert.Equal(t, 999, db2.index.Size())
+	assert.Equal(t, db.reclaimSize, db2.reclaimSize)
+	val, err := db2.Get(utils.GetTestKey(999))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(999), val)
+
+	// records after the checkpoint are replayed
+	err = db2.CheckpointIndex()
+	assert.Nil(t, err)
+	err = db2.Put(utils.GetTestKey(2000), utils.GetTestKey(2000))
+	assert.Nil(t, err)
+	err = db2.Delete(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	wb := db2.NewWriteBatch(DefaultWriteBatchConfigs)
+	err = wb.Put(utils.GetTestKey(3000), utils.GetTestKey(3000))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+	crashDB(db2)
+
+	db3, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, db3.index.Size())
+	_, err = db3.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrorKeyNotFound, err)
+	val, err = db3.Get(utils.GetTestKey(3000))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(3000), val)
+	assert.Equal(t, uint64(1), db3.seqNo)
+	err = db3.Close()
+	assert.Nil(t, err)
+
+	// a broken snapshot is ignored
+	snapshotName := filepath.Join(opts.DirPath, data.IndexSnapshotFileName)
+	buf, err := os.ReadFile(snapshotName)
+	assert.Nil(t, err)
+	buf[len(buf)/2]++
+	err = os.WriteFile(snapshotName, buf, 0644)
+	assert.Nil(t, err)
+	db4, err := Open(opts)
+	defer destroyDB(db4)
+	assert.Nil(t, err)
+	assert.Nil(t, db4.snapshotPos)
+	assert.Equal(t, 1000, db4.index.Size())
+}
@@ -0,0 +1,121 @@
+package KVstore
+
+import (
+	"context"
+	"time"
+)
+
+// WriteStall how writes are held back by the disk usage and reclaimable ratio limits
+type WriteStall int8
+
+const (
+	WriteStallNone WriteStall = iota
+	// past a soft limit, writes wait for WriteSlowdownDelay and a merge is requested
+	WriteStallSlowdown
+	// past a hard limit, writes fail with ErrorWriteStopped
+	WriteStallStop
+)
+
+func (s WriteStall) String() string {
+	switch s {
+	case WriteStallSlowdown:
+		return "slowdown"
+	case WriteStallStop:
+		return "stop"
+	default:
+		return "none"
+	}
+}
+
+// need a mutex before reaching this func
+func (db *DB) writeStall() WriteStall {
+	diskSize, reclaimSize := db.stallSizes()
+	var ratio float32
+	if diskSize > 0 {
+		ratio = float32(reclaimSize) / float32(diskSize)
+	}
+	config := db.config
+	if (config.DiskHardLimit > 0 && diskSize >= config.DiskHardLimit) ||
+		(config.ReclaimHardRatio > 0 && ratio >= config.ReclaimHardRatio) {
+		return WriteStallStop
+	}
+	if (config.DiskSoftLimit > 0 && diskSize >= config.DiskSoftLimit) ||
+		(config.ReclaimSoftRatio > 0 && ratio >= config.ReclaimSoftRatio) {
+		return WriteStallSlowdown
+	}
+	return WriteStallNone
+}
+
+// the disk size counts the finished merge until the next Open installs it and
+// removes the files it replaces. The reclaimable size handled by it is not counted,
+// merging again doesn't give back more.
+// need a mutex before reaching this func
+func (db *DB) stallSizes() (int64, int64) {
+	return db.diskSize + db.mergeDirSize, db.reclaimSize - db.mergedReclaimSize
+}
+
+// waitWriteStall wait for WriteSlowdownDelay if writes are slowed down,
+// a batch only waits once, on commit
+func (db *DB) waitWriteStall(ctx context.Context) error {
+	if err := db.rlockContext(ctx); err != nil {
+		return err
+	}
+	stall := db.writeStall()
+	db.mutex.RUnlock()
+	if stall != WriteStallSlowdown {
+		return nil
+	}
+	timer := time.NewTimer(db.config.WriteSlowdownDelay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// checkWriteStall is called before appending a record
+// need a mutex before reaching this func
+func (db *DB) checkWriteStall() error {
+	stall := db.writeStall()
+	if stall != db.lastWriteStall {
+		db.config.Logger.Warn("write stall changed", "from", db.lastWriteStall, "to", stall,
+			"disk_size", db.diskSize, "reclaimable_size", db.reclaimSize)
+		db.config.EventListener.OnWriteStallChange(db.lastWriteStall, stall)
+		db.lastWriteStall = stall
+	}
+	switch stall {
+	case WriteStallStop:
+		db.requestMerge()
+		return ErrorWriteStopped
+	case WriteStallSlowdown:
+		db.requestMerge()
+	}
+	return nil
+}
+
+// requestMerge start a merge in the background if the merge ratio is reached,
+// the space is given back when the merged files are installed by the next Open
+// need a mutex before reaching this func
+func (db *DB) requestMerge() {
+	if db.mergeDone != nil || db.isMerging || db.isClosed {
+		return
+	}
+	diskSize, reclaimSize := db.stallSizes()
+	if diskSize <= 0 || float32(reclaimSize)/float32(diskSize) < db.config.DataFileMergeRatio {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	db.mergeCancel, db.mergeDone = cancel, done
+	go func() {
+		defer close(done)
+		defer cancel()
+		// request it again on a later write if the stall is still there
+		_ = db.MergeContext(ctx)
+		db.mutex.Lock()
+		db.mergeCancel, db.mergeDone = nil, nil
+		db.mutex.Unlock()
+	}()
+}